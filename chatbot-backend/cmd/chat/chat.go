@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -20,6 +21,10 @@ func main() {
 
 	dbPathFlag := flag.String("db", "", "Path to the database file (overrides DATABASE_PATH env var)")
 	apiKeyFlag := flag.String("api-key", "", "OpenAI API key (overrides OPENAI_API_KEY env var)")
+	llmProviderFlag := flag.String("llm-provider", "", "LLM provider: openai, openai-compatible or fake (overrides LLM_PROVIDER env var)")
+	llmBaseURLFlag := flag.String("llm-base-url", "", "Base URL of an OpenAI-compatible LLM server (overrides LLM_BASE_URL env var)")
+	llmModelFlag := flag.String("llm-model", "", "LLM model name (overrides LLM_MODEL env var)")
+	embeddingProviderFlag := flag.String("embedding-provider", "", "Embedding provider: openai or local (overrides EMBEDDING_PROVIDER env var)")
 	flag.Parse()
 
 	dbPath := *dbPathFlag
@@ -33,8 +38,22 @@ func main() {
 	apiKey := *apiKeyFlag
 	if apiKey != "" {
 		os.Setenv("OPENAI_API_KEY", apiKey)
-	} else if os.Getenv("OPENAI_API_KEY") == "" {
-		log.Fatal("Error: No OpenAI API key provided. Use --api-key flag or set OPENAI_API_KEY environment variable")
+	}
+
+	llmConfig := backend.LLMConfigFromEnv()
+	if *llmProviderFlag != "" {
+		llmConfig.Provider = *llmProviderFlag
+	}
+	if *llmBaseURLFlag != "" {
+		llmConfig.BaseURL = *llmBaseURLFlag
+	}
+	if *llmModelFlag != "" {
+		llmConfig.Model = *llmModelFlag
+	}
+
+	embeddingConfig := backend.EmbeddingConfigFromEnv()
+	if *embeddingProviderFlag != "" {
+		embeddingConfig.Provider = *embeddingProviderFlag
 	}
 
 	database, err := backend.GetDB(dbPath)
@@ -43,24 +62,27 @@ func main() {
 	}
 	defer backend.Close(database)
 
-	embeddingClient, err := backend.NewEmbeddingClient()
+	embedder, err := backend.NewEmbedder(embeddingConfig)
 	if err != nil {
-		log.Fatalf("Error creating embeddings client: %v", err)
+		log.Fatalf("Error creating embedder: %v", err)
+	}
+	if err := backend.UseEmbedder(database, embedder); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 
-	llmClient, err := backend.NewLLMClient()
+	llm, err := backend.NewLLMProvider(llmConfig)
 	if err != nil {
-		log.Fatalf("Error creating LLM client: %v", err)
+		log.Fatalf("Error creating LLM provider: %v", err)
 	}
 
-	bot := chatbot.NewChatBot(database, embeddingClient, llmClient)
+	bot := chatbot.NewChatBotWithOptions(database, embedder, llm, chatbot.OptionsFromEnv(embedder))
 
 	fmt.Println("Welcome to the Chatbot CLI!")
 	fmt.Println("Type 'exit' or 'quit' to end the session.")
 	fmt.Println("Type 'clear' to clear the conversation history.")
 	fmt.Println("---------------------------------------------")
 
-	history := ""
+	conversationID := ""
 	scanner := bufio.NewScanner(os.Stdin)
 
 	for {
@@ -80,24 +102,22 @@ func main() {
 		}
 
 		if userInput == "clear" {
-			history = ""
+			conversationID = ""
 			fmt.Println("Conversation history cleared.")
 			continue
 		}
 
-		if history != "" {
-			history += "\n"
-		}
-		history += "User: " + userInput
-
-		response, _, sources, err := chatbot.Chat(bot, 1, userInput, history)
+		result, err := chatbot.ChatInConversation(context.Background(), bot, 1, conversationID, userInput, backend.SearchFilter{})
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			continue
 		}
+		conversationID = result.ConversationID
+		response, sources := result.Response, result.Sources
 
-		history += "\nBot: " + response
-
+		if result.RewrittenQuery != "" {
+			fmt.Println("\n(Searched for:", result.RewrittenQuery+")")
+		}
 		fmt.Println("\nBot:", response)
 
 		if len(sources) > 0 {
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Epistemic-Technology/epistemic.technology/chatbot-backend/internal/backend"
 	"github.com/joho/godotenv"
@@ -37,6 +41,14 @@ func main() {
 		listChunks(os.Args[2:])
 	case "list-chunks-for-document":
 		listChunksForDocument(os.Args[2:])
+	case "search":
+		search(os.Args[2:])
+	case "migrate-status":
+		migrateStatus(os.Args[2:])
+	case "migrate-up":
+		migrateUp(os.Args[2:])
+	case "reembed":
+		reembed(os.Args[2:])
 	default:
 		fmt.Printf("Unknown command: %s\n", os.Args[1])
 		printUsage()
@@ -46,13 +58,17 @@ func main() {
 
 func printUsage() {
 	fmt.Println("Usage:")
-	fmt.Println("  cli embed-hugo-directory <directory> [--recursive] [--db=<path>]")
-	fmt.Println("  cli embed-hugo-file <file> [--db=<path>]")
+	fmt.Println("  cli embed-hugo-directory <directory> [--recursive] [--db=<path>] [--embedding-provider=<provider>] [--chunk-strategy=<strategy>]")
+	fmt.Println("  cli embed-hugo-file <file> [--db=<path>] [--embedding-provider=<provider>] [--chunk-strategy=<strategy>]")
 	fmt.Println("  cli list-documents [--db=<path>]")
 	fmt.Println("  cli get-document-details <document_id> [--db=<path>]")
 	fmt.Println("  cli get-db-stats [--db=<path>]")
 	fmt.Println("  cli list-chunks [--db=<path>]")
 	fmt.Println("  cli list-chunks-for-document <document_id> [--db=<path>]")
+	fmt.Println("  cli search <query> [--mode=hybrid|vector|keyword] [--limit=<n>] [--keyword-weight=<w>] [--vector-weight=<w>] [--max-distance=<d>] [--mmr-lambda=<l>] [--max-chunks-per-document=<n>] [--reranker=none|keyword|llm] [--rerank-candidates=<n>] [--section=<a,b>] [--tag=<a,b>] [--category=<a,b>] [--from=<YYYY-MM-DD>] [--to=<YYYY-MM-DD>] [--document-ids=<1,2>] [--db=<path>] [--embedding-provider=<provider>]")
+	fmt.Println("  cli migrate-status [--db=<path>]")
+	fmt.Println("  cli migrate-up [--db=<path>]")
+	fmt.Println("  cli reembed [--embedding-provider=<provider>] [--embedding-model=<model>] [--embedding-dimensions=<n>] [--batch-size=<n>] [--db=<path>]")
 }
 
 func parseArgs(args []string) ([]string, map[string]string) {
@@ -87,6 +103,42 @@ func getDBPath(args []string) string {
 	return dbPath
 }
 
+func getEmbedder(args []string) backend.Embedder {
+	_, namedArgs := parseArgs(args)
+	config := backend.EmbeddingConfigFromEnv()
+	if namedArgs["embedding-provider"] != "" {
+		config.Provider = namedArgs["embedding-provider"]
+	}
+	if namedArgs["embedding-model"] != "" {
+		config.Model = namedArgs["embedding-model"]
+	}
+	if namedArgs["embedding-dimensions"] != "" {
+		dimensions, err := strconv.Atoi(namedArgs["embedding-dimensions"])
+		if err != nil {
+			log.Fatalf("Error: Invalid embedding dimensions: %v", err)
+		}
+		config.Dimensions = dimensions
+	}
+	embedder, err := backend.NewEmbedder(config)
+	if err != nil {
+		log.Fatalf("Error creating embedder: %v", err)
+	}
+	return embedder
+}
+
+func getChunker(args []string) backend.Chunker {
+	_, namedArgs := parseArgs(args)
+	config := backend.ChunkerConfigFromEnv()
+	if namedArgs["chunk-strategy"] != "" {
+		config.Strategy = namedArgs["chunk-strategy"]
+	}
+	chunker, err := backend.NewChunker(config)
+	if err != nil {
+		log.Fatalf("Error creating chunker: %v", err)
+	}
+	return chunker
+}
+
 func embedHugoDirectory(args []string) {
 	positionalArgs, namedArgs := parseArgs(args)
 	if len(positionalArgs) < 1 {
@@ -103,7 +155,7 @@ func embedHugoDirectory(args []string) {
 		log.Fatalf("Error: Directory %s does not exist", directory)
 	}
 
-	fmt.Printf("Embedding Hugo directory: %s (recursive: %v)\n", directory, recursive)
+	fmt.Printf("Syncing Hugo directory: %s (recursive: %v)\n", directory, recursive)
 	fmt.Printf("Using database: %s\n", dbPath)
 
 	// Connect to database
@@ -113,45 +165,19 @@ func embedHugoDirectory(args []string) {
 	}
 	defer backend.Close(database)
 
-	embeddingClient, err := backend.NewEmbeddingClient()
-	if err != nil {
-		log.Fatalf("Error creating embeddings client: %v", err)
-	}
-
-	// Process directory
-	docs, err := backend.HugoDirectoryToDocuments(directory, recursive)
-	if err != nil {
-		log.Fatalf("Error processing directory: %v", err)
-	}
-
-	fmt.Printf("Found %d documents\n", len(docs))
+	embedder := backend.NewCachingEmbedder(database, getEmbedder(args))
+	chunker := getChunker(args)
 
 	// Create a user for embedding generation
 	user := &backend.User{ID: 1}
 
-	for i, doc := range docs {
-		fmt.Printf("Processing document %d/%d: %s\n", i+1, len(docs), doc.Title)
-
-		if err := backend.InsertDocument(database, &doc); err != nil {
-			log.Fatalf("Error inserting document: %v", err)
-		}
-
-		chunks, err := backend.ChunkDocument(&doc, embeddingClient, user, database)
-		if err != nil {
-			log.Fatalf("Error creating chunks: %v", err)
-		}
-
-		fmt.Printf("Created %d chunks\n", len(chunks))
-
-		for j, chunk := range chunks {
-			chunk.DocumentID = doc.ID
-			if err := backend.InsertChunk(database, &chunk); err != nil {
-				log.Fatalf("Error inserting chunk %d: %v", j, err)
-			}
-		}
+	result, err := backend.SyncHugoDirectory(database, directory, recursive, chunker, embedder, user)
+	fmt.Printf("Embeddings: %s\n", embedder.Stats())
+	if err != nil {
+		log.Fatalf("Error syncing directory: %v", err)
 	}
 
-	fmt.Println("Done!")
+	fmt.Printf("Done! %s\n", result)
 }
 
 func embedHugoFile(args []string) {
@@ -169,7 +195,7 @@ func embedHugoFile(args []string) {
 		log.Fatalf("Error: File %s does not exist", filePath)
 	}
 
-	fmt.Printf("Embedding Hugo file: %s\n", filePath)
+	fmt.Printf("Syncing Hugo file: %s\n", filePath)
 	fmt.Printf("Using database: %s\n", dbPath)
 
 	// Connect to database
@@ -179,10 +205,8 @@ func embedHugoFile(args []string) {
 	}
 	defer backend.Close(database)
 
-	embeddingClient, err := backend.NewEmbeddingClient()
-	if err != nil {
-		log.Fatalf("Error creating embeddings client: %v", err)
-	}
+	embedder := backend.NewCachingEmbedder(database, getEmbedder(args))
+	chunker := getChunker(args)
 
 	// Process Hugo file
 	doc, err := backend.HugoToDocument(filePath)
@@ -190,28 +214,26 @@ func embedHugoFile(args []string) {
 		log.Fatalf("Error processing Hugo file: %v", err)
 	}
 
-	if err := backend.InsertDocument(database, &doc); err != nil {
-		log.Fatalf("Error inserting document: %v", err)
-	}
-
 	// Create a user for embedding generation
 	user := &backend.User{ID: 1}
 
-	chunks, err := backend.ChunkDocument(&doc, embeddingClient, user, database)
-	if err != nil {
-		log.Fatalf("Error creating chunks: %v", err)
+	// Sync just this file, which removes it if it is no longer published
+	docs := []backend.Document{}
+	if backend.IsPublished(doc.Metadata) && len(doc.Content) > 0 {
+		docs = append(docs, doc)
+	} else {
+		fmt.Println("File is empty, a draft or excluded from the site by its build options")
 	}
-
-	fmt.Printf("Created %d chunks\n", len(chunks))
-
-	for j, chunk := range chunks {
-		chunk.DocumentID = doc.ID
-		if err := backend.InsertChunk(database, &chunk); err != nil {
-			log.Fatalf("Error inserting chunk %d: %v", j, err)
-		}
+	inScope := func(path string) bool {
+		return filepath.Clean(path) == filepath.Clean(filePath)
+	}
+	result, err := backend.SyncDocuments(database, docs, inScope, chunker, embedder, user)
+	fmt.Printf("Embeddings: %s\n", embedder.Stats())
+	if err != nil {
+		log.Fatalf("Error syncing file: %v", err)
 	}
 
-	fmt.Println("Done!")
+	fmt.Printf("Done! %s\n", result)
 }
 
 func listDocuments(args []string) {
@@ -351,6 +373,18 @@ func getDBStats(args []string) {
 		log.Fatalf("Error getting chunks: %v", err)
 	}
 	fmt.Printf("Found %d chunks\n", len(chunks))
+
+	tables, err := backend.GetVectorTables(database)
+	if err != nil {
+		log.Fatalf("Error getting vector tables: %v", err)
+	}
+	for _, table := range tables {
+		if table.Active {
+			fmt.Printf("Embedding model: %s\n", table)
+		} else {
+			fmt.Printf("Unfinished re-embedding: %s in %s\n", table, table.Name)
+		}
+	}
 }
 
 func getDocumentDetails(args []string) {
@@ -399,6 +433,16 @@ func getDocumentDetails(args []string) {
 	if doc.FilePath != "" {
 		fmt.Printf("File: %s\n", doc.FilePath)
 	}
+	if doc.Section != "" {
+		fmt.Printf("Section: %s\n", doc.Section)
+	}
+	if len(doc.Metadata) > 0 {
+		metadata, err := json.MarshalIndent(doc.Metadata, "", "  ")
+		if err != nil {
+			log.Fatalf("Error encoding metadata: %v", err)
+		}
+		fmt.Printf("Metadata: %s\n", metadata)
+	}
 	fmt.Printf("Content length: %d characters\n", len(doc.Content))
 	fmt.Printf("Number of chunks: %d\n", len(chunks))
 
@@ -410,6 +454,264 @@ func getDocumentDetails(args []string) {
 	fmt.Printf("\nContent preview:\n%s\n", contentPreview)
 }
 
+func search(args []string) {
+	positionalArgs, namedArgs := parseArgs(args)
+	if len(positionalArgs) < 1 {
+		fmt.Println("Error: Missing query")
+		printUsage()
+		os.Exit(1)
+	}
+
+	query := strings.Join(positionalArgs, " ")
+	dbPath := getDBPath(args)
+
+	options := backend.DefaultHybridSearchOptions()
+	if namedArgs["limit"] != "" {
+		limit, err := strconv.Atoi(namedArgs["limit"])
+		if err != nil {
+			log.Fatalf("Error: Invalid limit: %v", err)
+		}
+		options.Limit = limit
+	}
+	if namedArgs["keyword-weight"] != "" {
+		weight, err := strconv.ParseFloat(namedArgs["keyword-weight"], 64)
+		if err != nil {
+			log.Fatalf("Error: Invalid keyword weight: %v", err)
+		}
+		options.KeywordWeight = weight
+	}
+	if namedArgs["vector-weight"] != "" {
+		weight, err := strconv.ParseFloat(namedArgs["vector-weight"], 64)
+		if err != nil {
+			log.Fatalf("Error: Invalid vector weight: %v", err)
+		}
+		options.VectorWeight = weight
+	}
+	if namedArgs["max-distance"] != "" {
+		maxDistance, err := strconv.ParseFloat(namedArgs["max-distance"], 64)
+		if err != nil {
+			log.Fatalf("Error: Invalid max distance: %v", err)
+		}
+		options.MaxDistance = maxDistance
+	}
+	if namedArgs["mmr-lambda"] != "" {
+		lambda, err := strconv.ParseFloat(namedArgs["mmr-lambda"], 64)
+		if err != nil {
+			log.Fatalf("Error: Invalid MMR lambda: %v", err)
+		}
+		options.MMRLambda = lambda
+	}
+	if namedArgs["max-chunks-per-document"] != "" {
+		maxChunks, err := strconv.Atoi(namedArgs["max-chunks-per-document"])
+		if err != nil {
+			log.Fatalf("Error: Invalid max chunks per document: %v", err)
+		}
+		options.MaxChunksPerDocument = maxChunks
+	}
+	options.Filter = parseSearchFilter(namedArgs)
+	rerankCandidates := 20
+	if namedArgs["rerank-candidates"] != "" {
+		candidates, err := strconv.Atoi(namedArgs["rerank-candidates"])
+		if err != nil {
+			log.Fatalf("Error: Invalid rerank candidates: %v", err)
+		}
+		rerankCandidates = candidates
+	}
+
+	database, err := backend.GetDB(dbPath)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+	defer backend.Close(database)
+
+	if !backend.HasFTS(database) {
+		fmt.Println("Warning: keyword search is unavailable; build with -tags sqlite_fts5")
+	}
+
+	mode := namedArgs["mode"]
+	if mode == "" {
+		mode = "hybrid"
+	}
+
+	reranker := getReranker(namedArgs["reranker"], database)
+	limit := options.Limit
+	options.Limit = max(options.Limit, rerankCandidates)
+
+	ctx := context.Background()
+	var chunks []backend.Chunk
+	switch mode {
+	case "keyword":
+		chunks, err = backend.FilteredKeywordSearch(ctx, database, query, options.Limit, options.Filter)
+	case "vector", "hybrid":
+		embedder := getEmbedder(args)
+		if err := backend.CheckEmbedder(database, embedder); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		embedding, embedErr := backend.CreateEmbedding(ctx, embedder, query, 1)
+		if embedErr != nil {
+			log.Fatalf("Error creating query embedding: %v", embedErr)
+		}
+		if mode == "vector" {
+			chunks, err = backend.FilteredSimilaritySearch(ctx, database, embedding, options.Limit, options.Filter)
+		} else {
+			chunks, err = backend.HybridSearch(ctx, database, query, embedding, options)
+		}
+	default:
+		log.Fatalf("Error: Unknown search mode: %s", mode)
+	}
+	if err != nil {
+		log.Fatalf("Error searching: %v", err)
+	}
+	chunks, err = reranker.Rerank(ctx, query, chunks, limit)
+	if err != nil {
+		log.Fatalf("Error reranking: %v", err)
+	}
+
+	fmt.Printf("Found %d chunks for %q (mode: %s):\n", len(chunks), query, mode)
+	for i, chunk := range chunks {
+		fmt.Printf("%d. ID: %d, Document ID: %d, Distance: %.4f, Score: %.4f\n", i+1, chunk.ID, chunk.DocumentID, chunk.Distance, chunk.Score)
+		content := chunk.Content
+		if len(content) > 100 {
+			content = content[:97] + "..."
+		}
+		fmt.Printf("  Content: %s\n", content)
+		fmt.Println()
+	}
+}
+
+// getReranker creates the named reranker, with an LLM provider configured from
+// the environment if it needs one.
+func getReranker(name string, database *backend.DB) backend.Reranker {
+	var llm backend.LLMProvider
+	if name == backend.RerankerLLM {
+		var err error
+		llm, err = backend.NewLLMProvider(backend.LLMConfigFromEnv())
+		if err != nil {
+			log.Fatalf("Error creating LLM provider: %v", err)
+		}
+	}
+	reranker, err := backend.NewReranker(name, database, llm)
+	if err != nil {
+		log.Fatalf("Error creating reranker: %v", err)
+	}
+	return reranker
+}
+
+// parseSearchFilter reads the search filter flags. Flags taking several
+// values are comma separated.
+func parseSearchFilter(namedArgs map[string]string) backend.SearchFilter {
+	list := func(name string) []string {
+		if namedArgs[name] == "" {
+			return nil
+		}
+		return strings.Split(namedArgs[name], ",")
+	}
+	date := func(name string) time.Time {
+		if namedArgs[name] == "" {
+			return time.Time{}
+		}
+		value, err := time.Parse(time.DateOnly, namedArgs[name])
+		if err != nil {
+			log.Fatalf("Error: Invalid --%s date: %v", name, err)
+		}
+		return value
+	}
+
+	filter := backend.SearchFilter{
+		Sections:      list("section"),
+		Tags:          list("tag"),
+		Categories:    list("category"),
+		PublishedFrom: date("from"),
+		PublishedTo:   date("to"),
+	}
+	for _, id := range list("document-ids") {
+		documentID, err := strconv.Atoi(id)
+		if err != nil {
+			log.Fatalf("Error: Invalid document ID: %v", err)
+		}
+		filter.DocumentIDs = append(filter.DocumentIDs, documentID)
+	}
+	return filter
+}
+
+func migrateStatus(args []string) {
+	dbPath := getDBPath(args)
+
+	// Open without migrating so pending migrations are shown
+	database, err := backend.OpenDB(dbPath)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+	defer backend.Close(database)
+
+	states, err := backend.MigrationStatus(database)
+	if err != nil {
+		log.Fatalf("Error getting migration status: %v", err)
+	}
+
+	pending := 0
+	for _, state := range states {
+		if state.Applied() {
+			fmt.Printf("  applied  %3d  %s (%s)\n", state.Version, state.Name, state.AppliedAt)
+		} else {
+			fmt.Printf("  pending  %3d  %s\n", state.Version, state.Name)
+			pending++
+		}
+	}
+	fmt.Printf("%d of %d migrations pending\n", pending, len(states))
+}
+
+func migrateUp(args []string) {
+	dbPath := getDBPath(args)
+
+	database, err := backend.OpenDB(dbPath)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+	defer backend.Close(database)
+
+	if err := backend.Migrate(database); err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+	fmt.Println("Database is up to date")
+}
+
+func reembed(args []string) {
+	_, namedArgs := parseArgs(args)
+	dbPath := getDBPath(args)
+	batchSize := 100
+	if namedArgs["batch-size"] != "" {
+		size, err := strconv.Atoi(namedArgs["batch-size"])
+		if err != nil {
+			log.Fatalf("Error: Invalid batch size: %v", err)
+		}
+		batchSize = size
+	}
+
+	database, err := backend.GetDB(dbPath)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+	defer backend.Close(database)
+
+	active, err := backend.ActiveVectorTable(database)
+	if err != nil {
+		log.Fatalf("Error getting embedding model: %v", err)
+	}
+	embedder := backend.NewCachingEmbedder(database, getEmbedder(args))
+	fmt.Printf("Re-embedding %s from %s to %s (%d dimensions)\n", dbPath, active, embedder.Model(), embedder.Dimensions())
+
+	user := &backend.User{ID: 1}
+	table, err := backend.Reembed(context.Background(), database, embedder, user, batchSize, func(done int, total int) {
+		fmt.Printf("Embedded %d of %d chunks\n", done, total)
+	})
+	fmt.Printf("Embeddings: %s\n", embedder.Stats())
+	if err != nil {
+		log.Fatalf("Error re-embedding: %v", err)
+	}
+	fmt.Printf("Done! The database now uses %s. Set EMBEDDING_PROVIDER, EMBEDDING_MODEL and EMBEDDING_DIMENSIONS to match and restart the server.\n", table)
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -3,10 +3,12 @@ module github.com/Epistemic-Technology/epistemic.technology/chatbot-backend
 go 1.24.1
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/asg017/sqlite-vec-go-bindings v0.1.6
 	github.com/joho/godotenv v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/openai/openai-go v0.1.0-alpha.59
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -1,31 +1,115 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
 
 	"github.com/Epistemic-Technology/epistemic.technology/chatbot-backend/internal/backend"
 	"github.com/Epistemic-Technology/epistemic.technology/chatbot-backend/internal/chatbot"
 )
 
+// ChatRequest asks a query within the conversation with ConversationID. An
+// empty or expired ConversationID starts a new conversation. Filters, if set,
+// restrict the documents used to answer. Debug adds details of how the
+// response was produced to the ChatResponse.
 type ChatRequest struct {
-	Query   string `json:"query"`
-	History string `json:"history"`
+	Query          string       `json:"query"`
+	ConversationID string       `json:"conversation_id"`
+	Filters        *ChatFilters `json:"filters,omitempty"`
+	Debug          bool         `json:"debug,omitempty"`
 }
 
+// ChatFilters is the JSON form of backend.SearchFilter. Dates are given as
+// YYYY-MM-DD or RFC 3339 timestamps.
+type ChatFilters struct {
+	Sections      []string `json:"sections"`
+	Tags          []string `json:"tags"`
+	Categories    []string `json:"categories"`
+	PublishedFrom string   `json:"published_from"`
+	PublishedTo   string   `json:"published_to"`
+	DocumentIDs   []int    `json:"document_ids"`
+}
+
+func (f *ChatFilters) searchFilter() (backend.SearchFilter, error) {
+	if f == nil {
+		return backend.SearchFilter{}, nil
+	}
+	filter := backend.SearchFilter{
+		Sections:    f.Sections,
+		Tags:        f.Tags,
+		Categories:  f.Categories,
+		DocumentIDs: f.DocumentIDs,
+	}
+	var err error
+	if filter.PublishedFrom, err = parseFilterDate(f.PublishedFrom); err != nil {
+		return backend.SearchFilter{}, fmt.Errorf("invalid published_from: %w", err)
+	}
+	if filter.PublishedTo, err = parseFilterDate(f.PublishedTo); err != nil {
+		return backend.SearchFilter{}, fmt.Errorf("invalid published_to: %w", err)
+	}
+	return filter, nil
+}
+
+func parseFilterDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ChatResponse is the answer to a ChatRequest. Sources holds only the
+// documents the response cites, and each of Citations maps a span of the
+// response to one of them. Uncited is set when the response cites nothing.
 type ChatResponse struct {
-	Response   string             `json:"response"`
-	References []backend.Chunk    `json:"references"`
-	Sources    []backend.Document `json:"sources"`
+	ConversationID string             `json:"conversation_id"`
+	RewrittenQuery string             `json:"rewritten_query,omitempty"`
+	Response       string             `json:"response"`
+	References     []backend.Chunk    `json:"references"`
+	Sources        []backend.Document `json:"sources"`
+	Citations      []Citation         `json:"citations"`
+	Uncited        bool               `json:"uncited"`
+	Debug          *ChatDebug         `json:"debug,omitempty"`
+}
+
+// ChatDebug is included in a ChatResponse when the request asks for it.
+// Verification is the check of the response against the documents it was
+// generated from, if verification is enabled, and VerificationAction is
+// "regenerate" or "fallback" if the response failed it.
+type ChatDebug struct {
+	Verification       *backend.Verification `json:"verification"`
+	VerificationAction string                `json:"verification_action,omitempty"`
+}
+
+// Citation is the JSON form of backend.Citation. Marker is the number of the
+// cited passage, and Start and End are the offsets in the response, in UTF-16
+// code units as used by JavaScript strings, of the text that cites it. The
+// response itself contains no citation markers.
+type Citation struct {
+	Marker     int `json:"marker"`
+	Start      int `json:"start"`
+	End        int `json:"end"`
+	ChunkID    int `json:"chunk_id"`
+	DocumentID int `json:"document_id"`
 }
 
 func StartAPI(bot *chatbot.ChatBot) {
 	http.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
 		HandleChat(w, r, bot)
 	})
+	http.HandleFunc("/chat/stream", func(w http.ResponseWriter, r *http.Request) {
+		HandleChatStream(w, r, bot)
+	})
 
 	port := ":" + os.Getenv("PORT")
 	fmt.Printf("Server starting on port %s...\n", port)
@@ -40,32 +124,167 @@ func HandleChat(w http.ResponseWriter, r *http.Request, bot *chatbot.ChatBot) {
 		return
 	}
 
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		HandleChatStream(w, r, bot)
+		return
+	}
+
 	// Parse the request
 	var req ChatRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request format", http.StatusBadRequest)
 		return
 	}
+	filter, err := req.Filters.searchFilter()
+	if err != nil {
+		http.Error(w, "Invalid filters: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	log.Println("Received chat request: ", req.Query)
 
-	// Process the chat request
-	response, references, sources, err := chatbot.Chat(bot, 1, req.Query, req.History)
+	// Process the chat request, stopping if the client goes away
+	result, err := chatbot.ChatInConversation(r.Context(), bot, 1, req.ConversationID, req.Query, filter)
 	if err != nil {
-		http.Error(w, "Error processing chat: "+err.Error(), http.StatusInternalServerError)
+		if logChatError(r, err) {
+			return
+		}
+		http.Error(w, "Error processing chat: "+err.Error(), chatErrorStatus(err))
 		return
 	}
-	log.Println("Response: ", response)
+	log.Println("Response: ", result.Response)
 	// Return the response
-	resp := ChatResponse{
-		Response:   response,
-		References: references,
-		Sources:    sources,
-	}
+	resp := newChatResponse(result, req.Debug)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// HandleChatStream answers a chat request as a stream of Server-Sent Events.
+// Each piece of the response is sent as a "delta" event, followed by a single
+// "done" event carrying the full ChatResponse. Failures are reported as an
+// "error" event.
+func HandleChatStream(w http.ResponseWriter, r *http.Request, bot *chatbot.ChatBot) {
+	if setCORSHeaders(w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	filter, err := req.Filters.searchFilter()
+	if err != nil {
+		http.Error(w, "Invalid filters: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Println("Received streaming chat request: ", req.Query)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	result, err := chatbot.ChatInConversationStream(r.Context(), bot, 1, req.ConversationID, req.Query, filter, func(delta string) error {
+		return writeEvent(w, flusher, "delta", StreamDelta{Delta: delta})
+	})
+	if err != nil {
+		if logChatError(r, err) {
+			return
+		}
+		writeEvent(w, flusher, "error", StreamError{Error: "Error processing chat: " + err.Error()})
+		return
+	}
+	log.Println("Response: ", result.Response)
+
+	writeEvent(w, flusher, "done", newChatResponse(result, req.Debug))
+}
+
+func newChatResponse(result chatbot.ChatResult, debug bool) ChatResponse {
+	citations := make([]Citation, len(result.Citations))
+	for i, citation := range result.Citations {
+		citations[i] = Citation{
+			Marker:     citation.Marker,
+			Start:      utf16Offset(result.Response, citation.Start),
+			End:        utf16Offset(result.Response, citation.End),
+			ChunkID:    citation.ChunkID,
+			DocumentID: citation.DocumentID,
+		}
+	}
+	resp := ChatResponse{
+		ConversationID: result.ConversationID,
+		RewrittenQuery: result.RewrittenQuery,
+		Response:       result.Response,
+		References:     result.References,
+		Sources:        result.Sources,
+		Citations:      citations,
+		Uncited:        result.Uncited,
+	}
+	if debug {
+		resp.Debug = &ChatDebug{
+			Verification:       result.Verification,
+			VerificationAction: result.VerificationAction,
+		}
+	}
+	return resp
+}
+
+// utf16Offset converts a byte offset in s to an offset in UTF-16 code units.
+func utf16Offset(s string, offset int) int {
+	return len(utf16.Encode([]rune(s[:offset])))
+}
+
+// logChatError logs an error answering a chat request, distinguishing
+// requests cancelled by the client and stages that timed out from other
+// failures. It reports whether the client has gone, so no response should be
+// written.
+func logChatError(r *http.Request, err error) bool {
+	switch {
+	case errors.Is(r.Context().Err(), context.Canceled):
+		log.Println("Chat request cancelled by the client: ", err)
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Println("Chat request timed out: ", err)
+	default:
+		log.Println("Error processing chat: ", err)
+	}
+	return false
+}
+
+func chatErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+type StreamDelta struct {
+	Delta string `json:"delta"`
+}
+
+type StreamError struct {
+	Error string `json:"error"`
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", event, err)
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return fmt.Errorf("failed to write %s event: %w", event, err)
+	}
+	flusher.Flush()
+	return nil
+}
+
 func setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
 	log.Println("Setting CORS headers")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
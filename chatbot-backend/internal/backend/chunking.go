@@ -0,0 +1,461 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	ChunkStrategyMarkdown  = "markdown"
+	ChunkStrategyParagraph = "paragraph"
+)
+
+const (
+	DefaultChunkTargetTokens  = 300
+	DefaultChunkOverlapTokens = 40
+)
+
+// DocumentChunkOrdinal is the ordinal given to a chunk holding an entire
+// document rather than a position within it.
+const DocumentChunkOrdinal = -1
+
+// Chunker splits a document into the chunks that are embedded and retrieved.
+// The returned chunks have their content, hash, heading path and ordinal set
+// but no embeddings.
+type Chunker interface {
+	Chunk(doc *Document) []Chunk
+}
+
+// ChunkerConfig selects and configures a Chunker.
+type ChunkerConfig struct {
+	Strategy      string
+	TargetTokens  int
+	OverlapTokens int
+}
+
+// ChunkerConfigFromEnv reads the chunker configuration from CHUNK_STRATEGY,
+// CHUNK_TARGET_TOKENS and CHUNK_OVERLAP_TOKENS.
+func ChunkerConfigFromEnv() ChunkerConfig {
+	targetTokens, _ := strconv.Atoi(os.Getenv("CHUNK_TARGET_TOKENS"))
+	overlapTokens, _ := strconv.Atoi(os.Getenv("CHUNK_OVERLAP_TOKENS"))
+	return ChunkerConfig{
+		Strategy:      os.Getenv("CHUNK_STRATEGY"),
+		TargetTokens:  targetTokens,
+		OverlapTokens: overlapTokens,
+	}
+}
+
+// NewChunker creates the Chunker described by config. An empty strategy
+// defaults to markdown.
+func NewChunker(config ChunkerConfig) (Chunker, error) {
+	switch config.Strategy {
+	case "", ChunkStrategyMarkdown:
+		return NewMarkdownChunker(config.TargetTokens, config.OverlapTokens), nil
+	case ChunkStrategyParagraph:
+		return &ParagraphChunker{}, nil
+	default:
+		return nil, fmt.Errorf("unknown chunk strategy: %s", config.Strategy)
+	}
+}
+
+// ParagraphChunker splits a document on blank lines and adds the whole
+// document as a final chunk.
+type ParagraphChunker struct{}
+
+func (c *ParagraphChunker) Chunk(doc *Document) []Chunk {
+	chunks := []Chunk{}
+	headings := headingStack{}
+	for _, paragraph := range strings.Split(doc.Content, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if len(paragraph) == 0 {
+			continue
+		}
+		if level, text, ok := parseHeading(paragraph); ok {
+			headings.push(level, text)
+		}
+
+		chunks = append(chunks, Chunk{
+			DocumentID:  doc.ID,
+			Content:     paragraph,
+			Hash:        MakeHash(paragraph),
+			HeadingPath: headings.path(),
+			Ordinal:     len(chunks),
+		})
+	}
+
+	chunks = append(chunks, Chunk{
+		DocumentID: doc.ID,
+		Content:    doc.Content,
+		Hash:       MakeHash(doc.Content),
+		Ordinal:    DocumentChunkOrdinal,
+	})
+	return chunks
+}
+
+// MarkdownChunker splits a document along its Markdown structure. Chunks
+// never span a heading, and blocks within a section are packed together up to
+// TargetTokens. Headings, lists and code fences are kept whole where possible,
+// and blocks larger than the target are split on item, line or sentence
+// boundaries. When a section spans several chunks, each continuation starts
+// with up to OverlapTokens of the text preceding it. Fragments without any
+// letters or digits, such as thematic breaks, are dropped.
+type MarkdownChunker struct {
+	TargetTokens  int
+	OverlapTokens int
+}
+
+// NewMarkdownChunker creates a MarkdownChunker, using the defaults for
+// non-positive values.
+func NewMarkdownChunker(targetTokens int, overlapTokens int) *MarkdownChunker {
+	if targetTokens <= 0 {
+		targetTokens = DefaultChunkTargetTokens
+	}
+	if overlapTokens <= 0 {
+		overlapTokens = DefaultChunkOverlapTokens
+	}
+	if overlapTokens >= targetTokens {
+		overlapTokens = targetTokens / 4
+	}
+	return &MarkdownChunker{TargetTokens: targetTokens, OverlapTokens: overlapTokens}
+}
+
+func (c *MarkdownChunker) Chunk(doc *Document) []Chunk {
+	chunks := []Chunk{}
+	headings := headingStack{}
+	var headingLines []string
+	var overlap string
+	var body []markdownBlock
+
+	content := func(extra ...markdownBlock) string {
+		parts := append([]string{}, headingLines...)
+		if overlap != "" {
+			parts = append(parts, overlap)
+		}
+		for _, block := range append(body, extra...) {
+			parts = append(parts, block.text)
+		}
+		return strings.Join(parts, "\n\n")
+	}
+
+	emit := func() {
+		text := content()
+		if hasAlphanumeric(text) {
+			chunks = append(chunks, Chunk{
+				DocumentID:  doc.ID,
+				Content:     text,
+				Hash:        MakeHash(text),
+				HeadingPath: headings.path(),
+				Ordinal:     len(chunks),
+			})
+		}
+		headingLines = nil
+		overlap = ""
+		body = nil
+	}
+
+	splitBudget := c.TargetTokens - c.OverlapTokens - 1
+	if splitBudget < 1 {
+		splitBudget = 1
+	}
+
+	for _, block := range parseMarkdownBlocks(doc.Content) {
+		if block.kind == blockHeading {
+			if len(body) > 0 {
+				emit()
+			}
+			headings.push(block.level, block.heading)
+			headingLines = append(headingLines, block.text)
+			continue
+		}
+
+		for _, part := range splitBlock(block, splitBudget) {
+			if len(body) > 0 && EstimateTokens(content(part)) > c.TargetTokens {
+				previous := body[len(body)-1]
+				emit()
+				overlap = trailingText(previous, c.OverlapTokens)
+			}
+			body = append(body, part)
+		}
+	}
+	if len(body) > 0 {
+		emit()
+	}
+
+	return chunks
+}
+
+type headingStack [6]string
+
+func (h *headingStack) push(level int, text string) {
+	h[level-1] = text
+	for i := level; i < len(h); i++ {
+		h[i] = ""
+	}
+}
+
+func (h *headingStack) path() string {
+	parts := []string{}
+	for _, heading := range h {
+		if heading != "" {
+			parts = append(parts, heading)
+		}
+	}
+	return strings.Join(parts, " > ")
+}
+
+type blockKind int
+
+const (
+	blockParagraph blockKind = iota
+	blockHeading
+	blockList
+	blockCode
+)
+
+type markdownBlock struct {
+	kind    blockKind
+	text    string
+	level   int
+	heading string
+}
+
+var (
+	headingPattern       = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	thematicBreakPattern = regexp.MustCompile(`^\s{0,3}((\*\s*){3,}|(-\s*){3,}|(_\s*){3,})$`)
+	listItemPattern      = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+	fencePattern         = regexp.MustCompile("^\\s{0,3}(```+|~~~+)")
+)
+
+func parseHeading(line string) (int, string, bool) {
+	match := headingPattern.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil || strings.Contains(line, "\n") {
+		return 0, "", false
+	}
+	return len(match[1]), match[2], true
+}
+
+func parseMarkdownBlocks(content string) []markdownBlock {
+	blocks := []markdownBlock{}
+	var lines []string
+	kind := blockParagraph
+	fence := ""
+
+	flush := func() {
+		if len(lines) > 0 {
+			blocks = append(blocks, markdownBlock{kind: kind, text: strings.Join(lines, "\n")})
+		}
+		lines = nil
+		kind = blockParagraph
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if fence != "" {
+			lines = append(lines, line)
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				flush()
+				fence = ""
+			}
+			continue
+		}
+
+		if match := fencePattern.FindStringSubmatch(line); match != nil {
+			flush()
+			fence = match[1]
+			kind = blockCode
+			lines = append(lines, line)
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		if level, text, ok := parseHeading(line); ok {
+			flush()
+			blocks = append(blocks, markdownBlock{kind: blockHeading, text: strings.TrimSpace(line), level: level, heading: text})
+			continue
+		}
+
+		if thematicBreakPattern.MatchString(line) {
+			flush()
+			continue
+		}
+
+		if listItemPattern.MatchString(line) {
+			if kind != blockList {
+				flush()
+				kind = blockList
+			}
+			lines = append(lines, line)
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+	flush()
+
+	return blocks
+}
+
+func splitBlock(block markdownBlock, targetTokens int) []markdownBlock {
+	if EstimateTokens(block.text) <= targetTokens {
+		return []markdownBlock{block}
+	}
+
+	var pieces []string
+	switch block.kind {
+	case blockCode:
+		pieces = splitCode(block.text, targetTokens)
+	case blockList:
+		pieces = packPieces(splitListItems(block.text), "\n", targetTokens)
+	default:
+		pieces = packPieces(splitSentences(block.text), " ", targetTokens)
+	}
+
+	parts := make([]markdownBlock, len(pieces))
+	for i, piece := range pieces {
+		parts[i] = markdownBlock{kind: block.kind, text: piece}
+	}
+	return parts
+}
+
+func splitCode(text string, targetTokens int) []string {
+	lines := strings.Split(text, "\n")
+	if len(lines) < 3 {
+		return packPieces(lines, "\n", targetTokens)
+	}
+	open, close := lines[0], lines[len(lines)-1]
+	budget := targetTokens - EstimateTokens(open+"\n"+close)
+	if budget < 1 {
+		budget = 1
+	}
+
+	pieces := packPieces(lines[1:len(lines)-1], "\n", budget)
+	for i, piece := range pieces {
+		pieces[i] = open + "\n" + piece + "\n" + close
+	}
+	return pieces
+}
+
+func splitListItems(text string) []string {
+	items := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if listItemPattern.MatchString(line) || len(items) == 0 {
+			items = append(items, line)
+			continue
+		}
+		items[len(items)-1] += "\n" + line
+	}
+	return items
+}
+
+func splitSentences(text string) []string {
+	sentences := []string{}
+	start := 0
+	runes := []rune(text)
+	for i, r := range runes {
+		if (r == '.' || r == '!' || r == '?') && i+1 < len(runes) && unicode.IsSpace(runes[i+1]) {
+			sentences = append(sentences, strings.TrimSpace(string(runes[start:i+1])))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(string(runes[start:])); rest != "" {
+		sentences = append(sentences, rest)
+	}
+	return sentences
+}
+
+// packPieces joins consecutive pieces with sep into groups of at most
+// targetTokens. Pieces that are too large on their own are split into words,
+// and words that are too large on their own, such as long URLs or encoded
+// images, are split into runs of characters.
+func packPieces(pieces []string, sep string, targetTokens int) []string {
+	packed := []string{}
+	current := ""
+	for _, piece := range pieces {
+		if EstimateTokens(piece) > targetTokens {
+			if current != "" {
+				packed = append(packed, current)
+				current = ""
+			}
+			words := strings.Fields(piece)
+			if len(words) == 1 {
+				packed = append(packed, splitRunes(words[0], targetTokens)...)
+				continue
+			}
+			packed = append(packed, packPieces(words, " ", targetTokens)...)
+			continue
+		}
+		if current != "" && EstimateTokens(current+sep+piece) > targetTokens {
+			packed = append(packed, current)
+			current = ""
+		}
+		if current == "" {
+			current = piece
+		} else {
+			current += sep + piece
+		}
+	}
+	if current != "" {
+		packed = append(packed, current)
+	}
+	return packed
+}
+
+// splitRunes splits a word into pieces of at most targetTokens.
+func splitRunes(word string, targetTokens int) []string {
+	maxRunes := max(targetTokens*4, 1)
+	runes := []rune(word)
+	pieces := []string{}
+	for len(runes) > maxRunes {
+		pieces = append(pieces, string(runes[:maxRunes]))
+		runes = runes[maxRunes:]
+	}
+	return append(pieces, string(runes))
+}
+
+// trailingText returns the last sentences of block, or failing that its last
+// words, that fit within budget tokens. Code blocks are never overlapped.
+func trailingText(block markdownBlock, budget int) string {
+	if budget <= 0 || block.kind == blockCode {
+		return ""
+	}
+
+	sentences := splitSentences(block.text)
+	text := ""
+	for i := len(sentences) - 1; i >= 0; i-- {
+		candidate := strings.TrimSpace(sentences[i] + " " + text)
+		if EstimateTokens(candidate) > budget {
+			break
+		}
+		text = candidate
+	}
+	if text != "" {
+		return text
+	}
+
+	words := strings.Fields(block.text)
+	for i := len(words) - 1; i >= 0; i-- {
+		candidate := strings.TrimSpace(words[i] + " " + text)
+		if EstimateTokens(candidate) > budget {
+			break
+		}
+		text = candidate
+	}
+	return text
+}
+
+func hasAlphanumeric(text string) bool {
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
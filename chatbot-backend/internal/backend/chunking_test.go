@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+const chunkingTestContent = `Introductory paragraph before any heading.
+
+---
+
+# Services
+
+We offer consulting.
+
+## Software Engineering
+
+We build software.
+
+- Go services
+- SolidJS frontends
+
+` + "```go" + `
+func main() {
+
+	fmt.Println("hello")
+}
+` + "```" + `
+
+## Training
+
+Workshops for teams.
+`
+
+func TestParagraphChunker(t *testing.T) {
+	doc := &Document{ID: 7, Content: chunkingTestContent}
+	chunks := (&ParagraphChunker{}).Chunk(doc)
+
+	last := chunks[len(chunks)-1]
+	if last.Content != doc.Content || last.Ordinal != DocumentChunkOrdinal {
+		t.Errorf("Expected the whole document as the last chunk, got ordinal %d", last.Ordinal)
+	}
+	for i, chunk := range chunks[:len(chunks)-1] {
+		if chunk.Ordinal != i {
+			t.Errorf("Chunk %d has ordinal %d", i, chunk.Ordinal)
+		}
+		if chunk.DocumentID != doc.ID {
+			t.Errorf("Chunk %d has document ID %d, expected %d", i, chunk.DocumentID, doc.ID)
+		}
+	}
+	if chunks[1].Content != "---" {
+		t.Errorf("Expected the paragraph chunker to keep the thematic break, got %q", chunks[1].Content)
+	}
+}
+
+func TestMarkdownChunker(t *testing.T) {
+	doc := &Document{ID: 7, Content: chunkingTestContent}
+	chunks := NewMarkdownChunker(0, 0).Chunk(doc)
+
+	expected := []struct {
+		headingPath string
+		prefix      string
+	}{
+		{"", "Introductory paragraph"},
+		{"Services", "# Services\n\nWe offer consulting."},
+		{"Services > Software Engineering", "## Software Engineering\n\nWe build software."},
+		{"Services > Training", "## Training\n\nWorkshops for teams."},
+	}
+	if len(chunks) != len(expected) {
+		for _, chunk := range chunks {
+			t.Logf("%q: %q", chunk.HeadingPath, chunk.Content)
+		}
+		t.Fatalf("Expected %d chunks, got %d", len(expected), len(chunks))
+	}
+	for i, chunk := range chunks {
+		if chunk.Ordinal != i {
+			t.Errorf("Chunk %d has ordinal %d", i, chunk.Ordinal)
+		}
+		if chunk.HeadingPath != expected[i].headingPath {
+			t.Errorf("Chunk %d has heading path %q, expected %q", i, chunk.HeadingPath, expected[i].headingPath)
+		}
+		if !strings.HasPrefix(chunk.Content, expected[i].prefix) {
+			t.Errorf("Chunk %d starts with %q, expected %q", i, chunk.Content, expected[i].prefix)
+		}
+		if strings.Contains(chunk.Content, "---") {
+			t.Errorf("Chunk %d contains the thematic break", i)
+		}
+	}
+	if !strings.Contains(chunks[2].Content, "func main() {\n\n\tfmt.Println(\"hello\")\n}\n```") {
+		t.Errorf("Expected the code fence to be kept whole, got %q", chunks[2].Content)
+	}
+}
+
+func TestMarkdownChunkerTokenBudget(t *testing.T) {
+	sentence := "Retrieval augmented generation inserts relevant context into the prompt. "
+	content := "# Long Section\n\n" + strings.Repeat(sentence, 40) + "\n\n" + strings.Repeat(sentence, 40)
+	chunker := NewMarkdownChunker(100, 20)
+	chunks := chunker.Chunk(&Document{Content: content})
+
+	if len(chunks) < 5 {
+		t.Fatalf("Expected the section to be split into several chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if tokens := EstimateTokens(chunk.Content); tokens > chunker.TargetTokens {
+			t.Errorf("Chunk %d has %d tokens, more than the target of %d", i, tokens, chunker.TargetTokens)
+		}
+		if chunk.HeadingPath != "Long Section" {
+			t.Errorf("Chunk %d has heading path %q", i, chunk.HeadingPath)
+		}
+	}
+	for i := 1; i < len(chunks); i++ {
+		if !strings.HasPrefix(chunks[i].Content, strings.TrimSpace(sentence)) {
+			t.Errorf("Expected chunk %d to start with overlap from the previous chunk, got %q", i, chunks[i].Content)
+		}
+	}
+}
+
+func TestMarkdownChunkerLongWords(t *testing.T) {
+	word := strings.Repeat("a", 2000)
+	content := "Intro paragraph.\n\n" + word + "\n\n```\n" + strings.Repeat("b", 2000) + "\n```"
+	chunker := NewMarkdownChunker(0, 0)
+	chunks := chunker.Chunk(&Document{Content: content})
+
+	joined := ""
+	for i, chunk := range chunks {
+		if tokens := EstimateTokens(chunk.Content); tokens > chunker.TargetTokens {
+			t.Errorf("Chunk %d has %d tokens, more than the target of %d", i, tokens, chunker.TargetTokens)
+		}
+		joined += chunk.Content
+	}
+	if strings.Count(joined, "a") < len(word) || strings.Count(joined, "b") < 2000 {
+		t.Errorf("Expected the long words to be kept across chunks")
+	}
+}
+
+func TestMarkdownChunkerRealFiles(t *testing.T) {
+	docs, err := HugoDirectoryToDocuments("test-docs", false)
+	if err != nil {
+		t.Fatalf("Failed to load documents: %v", err)
+	}
+
+	chunker := NewMarkdownChunker(0, 0)
+	for _, doc := range docs {
+		chunks := chunker.Chunk(&doc)
+		if len(chunks) == 0 {
+			t.Errorf("Expected chunks for %s", doc.FilePath)
+		}
+		for _, chunk := range chunks {
+			if !hasAlphanumeric(chunk.Content) {
+				t.Errorf("Chunk of %s has no text: %q", doc.FilePath, chunk.Content)
+			}
+			if tokens := EstimateTokens(chunk.Content); tokens > chunker.TargetTokens {
+				t.Errorf("Chunk of %s has %d tokens, more than the target of %d", doc.FilePath, tokens, chunker.TargetTokens)
+			}
+		}
+	}
+}
+
+func TestNewChunker(t *testing.T) {
+	chunker, err := NewChunker(ChunkerConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create default chunker: %v", err)
+	}
+	if _, ok := chunker.(*MarkdownChunker); !ok {
+		t.Errorf("Expected the default chunker to be a MarkdownChunker, got %T", chunker)
+	}
+
+	chunker, err = NewChunker(ChunkerConfig{Strategy: ChunkStrategyParagraph})
+	if err != nil {
+		t.Fatalf("Failed to create paragraph chunker: %v", err)
+	}
+	if _, ok := chunker.(*ParagraphChunker); !ok {
+		t.Errorf("Expected a ParagraphChunker, got %T", chunker)
+	}
+
+	if _, err := NewChunker(ChunkerConfig{Strategy: "unknown"}); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+}
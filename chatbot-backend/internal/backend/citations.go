@@ -0,0 +1,298 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Answer is the LLM's structured response to a query: the text of the answer
+// in segments, each with the numbers of the passages it relies on. Passages
+// are numbered from 1 in the order they are given to the LLM.
+type Answer struct {
+	Segments []AnswerSegment `json:"segments"`
+}
+
+type AnswerSegment struct {
+	Text     string `json:"text"`
+	Passages []int  `json:"passages"`
+}
+
+// answerSchema constrains the LLM's response to an Answer.
+var answerSchema = ResponseSchema{
+	Name: "answer",
+	Schema: map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"segments": map[string]any{
+				"type": "array",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"text":     map[string]any{"type": "string"},
+						"passages": map[string]any{"type": "array", "items": map[string]any{"type": "integer"}},
+					},
+					"required":             []string{"text", "passages"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		"required":             []string{"segments"},
+		"additionalProperties": false,
+	},
+}
+
+// TextAnswer returns an Answer of text that cites nothing.
+func TextAnswer(text string) Answer {
+	return Answer{Segments: []AnswerSegment{{Text: text, Passages: []int{}}}}
+}
+
+// ParseAnswer decodes a response made with answerSchema. The JSON may be in a
+// markdown code block, as models asked for it only by an instruction often
+// write it.
+func ParseAnswer(response string) (Answer, error) {
+	var answer Answer
+	if err := json.Unmarshal([]byte(jsonBody(response)), &answer); err != nil {
+		return Answer{}, fmt.Errorf("response is not a structured answer: %w", err)
+	}
+	if len(answer.Segments) == 0 {
+		return Answer{}, fmt.Errorf("structured answer has no text")
+	}
+	return answer, nil
+}
+
+// jsonBody returns response without surrounding whitespace or a markdown
+// code fence.
+func jsonBody(response string) string {
+	body := strings.TrimSpace(response)
+	if !strings.HasPrefix(body, "```") {
+		return body
+	}
+	body = strings.TrimPrefix(body, "```")
+	if newline := strings.IndexByte(body, '\n'); newline >= 0 {
+		body = body[newline+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(body), "```"))
+}
+
+// ChatAnswer sends messages, as built by ChatMessages, to the LLM and returns
+// its structured answer. A model that ignores the requested format answers in
+// plain text, which is returned as an answer that cites nothing.
+func ChatAnswer(ctx context.Context, p LLMProvider, messages []Message) (Answer, error) {
+	response, err := p.CompleteJSON(ctx, messages, answerSchema)
+	if err != nil {
+		return Answer{}, err
+	}
+	return parseOrTextAnswer(response)
+}
+
+// ChatAnswerStream works like ChatAnswer but calls onDelta with the text of
+// each segment, as it would appear in Text, once the segment is complete. A
+// plain text answer is sent in one piece once it is complete.
+func ChatAnswerStream(ctx context.Context, p LLMProvider, messages []Message, onDelta func(delta string) error) (Answer, error) {
+	stream := &answerStream{onDelta: onDelta}
+	response, err := p.CompleteJSONStream(ctx, messages, answerSchema, stream.write)
+	if err != nil {
+		return Answer{}, err
+	}
+	if stream.sent > 0 {
+		// The client has seen these segments, so keep them even if the
+		// rest of the response is malformed
+		answer, err := ParseAnswer(response)
+		if err != nil {
+			log.Printf("Warning: %v; keeping the %d segments streamed", err, stream.sent)
+			return TextAnswer(stream.text), nil
+		}
+		return answer, stream.finish(answer)
+	}
+	answer, err := parseOrTextAnswer(response)
+	if err != nil {
+		return Answer{}, err
+	}
+	return answer, stream.finish(answer)
+}
+
+// parseOrTextAnswer parses response as a structured answer, or failing that
+// returns it as plain text. An empty response is an error.
+func parseOrTextAnswer(response string) (Answer, error) {
+	answer, err := ParseAnswer(response)
+	if err == nil {
+		return answer, nil
+	}
+	text := strings.TrimSpace(response)
+	if text == "" {
+		return Answer{}, err
+	}
+	log.Printf("Warning: %v; using the response as an uncited answer", err)
+	return TextAnswer(text), nil
+}
+
+// Text joins the segments of the answer, separated by a space where neither
+// already has whitespace at the join.
+func (a Answer) Text() string {
+	var text strings.Builder
+	for _, segment := range a.Segments {
+		text.WriteString(segmentSeparator(text.String(), segment.Text))
+		text.WriteString(segment.Text)
+	}
+	return text.String()
+}
+
+func segmentSeparator(previous string, next string) string {
+	if previous == "" || next == "" {
+		return ""
+	}
+	last, _ := utf8.DecodeLastRuneInString(previous)
+	first, _ := utf8.DecodeRuneInString(next)
+	if unicode.IsSpace(last) || unicode.IsSpace(first) {
+		return ""
+	}
+	return " "
+}
+
+// Citation ties a span of an answer to the passage it cites. Marker is the
+// number of the passage, and Start and End are the byte offsets in the
+// answer's Text of the segment that cites it.
+type Citation struct {
+	Marker     int
+	Start      int
+	End        int
+	ChunkID    int
+	DocumentID int
+}
+
+// Citations returns a citation for each passage each segment relies on,
+// where passage n is passages[n-1]. Numbers of passages that do not exist
+// are ignored, as are repeated numbers within a segment.
+func (a Answer) Citations(passages []Chunk) []Citation {
+	citations := []Citation{}
+	text := ""
+	for _, segment := range a.Segments {
+		start := len(text) + len(segmentSeparator(text, segment.Text))
+		text += segmentSeparator(text, segment.Text) + segment.Text
+		cited := map[int]bool{}
+		for _, marker := range segment.Passages {
+			if marker < 1 || marker > len(passages) || cited[marker] {
+				continue
+			}
+			cited[marker] = true
+			passage := passages[marker-1]
+			citations = append(citations, Citation{
+				Marker:     marker,
+				Start:      start,
+				End:        len(text),
+				ChunkID:    passage.ID,
+				DocumentID: passage.DocumentID,
+			})
+		}
+	}
+	return citations
+}
+
+// answerStream passes the text of each segment of a streamed structured
+// answer to onDelta once the segment's text is complete.
+type answerStream struct {
+	onDelta  func(delta string) error
+	response bytes.Buffer
+	text     string
+	sent     int
+}
+
+func (s *answerStream) write(delta string) error {
+	s.response.WriteString(delta)
+	return s.send(segmentTexts([]byte(jsonBody(s.response.String()))))
+}
+
+// finish sends the segments of answer that were not streamed, such as those
+// of a response in a form that segmentTexts cannot read while incomplete.
+func (s *answerStream) finish(answer Answer) error {
+	texts := make([]string, len(answer.Segments))
+	for i, segment := range answer.Segments {
+		texts[i] = segment.Text
+	}
+	return s.send(texts)
+}
+
+// send passes the texts after the first s.sent to onDelta.
+func (s *answerStream) send(texts []string) error {
+	for ; s.sent < len(texts); s.sent++ {
+		piece := segmentSeparator(s.text, texts[s.sent]) + texts[s.sent]
+		s.text += piece
+		if piece == "" {
+			continue
+		}
+		if err := s.onDelta(piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentTexts returns the text of each segment that is complete in response,
+// which may be a truncated structured answer.
+func segmentTexts(response []byte) []string {
+	// Each open object and whether its next token is a key, and the key of
+	// the value being read
+	type object struct {
+		expectKey bool
+		key       string
+	}
+	var stack []*object
+	texts := []string{}
+	decoder := json.NewDecoder(bytes.NewReader(response))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return texts
+		}
+		var top *object
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		if key, ok := token.(string); ok && top != nil && top.expectKey {
+			top.key = key
+			top.expectKey = false
+			continue
+		}
+		if top != nil {
+			top.expectKey = true
+		}
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, &object{expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, nil)
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		default:
+			if text, ok := token.(string); ok && top != nil && top.key == "text" && len(stack) == 3 {
+				texts = append(texts, text)
+			}
+		}
+	}
+}
+
+// CitedDocuments returns the documents of sources that are cited, in the order
+// they are first cited.
+func CitedDocuments(citations []Citation, sources []Document) []Document {
+	byID := make(map[int]Document, len(sources))
+	for _, doc := range sources {
+		byID[doc.ID] = doc
+	}
+	cited := []Document{}
+	seen := map[int]bool{}
+	for _, citation := range citations {
+		doc, ok := byID[citation.DocumentID]
+		if !ok || seen[doc.ID] {
+			continue
+		}
+		seen[doc.ID] = true
+		cited = append(cited, doc)
+	}
+	return cited
+}
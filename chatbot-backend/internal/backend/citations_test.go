@@ -0,0 +1,104 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAnswerCitations(t *testing.T) {
+	passages := []Chunk{
+		{ID: 10, DocumentID: 1},
+		{ID: 20, DocumentID: 2},
+		{ID: 30, DocumentID: 1},
+	}
+	answer, err := ParseAnswer(`{"segments": [
+		{"text": "We are based in Kingston.", "passages": [1]},
+		{"text": "We build retrieval systems, as in a[1].", "passages": [2, 3]},
+		{"text": "We also teach.", "passages": [1, 4, 1]},
+		{"text": "\nThanks!", "passages": []}
+	]}`)
+	if err != nil {
+		t.Fatalf("ParseAnswer failed: %v", err)
+	}
+	text := answer.Text()
+	if text != "We are based in Kingston. We build retrieval systems, as in a[1]. We also teach.\nThanks!" {
+		t.Errorf("Unexpected answer text: %q", text)
+	}
+
+	citations := answer.Citations(passages)
+	expected := []struct {
+		marker  int
+		chunkID int
+		span    string
+	}{
+		{1, 10, "We are based in Kingston."},
+		{2, 20, "We build retrieval systems, as in a[1]."},
+		{3, 30, "We build retrieval systems, as in a[1]."},
+		{1, 10, "We also teach."},
+	}
+	if len(citations) != len(expected) {
+		t.Fatalf("Expected %d citations, got %+v", len(expected), citations)
+	}
+	for i, want := range expected {
+		got := citations[i]
+		if got.Marker != want.marker || got.ChunkID != want.chunkID {
+			t.Errorf("Citation %d: expected marker %d of chunk %d, got %+v", i, want.marker, want.chunkID, got)
+		}
+		if span := text[got.Start:got.End]; span != want.span {
+			t.Errorf("Citation %d: expected span %q, got %q", i, want.span, span)
+		}
+	}
+
+	if citations := TextAnswer("No citations here [1].").Citations(passages); len(citations) != 0 {
+		t.Errorf("Expected no citations, got %+v", citations)
+	}
+}
+
+func TestParseAnswerRejectsUnstructuredResponses(t *testing.T) {
+	for _, response := range []string{"We are based in Kingston [1].", `{"segments": []}`, ""} {
+		if _, err := ParseAnswer(response); err == nil {
+			t.Errorf("Expected %q to be rejected", response)
+		}
+	}
+}
+
+func TestParseAnswerInCodeBlock(t *testing.T) {
+	answer, err := ParseAnswer("```json\n{\"segments\": [{\"text\": \"We are based in Kingston.\", \"passages\": [1]}]}\n```")
+	if err != nil {
+		t.Fatalf("ParseAnswer failed: %v", err)
+	}
+	if answer.Text() != "We are based in Kingston." {
+		t.Errorf("Unexpected answer text: %q", answer.Text())
+	}
+}
+
+func TestChatAnswerStream(t *testing.T) {
+	llm := NewFakeLLMClient()
+	llm.Response = `{"segments": [{"text": "We are based in Kingston.", "passages": [1]}, {"text": "We build \"retrieval\" systems.", "passages": []}]}`
+
+	var deltas []string
+	answer, err := ChatAnswerStream(context.Background(), llm, ChatMessages(nil, "Where are you?"), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatAnswerStream failed: %v", err)
+	}
+	if len(deltas) != 2 || deltas[0] != "We are based in Kingston." {
+		t.Errorf("Expected a delta for each segment, got %q", deltas)
+	}
+	if strings.Join(deltas, "") != answer.Text() {
+		t.Errorf("Expected deltas to add up to %q, got %q", answer.Text(), strings.Join(deltas, ""))
+	}
+}
+
+func TestCitedDocuments(t *testing.T) {
+	sources := []Document{{ID: 1, Title: "One"}, {ID: 2, Title: "Two"}, {ID: 3, Title: "Three"}}
+	citations := []Citation{{DocumentID: 3}, {DocumentID: 1}, {DocumentID: 3}}
+
+	cited := CitedDocuments(citations, sources)
+	if len(cited) != 2 || cited[0].ID != 3 || cited[1].ID != 1 {
+		t.Errorf("Expected documents 3 and 1, got %+v", cited)
+	}
+}
@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrConversationNotFound is returned for conversation IDs that do not exist
+// or have expired.
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// Conversation is a chat session whose turns are stored server-side.
+type Conversation struct {
+	ID        string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ConversationTurn is one exchange in a conversation: the user's query, the
+// answer and the chunks retrieved to produce it. RewrittenQuery is the
+// standalone query used for retrieval, if the query was rewritten.
+type ConversationTurn struct {
+	ID             int
+	ConversationID string
+	Query          string
+	RewrittenQuery string
+	Response       string
+	ChunkIDs       []int
+	CreatedAt      time.Time
+}
+
+// NewConversationID returns a new random conversation ID.
+func NewConversationID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate conversation ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// CreateConversation stores a conversation with id, as returned by
+// NewConversationID. The ID can be handed out before the conversation is
+// stored, so the conversation can be stored along with its first turn.
+func CreateConversation(ctx context.Context, db *DB, id string) (Conversation, error) {
+	now := time.Now().UTC()
+	conversation := Conversation{ID: id, CreatedAt: now, UpdatedAt: now}
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO conversations (id, created_at, updated_at)
+		VALUES (?, ?, ?)
+	`, conversation.ID, formatTimestamp(now), formatTimestamp(now))
+	if err != nil {
+		return Conversation{}, fmt.Errorf("failed to create conversation: %w", err)
+	}
+	return conversation, nil
+}
+
+// GetConversation returns the conversation with id, or
+// ErrConversationNotFound if there is none.
+func GetConversation(ctx context.Context, db *DB, id string) (Conversation, error) {
+	var conversation Conversation
+	var createdAt, updatedAt string
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT id, created_at, updated_at FROM conversations WHERE id = ?
+	`, id).Scan(&conversation.ID, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return Conversation{}, ErrConversationNotFound
+	}
+	if err != nil {
+		return Conversation{}, fmt.Errorf("failed to get conversation: %w", err)
+	}
+	conversation.CreatedAt, _ = time.Parse(timestampLayout, createdAt)
+	conversation.UpdatedAt, _ = time.Parse(timestampLayout, updatedAt)
+	return conversation, nil
+}
+
+// GetConversationTurns returns the most recent turns of a conversation,
+// oldest first. A limit of zero or less returns every turn.
+func GetConversationTurns(ctx context.Context, db *DB, conversationID string, limit int) ([]ConversationTurn, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT id, conversation_id, query, rewritten_query, response, chunk_ids, created_at
+		FROM (
+			SELECT * FROM conversation_turns
+			WHERE conversation_id = ?
+			ORDER BY id DESC
+			LIMIT ?
+		)
+		ORDER BY id
+	`, conversationID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation turns: %w", err)
+	}
+	defer rows.Close()
+
+	turns := []ConversationTurn{}
+	for rows.Next() {
+		var turn ConversationTurn
+		var chunkIDs, createdAt string
+		err := rows.Scan(&turn.ID, &turn.ConversationID, &turn.Query, &turn.RewrittenQuery, &turn.Response, &chunkIDs, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan conversation turn: %w", err)
+		}
+		if err := json.Unmarshal([]byte(chunkIDs), &turn.ChunkIDs); err != nil {
+			return nil, fmt.Errorf("failed to parse chunk IDs of turn %d: %w", turn.ID, err)
+		}
+		turn.CreatedAt, _ = time.Parse(timestampLayout, createdAt)
+		turns = append(turns, turn)
+	}
+	return turns, rows.Err()
+}
+
+// AddConversationTurn stores a turn and marks its conversation as updated.
+func AddConversationTurn(ctx context.Context, db *DB, turn *ConversationTurn) error {
+	if turn.ChunkIDs == nil {
+		turn.ChunkIDs = []int{}
+	}
+	chunkIDs, err := json.Marshal(turn.ChunkIDs)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk IDs: %w", err)
+	}
+	turn.CreatedAt = time.Now().UTC()
+
+	return WithTx(db, func(tx *DB) error {
+		result, err := tx.conn.ExecContext(ctx, `
+			INSERT INTO conversation_turns (conversation_id, query, rewritten_query, response, chunk_ids, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, turn.ConversationID, turn.Query, turn.RewrittenQuery, turn.Response, string(chunkIDs), formatTimestamp(turn.CreatedAt))
+		if err != nil {
+			return fmt.Errorf("failed to insert conversation turn: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get last insert ID: %w", err)
+		}
+		turn.ID = int(id)
+
+		_, err = tx.conn.ExecContext(ctx, `
+			UPDATE conversations SET updated_at = ? WHERE id = ?
+		`, formatTimestamp(turn.CreatedAt), turn.ConversationID)
+		if err != nil {
+			return fmt.Errorf("failed to update conversation: %w", err)
+		}
+		return nil
+	})
+}
+
+// PruneConversations deletes conversations, and their turns, that have not
+// been updated since before cutoff. It returns the number deleted.
+func PruneConversations(ctx context.Context, db *DB, cutoff time.Time) (int, error) {
+	var pruned int64
+	err := WithTx(db, func(tx *DB) error {
+		_, err := tx.conn.ExecContext(ctx, `
+			DELETE FROM conversation_turns
+			WHERE conversation_id IN (SELECT id FROM conversations WHERE updated_at < ?)
+		`, formatTimestamp(cutoff))
+		if err != nil {
+			return fmt.Errorf("failed to delete conversation turns: %w", err)
+		}
+		result, err := tx.conn.ExecContext(ctx, `DELETE FROM conversations WHERE updated_at < ?`, formatTimestamp(cutoff))
+		if err != nil {
+			return fmt.Errorf("failed to delete conversations: %w", err)
+		}
+		pruned, err = result.RowsAffected()
+		return err
+	})
+	return int(pruned), err
+}
+
+// TurnsToMessages converts stored turns into alternating user and assistant
+// messages.
+func TurnsToMessages(turns []ConversationTurn) []Message {
+	messages := make([]Message, 0, 2*len(turns))
+	for _, turn := range turns {
+		messages = append(messages,
+			Message{Role: RoleUser, Content: turn.Query},
+			Message{Role: RoleAssistant, Content: turn.Response},
+		)
+	}
+	return messages
+}
+
+// timestampLayout is RFC 3339 with a fixed number of fractional digits, so
+// stored timestamps sort and compare correctly as text.
+const timestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
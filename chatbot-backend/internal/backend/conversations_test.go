@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConversationTurns(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	id, err := NewConversationID()
+	if err != nil {
+		t.Fatalf("Failed to generate conversation ID: %v", err)
+	}
+	conversation, err := CreateConversation(context.Background(), db, id)
+	if err != nil {
+		t.Fatalf("Failed to create conversation: %v", err)
+	}
+	for i, query := range []string{"First", "Second", "Third"} {
+		turn := &ConversationTurn{ConversationID: conversation.ID, Query: query, RewrittenQuery: query + " rewritten", Response: query + " answer", ChunkIDs: []int{i}}
+		if err := AddConversationTurn(context.Background(), db, turn); err != nil {
+			t.Fatalf("Failed to add turn: %v", err)
+		}
+	}
+
+	turns, err := GetConversationTurns(context.Background(), db, conversation.ID, 2)
+	if err != nil {
+		t.Fatalf("Failed to get turns: %v", err)
+	}
+	if len(turns) != 2 || turns[0].Query != "Second" || turns[1].Query != "Third" {
+		t.Fatalf("Expected the last two turns oldest first, got %+v", turns)
+	}
+	if !reflect.DeepEqual(turns[1].ChunkIDs, []int{2}) {
+		t.Errorf("Expected chunk IDs [2], got %v", turns[1].ChunkIDs)
+	}
+	if turns[1].RewrittenQuery != "Third rewritten" {
+		t.Errorf("Expected the rewritten query to be stored, got %q", turns[1].RewrittenQuery)
+	}
+
+	messages := TurnsToMessages(turns)
+	expected := []Message{
+		{Role: RoleUser, Content: "Second"},
+		{Role: RoleAssistant, Content: "Second answer"},
+		{Role: RoleUser, Content: "Third"},
+		{Role: RoleAssistant, Content: "Third answer"},
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+
+	updated, err := GetConversation(context.Background(), db, conversation.ID)
+	if err != nil {
+		t.Fatalf("Failed to get conversation: %v", err)
+	}
+	if !updated.UpdatedAt.After(conversation.UpdatedAt) {
+		t.Error("Expected adding a turn to update the conversation")
+	}
+
+	pruned, err := PruneConversations(context.Background(), db, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Failed to prune conversations: %v", err)
+	}
+	if pruned != 1 {
+		t.Errorf("Expected 1 pruned conversation, got %d", pruned)
+	}
+	if _, err := GetConversation(context.Background(), db, conversation.ID); !errors.Is(err, ErrConversationNotFound) {
+		t.Errorf("Expected ErrConversationNotFound, got %v", err)
+	}
+	if turns, _ := GetConversationTurns(context.Background(), db, conversation.ID, 0); len(turns) != 0 {
+		t.Errorf("Expected the turns to be pruned, got %d", len(turns))
+	}
+}
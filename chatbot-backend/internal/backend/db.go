@@ -1,8 +1,13 @@
 package backend
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
+	"strings"
+	"unicode"
 
 	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
 	_ "github.com/mattn/go-sqlite3"
@@ -10,17 +15,58 @@ import (
 
 type DB struct {
 	db *sql.DB
+	// conn runs queries: db itself, or the transaction for a DB passed to a
+	// WithTx callback.
+	conn   querier
+	inTx   bool
+	hasFTS bool
 }
 
+// querier is the subset of methods shared by *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// WithTx runs fn in a transaction, passing it a DB whose operations all take
+// part in the transaction. The transaction is committed if fn returns nil and
+// rolled back otherwise. Calling WithTx on a DB that is already in a
+// transaction runs fn as part of the enclosing transaction, so functions
+// that use WithTx can be composed.
+func WithTx(db *DB, fn func(tx *DB) error) error {
+	if db.inTx {
+		return fn(db)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	txDB := &DB{db: db.db, conn: tx, inTx: true, hasFTS: db.hasFTS}
+
+	if err := fn(txDB); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetDB opens the database at path and applies any pending migrations.
 func GetDB(path string) (*DB, error) {
-	sqlite_vec.Auto()
-	db, err := sql.Open("sqlite3", path)
+	sDB, err := OpenDB(path)
 	if err != nil {
 		return nil, err
 	}
 
-	sDB := &DB{db: db}
-
 	err = Init(sDB)
 	if err != nil {
 		return nil, err
@@ -29,48 +75,91 @@ func GetDB(path string) (*DB, error) {
 	return sDB, nil
 }
 
+// OpenDB opens the database at path without migrating it, such as to inspect
+// its migration status.
+func OpenDB(path string) (*DB, error) {
+	sqlite_vec.Auto()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{db: db, conn: db}, nil
+}
+
+// Init brings the schema up to date and sets up the full-text index, which
+// depends on how the binary was built rather than on the schema version.
 func Init(db *DB) error {
-	_, err := db.db.Exec(`
-		CREATE TABLE IF NOT EXISTS documents (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			title TEXT,
-			content TEXT NOT NULL,
-			author TEXT,
-			publication_date TEXT,
-			url TEXT,
-			file_path TEXT,
-			hash BLOB
-		);
-	`)
+	if err := Migrate(db); err != nil {
+		return err
+	}
+
+	var err error
+	db.hasFTS, err = initFTS(db)
 	if err != nil {
-		return fmt.Errorf("failed to create documents table: %w", err)
+		return err
 	}
 
-	_, err = db.db.Exec(`
-		CREATE TABLE IF NOT EXISTS chunks (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			document_id INTEGER NOT NULL,
-			content TEXT NOT NULL,
-			hash BLOB NOT NULL,
-			FOREIGN KEY (document_id) REFERENCES documents(id)
-		);
-	`)
+	return nil
+}
+
+// initFTS creates the chunks_fts full-text index over chunks.content and the
+// triggers that keep it in sync. FTS5 is only available when go-sqlite3 is
+// built with the sqlite_fts5 tag, so without it the index is skipped and
+// keyword search is disabled.
+func initFTS(db *DB) (bool, error) {
+	var existing int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM sqlite_master WHERE name = 'chunks_fts'
+	`).Scan(&existing)
 	if err != nil {
-		return fmt.Errorf("failed to create chunks table: %w", err)
+		return false, fmt.Errorf("failed to check for chunks_fts table: %w", err)
 	}
 
-	_, err = db.db.Exec(`
-		CREATE VIRTUAL TABLE IF NOT EXISTS vec_chunks
-		USING vec0(
-			id INTEGER PRIMARY KEY,
-			embedding FLOAT[1536]
-		);
+	_, err = db.conn.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS chunks_fts
+		USING fts5(content, content='chunks', content_rowid='id');
+	`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			if existing > 0 {
+				return false, fmt.Errorf("database has a full-text index but SQLite was built without FTS5; build with -tags sqlite_fts5")
+			}
+			log.Println("Warning: SQLite was built without FTS5, keyword search is disabled. Build with -tags sqlite_fts5 to enable it.")
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to create chunks_fts table: %w", err)
+	}
+
+	_, err = db.conn.Exec(`
+		CREATE TRIGGER IF NOT EXISTS chunks_fts_insert AFTER INSERT ON chunks BEGIN
+			INSERT INTO chunks_fts (rowid, content) VALUES (new.id, new.content);
+		END;
+		CREATE TRIGGER IF NOT EXISTS chunks_fts_delete AFTER DELETE ON chunks BEGIN
+			INSERT INTO chunks_fts (chunks_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		END;
+		CREATE TRIGGER IF NOT EXISTS chunks_fts_update AFTER UPDATE ON chunks BEGIN
+			INSERT INTO chunks_fts (chunks_fts, rowid, content) VALUES ('delete', old.id, old.content);
+			INSERT INTO chunks_fts (rowid, content) VALUES (new.id, new.content);
+		END;
 	`)
 	if err != nil {
-		return fmt.Errorf("failed to create vec_chunks table: %w", err)
+		return false, fmt.Errorf("failed to create chunks_fts triggers: %w", err)
 	}
 
-	return nil
+	if existing == 0 {
+		_, err = db.conn.Exec(`INSERT INTO chunks_fts (chunks_fts) VALUES ('rebuild')`)
+		if err != nil {
+			return false, fmt.Errorf("failed to build chunks_fts index: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// HasFTS reports whether the database has a full-text index for keyword search.
+func HasFTS(db *DB) bool {
+	return db.hasFTS
 }
 
 func InsertDocument(db *DB, doc *Document) error {
@@ -113,10 +202,21 @@ func InsertDocument(db *DB, doc *Document) error {
 	}
 
 	// If document doesn't exist, insert it
-	result, err := db.db.Exec(`
-		INSERT INTO documents (title, content, author, publication_date, url, file_path, hash)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, doc.Title, doc.Content, doc.Author, doc.PublicationDate, doc.URL, doc.FilePath, doc.Hash)
+	return insertDocumentRow(db, doc)
+}
+
+// insertDocumentRow inserts doc without checking for an existing document
+// with the same content.
+func insertDocumentRow(db *DB, doc *Document) error {
+	metadata, err := marshalMetadata(doc.Metadata)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.conn.Exec(`
+		INSERT INTO documents (title, content, author, publication_date, url, file_path, hash, metadata, section)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, doc.Title, doc.Content, doc.Author, doc.PublicationDate, doc.URL, doc.FilePath, doc.Hash, metadata, doc.Section)
 	if err != nil {
 		return fmt.Errorf("failed to insert document: %w", err)
 	}
@@ -128,14 +228,104 @@ func InsertDocument(db *DB, doc *Document) error {
 	return nil
 }
 
+// UpdateDocument overwrites the stored fields of the document with doc.ID.
+// Its chunks are left unchanged.
+func UpdateDocument(db *DB, doc *Document) error {
+	if doc.Hash == nil {
+		doc.Hash = MakeHash(doc.Content)
+	}
+	metadata, err := marshalMetadata(doc.Metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(`
+		UPDATE documents
+		SET title = ?, content = ?, author = ?, publication_date = ?, url = ?, file_path = ?, hash = ?, metadata = ?, section = ?
+		WHERE id = ?
+	`, doc.Title, doc.Content, doc.Author, doc.PublicationDate, doc.URL, doc.FilePath, doc.Hash, metadata, doc.Section, doc.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update document: %w", err)
+	}
+	return nil
+}
+
+// DeleteDocumentChunks removes the chunks of a document along with their
+// embeddings.
+func DeleteDocumentChunks(db *DB, docID int) error {
+	return WithTx(db, func(tx *DB) error {
+		vectors, err := vectorTableName(tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.conn.Exec(`
+			DELETE FROM `+vectors+`
+			WHERE id IN (SELECT id FROM chunks WHERE document_id = ?)
+		`, docID)
+		if err != nil {
+			return fmt.Errorf("failed to delete chunk embeddings: %w", err)
+		}
+
+		_, err = tx.conn.Exec(`DELETE FROM chunks WHERE document_id = ?`, docID)
+		if err != nil {
+			return fmt.Errorf("failed to delete chunks: %w", err)
+		}
+		return nil
+	})
+}
+
+// DeleteDocument removes a document, its chunks and their embeddings.
+func DeleteDocument(db *DB, id int) error {
+	return WithTx(db, func(tx *DB) error {
+		if err := DeleteDocumentChunks(tx, id); err != nil {
+			return err
+		}
+
+		_, err := tx.conn.Exec(`DELETE FROM documents WHERE id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("failed to delete document: %w", err)
+		}
+		return nil
+	})
+}
+
+// InsertDocumentWithChunks inserts a document and its embedded chunks in a
+// single transaction, so a failure leaves neither behind.
+func InsertDocumentWithChunks(db *DB, doc *Document, chunks []Chunk) error {
+	return WithTx(db, func(tx *DB) error {
+		if err := InsertDocument(tx, doc); err != nil {
+			return err
+		}
+		for i := range chunks {
+			chunks[i].DocumentID = doc.ID
+			if err := insertChunk(tx, &chunks[i]); err != nil {
+				return fmt.Errorf("error inserting chunk %d: %w", i, err)
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateDocumentURL sets the public URL of a stored document.
+func UpdateDocumentURL(db *DB, id int, url string) error {
+	_, err := db.conn.Exec(`UPDATE documents SET url = ? WHERE id = ?`, url, id)
+	if err != nil {
+		return fmt.Errorf("failed to update document URL: %w", err)
+	}
+	return nil
+}
+
 func GetDocumentByID(db *DB, id int) (Document, error) {
-	var doc Document
-	row := db.db.QueryRow(`
-		SELECT id, title, content, author, publication_date, url, file_path, hash
+	return getDocumentByID(context.Background(), db, id)
+}
+
+func getDocumentByID(ctx context.Context, db *DB, id int) (Document, error) {
+	row := db.conn.QueryRowContext(ctx, `
+		SELECT id, title, content, author, publication_date, url, file_path, hash, metadata, section
 		FROM documents
 		WHERE id = ?
 	`, id)
-	err := row.Scan(&doc.ID, &doc.Title, &doc.Content, &doc.Author, &doc.PublicationDate, &doc.URL, &doc.FilePath, &doc.Hash)
+	doc, err := scanDocument(row)
 	if err != nil {
 		return Document{}, fmt.Errorf("failed to get document: %w", err)
 	}
@@ -144,8 +334,8 @@ func GetDocumentByID(db *DB, id int) (Document, error) {
 
 func GetAllDocuments(db *DB) ([]Document, error) {
 	docs := []Document{}
-	rows, err := db.db.Query(`
-		SELECT id, title, content, author, publication_date, url, file_path, hash
+	rows, err := db.conn.Query(`
+		SELECT id, title, content, author, publication_date, url, file_path, hash, metadata, section
 		FROM documents
 	`)
 	if err != nil {
@@ -154,8 +344,7 @@ func GetAllDocuments(db *DB) ([]Document, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var doc Document
-		err = rows.Scan(&doc.ID, &doc.Title, &doc.Content, &doc.Author, &doc.PublicationDate, &doc.URL, &doc.FilePath, &doc.Hash)
+		doc, err := scanDocument(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan document: %w", err)
 		}
@@ -164,10 +353,38 @@ func GetAllDocuments(db *DB) ([]Document, error) {
 	return docs, nil
 }
 
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDocument(row rowScanner) (Document, error) {
+	var doc Document
+	var metadata string
+	err := row.Scan(&doc.ID, &doc.Title, &doc.Content, &doc.Author, &doc.PublicationDate, &doc.URL, &doc.FilePath, &doc.Hash, &metadata, &doc.Section)
+	if err != nil {
+		return Document{}, err
+	}
+	if err := json.Unmarshal([]byte(metadata), &doc.Metadata); err != nil {
+		return Document{}, fmt.Errorf("failed to parse metadata of document %d: %w", doc.ID, err)
+	}
+	return doc, nil
+}
+
+func marshalMetadata(metadata map[string]any) (string, error) {
+	if metadata == nil {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode document metadata: %w", err)
+	}
+	return string(encoded), nil
+}
+
 func GetAllChunks(db *DB) ([]Chunk, error) {
 	chunks := []Chunk{}
-	rows, err := db.db.Query(`
-		SELECT id, content, hash, document_id
+	rows, err := db.conn.Query(`
+		SELECT id, content, hash, document_id, heading_path, ordinal
 		FROM chunks
 	`)
 	if err != nil {
@@ -177,7 +394,7 @@ func GetAllChunks(db *DB) ([]Chunk, error) {
 
 	for rows.Next() {
 		var chunk Chunk
-		err = rows.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID)
+		err = rows.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID, &chunk.HeadingPath, &chunk.Ordinal)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan chunk: %w", err)
 		}
@@ -188,8 +405,8 @@ func GetAllChunks(db *DB) ([]Chunk, error) {
 
 func GetAllChunksWithDocumentID(db *DB, docID int) ([]Chunk, error) {
 	chunks := []Chunk{}
-	rows, err := db.db.Query(`
-		SELECT id, content, hash, document_id
+	rows, err := db.conn.Query(`
+		SELECT id, content, hash, document_id, heading_path, ordinal
 		FROM chunks
 		WHERE document_id = ?
 	`, docID)
@@ -200,7 +417,7 @@ func GetAllChunksWithDocumentID(db *DB, docID int) ([]Chunk, error) {
 
 	for rows.Next() {
 		var chunk Chunk
-		err = rows.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID)
+		err = rows.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID, &chunk.HeadingPath, &chunk.Ordinal)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan chunk: %w", err)
 		}
@@ -209,10 +426,37 @@ func GetAllChunksWithDocumentID(db *DB, docID int) ([]Chunk, error) {
 	return chunks, nil
 }
 
+// GetChunksByOrdinal returns the chunks of a document whose ordinals are
+// between from and to inclusive, in document order. Whole-document chunks are
+// never included.
+func GetChunksByOrdinal(ctx context.Context, db *DB, docID int, from int, to int) ([]Chunk, error) {
+	chunks := []Chunk{}
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT id, content, hash, document_id, heading_path, ordinal
+		FROM chunks
+		WHERE document_id = ? AND ordinal BETWEEN ? AND ? AND ordinal >= 0
+		ORDER BY ordinal, id
+	`, docID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunks by ordinal: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chunk Chunk
+		err = rows.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID, &chunk.HeadingPath, &chunk.Ordinal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
 func GetDocumentChunks(db *DB, docID int) ([]Chunk, error) {
 	chunks := []Chunk{}
-	rows, err := db.db.Query(`
-		SELECT id, content, hash, document_id
+	rows, err := db.conn.Query(`
+		SELECT id, content, hash, document_id, heading_path, ordinal
 		FROM chunks
 		WHERE document_id = ?
 	`, docID)
@@ -223,7 +467,7 @@ func GetDocumentChunks(db *DB, docID int) ([]Chunk, error) {
 
 	for rows.Next() {
 		var chunk Chunk
-		err = rows.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID)
+		err = rows.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID, &chunk.HeadingPath, &chunk.Ordinal)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan chunk: %w", err)
 		}
@@ -233,12 +477,19 @@ func GetDocumentChunks(db *DB, docID int) ([]Chunk, error) {
 	return chunks, nil
 }
 
+// InsertChunk inserts a chunk and its embedding, if it has one, atomically.
 func InsertChunk(db *DB, chunk *Chunk) error {
+	return WithTx(db, func(tx *DB) error {
+		return insertChunk(tx, chunk)
+	})
+}
+
+func insertChunk(db *DB, chunk *Chunk) error {
 	// Insert the chunk into chunks table
-	result, err := db.db.Exec(`
-		INSERT INTO chunks (document_id, content, hash)
-		VALUES (?, ?, ?)
-	`, chunk.DocumentID, chunk.Content, chunk.Hash)
+	result, err := db.conn.Exec(`
+		INSERT INTO chunks (document_id, content, hash, heading_path, ordinal)
+		VALUES (?, ?, ?, ?, ?)
+	`, chunk.DocumentID, chunk.Content, chunk.Hash, chunk.HeadingPath, chunk.Ordinal)
 	if err != nil {
 		return fmt.Errorf("failed to insert chunk: %w", err)
 	}
@@ -254,17 +505,17 @@ func InsertChunk(db *DB, chunk *Chunk) error {
 
 	// Insert the embedding if we have one
 	if chunk.Embedding != nil {
-		embeddingFloat := make([]float32, len(chunk.Embedding))
-		for i, v := range chunk.Embedding {
-			embeddingFloat[i] = float32(v)
+		serializedEmbedding, err := serializeEmbedding(chunk.Embedding)
+		if err != nil {
+			return err
 		}
-		serializedEmbedding, err := sqlite_vec.SerializeFloat32(embeddingFloat)
+		vectors, err := vectorTableName(db)
 		if err != nil {
-			return fmt.Errorf("failed to serialize embedding: %w", err)
+			return err
 		}
 
-		_, err = db.db.Exec(`
-			INSERT INTO vec_chunks (id, embedding)
+		_, err = db.conn.Exec(`
+			INSERT INTO `+vectors+` (id, embedding)
 			VALUES (?, ?)
 		`, lastID, serializedEmbedding)
 		if err != nil {
@@ -275,7 +526,138 @@ func InsertChunk(db *DB, chunk *Chunk) error {
 	return nil
 }
 
-func SimilaritySearch(db *DB, embedding Embedding, limit int) ([]Chunk, error) {
+func SimilaritySearch(ctx context.Context, db *DB, embedding Embedding, limit int) ([]Chunk, error) {
+	return FilteredSimilaritySearch(ctx, db, embedding, limit, SearchFilter{})
+}
+
+// FilteredSimilaritySearch works like SimilaritySearch but only searches the
+// chunks of documents matching filter. Matching chunks are selected first and
+// their distances computed directly, rather than filtering the nearest
+// neighbours of the whole index, so a narrow filter still returns up to limit
+// chunks.
+func FilteredSimilaritySearch(ctx context.Context, db *DB, embedding Embedding, limit int, filter SearchFilter) ([]Chunk, error) {
+	serializedEmbedding, err := serializeEmbedding(embedding)
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := vectorTableName(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var results *sql.Rows
+	if filter.IsEmpty() {
+		results, err = db.conn.QueryContext(ctx, `
+			SELECT
+				chunks.id,
+				chunks.content,
+				chunks.hash,
+				chunks.document_id,
+				chunks.heading_path,
+				chunks.ordinal,
+				vectors.distance
+			FROM chunks
+			JOIN `+vectors+` AS vectors ON chunks.id = vectors.id
+			WHERE vectors.embedding MATCH ?
+			AND vectors.k = ?
+			ORDER BY vectors.distance
+		`, serializedEmbedding, limit)
+	} else {
+		conditions, args := filter.sqlConditions()
+		args = append([]any{serializedEmbedding}, args...)
+		results, err = db.conn.QueryContext(ctx, `
+			SELECT
+				chunks.id,
+				chunks.content,
+				chunks.hash,
+				chunks.document_id,
+				chunks.heading_path,
+				chunks.ordinal,
+				vec_distance_l2(vectors.embedding, ?) AS distance
+			FROM chunks
+			JOIN documents ON documents.id = chunks.document_id
+			JOIN `+vectors+` AS vectors ON chunks.id = vectors.id
+			WHERE `+conditions+`
+			ORDER BY distance
+			LIMIT ?
+		`, append(args, limit)...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform similarity search: %w", err)
+	}
+	defer results.Close()
+
+	chunks := []Chunk{}
+	for results.Next() {
+		var chunk Chunk
+		err = results.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID, &chunk.HeadingPath, &chunk.Ordinal, &chunk.Distance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan result: %w", err)
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
+}
+
+// setChunkDistances sets the Distance of each chunk to its vector distance
+// from embedding, for chunks found by means other than SimilaritySearch, and
+// returns the chunks that have an embedding. Chunks without one are left
+// unchanged.
+func setChunkDistances(ctx context.Context, db *DB, embedding Embedding, chunks []Chunk) ([]Chunk, error) {
+	measured := []Chunk{}
+	if len(chunks) == 0 {
+		return measured, nil
+	}
+	serializedEmbedding, err := serializeEmbedding(embedding)
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := vectorTableName(db)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []any{serializedEmbedding}
+	placeholders := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		placeholders[i] = "?"
+		args = append(args, chunk.ID)
+	}
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT id, vec_distance_l2(embedding, ?)
+		FROM `+vectors+`
+		WHERE id IN (`+strings.Join(placeholders, ", ")+`)
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk distances: %w", err)
+	}
+	defer rows.Close()
+
+	distances := map[int]float64{}
+	for rows.Next() {
+		var id int
+		var distance float64
+		if err := rows.Scan(&id, &distance); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk distance: %w", err)
+		}
+		distances[id] = distance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get chunk distances: %w", err)
+	}
+
+	for i := range chunks {
+		if distance, ok := distances[chunks[i].ID]; ok {
+			chunks[i].Distance = distance
+			measured = append(measured, chunks[i])
+		}
+	}
+	return measured, nil
+}
+
+func serializeEmbedding(embedding Embedding) ([]byte, error) {
 	embeddingFloat := make([]float32, len(embedding))
 	for i, v := range embedding {
 		embeddingFloat[i] = float32(v)
@@ -284,50 +666,88 @@ func SimilaritySearch(db *DB, embedding Embedding, limit int) ([]Chunk, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize embedding: %w", err)
 	}
-	results, err := db.db.Query(`
+	return serializedEmbedding, nil
+}
+
+// KeywordSearch returns up to limit chunks that match any of the words in
+// query, ranked by BM25. It returns no chunks if the database has no
+// full-text index.
+func KeywordSearch(ctx context.Context, db *DB, query string, limit int) ([]Chunk, error) {
+	return FilteredKeywordSearch(ctx, db, query, limit, SearchFilter{})
+}
+
+// FilteredKeywordSearch works like KeywordSearch but only searches the chunks
+// of documents matching filter.
+func FilteredKeywordSearch(ctx context.Context, db *DB, query string, limit int, filter SearchFilter) ([]Chunk, error) {
+	chunks := []Chunk{}
+	if !db.hasFTS {
+		return chunks, nil
+	}
+
+	matchQuery := ftsMatchQuery(query)
+	if matchQuery == "" {
+		return chunks, nil
+	}
+	conditions, args := filter.sqlConditions()
+	args = append([]any{matchQuery}, args...)
+	args = append(args, limit)
+
+	results, err := db.conn.QueryContext(ctx, `
 		SELECT
 			chunks.id,
 			chunks.content,
 			chunks.hash,
-			chunks.document_id
-		FROM chunks
-		JOIN vec_chunks ON chunks.id = vec_chunks.id
-		WHERE vec_chunks.embedding MATCH ?
-		AND vec_chunks.k = ?
-		ORDER BY vec_chunks.distance
-	`, serializedEmbedding, limit)
+			chunks.document_id,
+			chunks.heading_path,
+			chunks.ordinal
+		FROM chunks_fts
+		JOIN chunks ON chunks.id = chunks_fts.rowid
+		LEFT JOIN documents ON documents.id = chunks.document_id
+		WHERE chunks_fts MATCH ?
+		AND `+conditions+`
+		ORDER BY bm25(chunks_fts)
+		LIMIT ?
+	`, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to perform similarity search: %w", err)
+		return nil, fmt.Errorf("failed to perform keyword search: %w", err)
 	}
 	defer results.Close()
 
-	chunks := []Chunk{}
 	for results.Next() {
 		var chunk Chunk
-		err = results.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID)
+		err = results.Scan(&chunk.ID, &chunk.Content, &chunk.Hash, &chunk.DocumentID, &chunk.HeadingPath, &chunk.Ordinal)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan result: %w", err)
 		}
-
 		chunks = append(chunks, chunk)
 	}
 
 	return chunks, nil
 }
 
+func ftsMatchQuery(query string) string {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		terms = append(terms, `"`+word+`"`)
+	}
+	return strings.Join(terms, " OR ")
+}
+
 func Close(db *DB) error {
 	return db.db.Close()
 }
 
 // GetDocumentByHash retrieves a document by its content hash
 func GetDocumentByHash(db *DB, hash []byte) (Document, error) {
-	var doc Document
-	row := db.db.QueryRow(`
-		SELECT id, title, content, author, publication_date, url, file_path, hash
+	row := db.conn.QueryRow(`
+		SELECT id, title, content, author, publication_date, url, file_path, hash, metadata, section
 		FROM documents
 		WHERE hash = ?
 	`, hash)
-	err := row.Scan(&doc.ID, &doc.Title, &doc.Content, &doc.Author, &doc.PublicationDate, &doc.URL, &doc.FilePath, &doc.Hash)
+	doc, err := scanDocument(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Document{}, nil
@@ -340,7 +760,7 @@ func GetDocumentByHash(db *DB, hash []byte) (Document, error) {
 // DocumentHashExists checks if a document with the given hash exists
 func DocumentHashExists(db *DB, hash []byte) (bool, error) {
 	var exists int
-	row := db.db.QueryRow(`
+	row := db.conn.QueryRow(`
 		SELECT 1 FROM documents WHERE hash = ? LIMIT 1
 	`, hash)
 	err := row.Scan(&exists)
@@ -374,7 +794,7 @@ func DocumentHasBeenProcessed(db *DB, hash []byte) (bool, error) {
 	
 	// Check if document has chunks
 	var chunkCount int
-	err = db.db.QueryRow(`
+	err = db.conn.QueryRow(`
 		SELECT COUNT(*) FROM chunks WHERE document_id = ?
 	`, doc.ID).Scan(&chunkCount)
 	if err != nil {
@@ -1,7 +1,10 @@
 package backend
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 
 	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
@@ -513,7 +516,7 @@ func TestSimilaritySearch(t *testing.T) {
 
 	// Perform a similarity search
 	queryEmbedding := Embedding{0.1, 0.2, 0.3, 0.4}
-	results, err := SimilaritySearch(db, queryEmbedding, 3)
+	results, err := SimilaritySearch(context.Background(), db, queryEmbedding, 3)
 	if err != nil {
 		t.Fatalf("Failed to perform similarity search: %v", err)
 	}
@@ -550,7 +553,7 @@ func TestSimilaritySearchWithEmptyDB(t *testing.T) {
 	}
 
 	// Perform similarity search on empty database
-	results, err := SimilaritySearch(db, queryEmbedding, 3)
+	results, err := SimilaritySearch(context.Background(), db, queryEmbedding, 3)
 	if err != nil {
 		t.Fatalf("Expected no error for empty database search, got: %v", err)
 	}
@@ -588,7 +591,7 @@ func TestSimilaritySearchWithInvalidEmbedding(t *testing.T) {
 
 	// Perform similarity search with invalid embedding
 	// This should still work but return empty results since no matches will be found
-	results, err := SimilaritySearch(db, invalidEmbedding, 3)
+	results, err := SimilaritySearch(context.Background(), db, invalidEmbedding, 3)
 	if err != nil {
 		t.Fatalf("Expected no error for invalid embedding search, got: %v", err)
 	}
@@ -760,7 +763,7 @@ func TestSimilaritySearchLimit(t *testing.T) {
 	}
 
 	// Perform similarity search
-	results, err := SimilaritySearch(db, queryEmbedding, 3)
+	results, err := SimilaritySearch(context.Background(), db, queryEmbedding, 3)
 	if err != nil {
 		t.Fatalf("Failed to perform similarity search: %v", err)
 	}
@@ -988,8 +991,100 @@ func TestSimilaritySearchInvalidEmbeddingDimensions(t *testing.T) {
 
 	// Test with invalid embedding dimensions
 	invalidEmbedding := Embedding{0.1, 0.2}
-	_, err = SimilaritySearch(db, invalidEmbedding, 3)
+	_, err = SimilaritySearch(context.Background(), db, invalidEmbedding, 3)
 	if err == nil {
 		t.Fatal("Expected error for invalid embedding dimensions, got nil")
 	}
 }
+
+func TestWithTx(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer Close(db)
+
+	// A failing transaction, including a nested one, leaves nothing behind
+	err = WithTx(db, func(tx *DB) error {
+		if err := InsertDocument(tx, &Document{Title: "Rolled back", Content: "Rolled back."}); err != nil {
+			return err
+		}
+		return WithTx(tx, func(nested *DB) error {
+			if err := InsertDocument(nested, &Document{Title: "Nested", Content: "Nested."}); err != nil {
+				return err
+			}
+			return errors.New("failed")
+		})
+	})
+	if err == nil || err.Error() != "failed" {
+		t.Fatalf("Expected the callback's error, got %v", err)
+	}
+	docs, err := GetAllDocuments(db)
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("Expected the transaction to be rolled back, got %d documents", len(docs))
+	}
+
+	// A successful transaction is committed
+	err = WithTx(db, func(tx *DB) error {
+		return InsertDocument(tx, &Document{Title: "Committed", Content: "Committed."})
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	docs, err = GetAllDocuments(db)
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	if len(docs) != 1 || docs[0].Title != "Committed" {
+		t.Errorf("Expected the committed document, got %+v", docs)
+	}
+}
+
+func TestInsertDocumentWithChunksIsAtomic(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer Close(db)
+
+	embedding, err := CreateEmbedding(context.Background(), NewLocalEmbedder(0), "First chunk.", 1)
+	if err != nil {
+		t.Fatalf("Failed to create embedding: %v", err)
+	}
+
+	// The second chunk's embedding has the wrong dimensions, so inserting it
+	// fails after the document and first chunk were written
+	doc := &Document{Title: "Partial", Content: "First chunk.\n\nSecond chunk."}
+	chunks := []Chunk{
+		{Content: "First chunk.", Hash: MakeHash("First chunk."), Embedding: embedding},
+		{Content: "Second chunk.", Hash: MakeHash("Second chunk."), Embedding: Embedding{0.1, 0.2}},
+	}
+	if err := InsertDocumentWithChunks(db, doc, chunks); err == nil {
+		t.Fatal("Expected an error for the invalid embedding")
+	}
+
+	for _, table := range []string{"documents", "chunks", "vec_chunks"} {
+		var count int
+		if err := db.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("Failed to count %s: %v", table, err)
+		}
+		if count != 0 {
+			t.Errorf("Expected no rows in %s after the failed insert, got %d", table, count)
+		}
+	}
+
+	chunks[1].Embedding = embedding
+	if err := InsertDocumentWithChunks(db, doc, chunks); err != nil {
+		t.Fatalf("Failed to insert document with chunks: %v", err)
+	}
+	stored, err := GetDocumentChunks(db, doc.ID)
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %v", err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("Expected 2 chunks, got %d", len(stored))
+	}
+}
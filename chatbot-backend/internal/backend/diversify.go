@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// diversifying reports whether HybridSearch should pick its results from a
+// larger candidate set rather than simply taking the top Limit.
+func (o HybridSearchOptions) diversifying() bool {
+	return o.MMRLambda < 1 || o.MaxChunksPerDocument > 0
+}
+
+// diversify picks up to options.Limit chunks from candidates, which are
+// ordered by relevance, using maximal marginal relevance: each pick maximises
+//
+//	MMRLambda*relevance - (1-MMRLambda)*max similarity to the chunks already picked
+//
+// where relevance is the chunk's Score relative to the best candidate's, and
+// similarity is the cosine similarity of the chunks' embeddings. No more than
+// MaxChunksPerDocument chunks are picked from any one document, so results
+// are not crowded out by a whole post and its paragraphs.
+func diversify(ctx context.Context, db *DB, candidates []Chunk, options HybridSearchOptions) ([]Chunk, error) {
+	var embeddings map[int]Embedding
+	if options.MMRLambda < 1 && len(candidates) > 0 {
+		var err error
+		embeddings, err = getChunkEmbeddings(ctx, db, candidates)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	topScore := 0.0
+	for _, chunk := range candidates {
+		topScore = math.Max(topScore, chunk.Score)
+	}
+
+	selected := []Chunk{}
+	perDocument := map[int]int{}
+	remaining := append([]Chunk{}, candidates...)
+	for len(selected) < options.Limit && len(remaining) > 0 {
+		best := -1
+		bestValue := math.Inf(-1)
+		for i, chunk := range remaining {
+			if options.MaxChunksPerDocument > 0 && perDocument[chunk.DocumentID] >= options.MaxChunksPerDocument {
+				continue
+			}
+			value := 1.0
+			if topScore > 0 {
+				value = chunk.Score / topScore
+			}
+			if embeddings != nil {
+				redundancy := 0.0
+				for _, picked := range selected {
+					redundancy = math.Max(redundancy, cosineSimilarity(embeddings[chunk.ID], embeddings[picked.ID]))
+				}
+				value = options.MMRLambda*value - (1-options.MMRLambda)*redundancy
+			}
+			if value > bestValue {
+				best, bestValue = i, value
+			}
+		}
+		if best == -1 {
+			break
+		}
+
+		chunk := remaining[best]
+		selected = append(selected, chunk)
+		perDocument[chunk.DocumentID]++
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return selected, nil
+}
+
+// getChunkEmbeddings loads the stored embeddings of chunks, keyed by chunk ID.
+func getChunkEmbeddings(ctx context.Context, db *DB, chunks []Chunk) (map[int]Embedding, error) {
+	args := make([]any, len(chunks))
+	for i, chunk := range chunks {
+		args[i] = chunk.ID
+	}
+	vectors, err := vectorTableName(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT id, embedding FROM `+vectors+` WHERE id IN (`+placeholders(len(chunks))+`)
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk embeddings: %w", err)
+	}
+	defer rows.Close()
+
+	embeddings := map[int]Embedding{}
+	for rows.Next() {
+		var id int
+		var blob []byte
+		if err := rows.Scan(&id, &blob); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk embedding: %w", err)
+		}
+		embeddings[id] = deserializeEmbedding(blob)
+	}
+	return embeddings, rows.Err()
+}
+
+// deserializeEmbedding decodes an embedding stored by sqlite-vec as
+// little-endian float32 values.
+func deserializeEmbedding(blob []byte) Embedding {
+	embedding := make(Embedding, len(blob)/4)
+	for i := range embedding {
+		embedding[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:])))
+	}
+	return embedding
+}
+
+func cosineSimilarity(a Embedding, b Embedding) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiversifyCapsChunksPerDocument(t *testing.T) {
+	candidates := []Chunk{
+		{ID: 1, DocumentID: 1, Score: 0.9},
+		{ID: 2, DocumentID: 1, Score: 0.8},
+		{ID: 3, DocumentID: 1, Score: 0.7},
+		{ID: 4, DocumentID: 2, Score: 0.6},
+		{ID: 5, DocumentID: 1, Score: 0.5},
+		{ID: 6, DocumentID: 3, Score: 0.4},
+	}
+	options := DefaultHybridSearchOptions()
+	options.Limit = 4
+	options.MMRLambda = 1
+	options.MaxChunksPerDocument = 2
+
+	selected, err := diversify(context.Background(), nil, candidates, options)
+	if err != nil {
+		t.Fatalf("diversify failed: %v", err)
+	}
+	expected := []int{1, 2, 4, 6}
+	if len(selected) != len(expected) {
+		t.Fatalf("Expected chunks %v, got %+v", expected, selected)
+	}
+	for i, id := range expected {
+		if selected[i].ID != id {
+			t.Errorf("Expected chunk %d at position %d, got %d", id, i, selected[i].ID)
+		}
+	}
+}
+
+func TestDiversifyMMR(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	doc := Document{Content: "About Epistemic Technology."}
+	if err := InsertDocument(db, &doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	embedder := NewLocalEmbedder(0)
+	contents := []string{
+		"Epistemic Technology builds retrieval systems.",
+		"Epistemic Technology builds retrieval systems.",
+		"Our office is in Kingston, New York.",
+	}
+	candidates := make([]Chunk, len(contents))
+	for i, content := range contents {
+		embedding, err := CreateEmbedding(context.Background(), embedder, content, 1)
+		if err != nil {
+			t.Fatalf("Failed to create embedding: %v", err)
+		}
+		candidates[i] = Chunk{DocumentID: doc.ID, Content: content, Hash: MakeHash(content), Embedding: embedding}
+		if err := InsertChunk(db, &candidates[i]); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+		candidates[i].Score = 1 - 0.1*float64(i)
+	}
+
+	options := DefaultHybridSearchOptions()
+	options.Limit = 2
+	options.MaxChunksPerDocument = 0
+
+	options.MMRLambda = 1
+	selected, err := diversify(context.Background(), db, candidates, options)
+	if err != nil {
+		t.Fatalf("diversify failed: %v", err)
+	}
+	if len(selected) != 2 || selected[1].ID != candidates[1].ID {
+		t.Errorf("Expected ranking by relevance alone to keep the duplicate, got %+v", selected)
+	}
+
+	options.MMRLambda = 0.5
+	selected, err = diversify(context.Background(), db, candidates, options)
+	if err != nil {
+		t.Fatalf("diversify failed: %v", err)
+	}
+	if len(selected) != 2 || selected[0].ID != candidates[0].ID || selected[1].ID != candidates[2].ID {
+		t.Errorf("Expected the duplicate to be skipped for a different chunk, got %+v", selected)
+	}
+}
+
+func TestDeserializeEmbedding(t *testing.T) {
+	embedding := Embedding{0.5, -1.25, 3}
+	blob, err := serializeEmbedding(embedding)
+	if err != nil {
+		t.Fatalf("Failed to serialize embedding: %v", err)
+	}
+	decoded := deserializeEmbedding(blob)
+	if len(decoded) != len(embedding) {
+		t.Fatalf("Expected %d values, got %d", len(embedding), len(decoded))
+	}
+	for i := range embedding {
+		if decoded[i] != embedding[i] {
+			t.Errorf("Expected %v at %d, got %v", embedding[i], i, decoded[i])
+		}
+	}
+	if similarity := cosineSimilarity(embedding, decoded); math.Abs(similarity-1) > 1e-9 {
+		t.Errorf("Expected identical embeddings to have similarity 1, got %v", similarity)
+	}
+}
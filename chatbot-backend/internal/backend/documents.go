@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"os"
@@ -17,21 +18,31 @@ type Document struct {
 	FilePath        string
 	ID              int
 	Hash            []byte
+	Metadata        map[string]any
+	// Section is the Hugo section the document belongs to, if it was read
+	// from a Hugo site.
+	Section string
 }
 
 type Chunk struct {
-	DocumentID int
-	Content    string
-	Embedding  Embedding
-	Hash       []byte
-	ID         int
+	DocumentID  int
+	Content     string
+	Embedding   Embedding
+	Hash        []byte
+	ID          int
+	HeadingPath string
+	Ordinal     int
+	// Distance is the vector distance from the query embedding and Score is
+	// the fused ranking score. Both are only set on search results.
+	Distance float64
+	Score    float64
 }
 
 type User struct {
 	ID int
 }
 
-func ChunkDocument(doc *Document, embeddingClient *EmbeddingClient, user *User, db *DB) ([]Chunk, error) {
+func ChunkDocument(doc *Document, chunker Chunker, embedder Embedder, user *User, db *DB) ([]Chunk, error) {
 	if len(doc.Content) == 0 {
 		return nil, fmt.Errorf("document content is empty")
 	}
@@ -64,95 +75,108 @@ func ChunkDocument(doc *Document, embeddingClient *EmbeddingClient, user *User,
 		return chunks, nil
 	}
 	
-	// If document hasn't been processed, create new chunks
-	chunks := []Chunk{}
-	paragraphs := strings.Split(doc.Content, "\n\n")
-	var chunkContents []string
-	
-	// Collect all paragraph chunks
-	for _, paragraph := range paragraphs {
-		paragraph = strings.TrimSpace(paragraph)
-		if len(paragraph) == 0 {
-			continue
+	return EmbedDocumentChunks(doc, chunker, embedder, user)
+}
+
+// EmbedDocumentChunks splits doc with chunker and embeds the chunks, without
+// checking whether the document has already been processed.
+func EmbedDocumentChunks(doc *Document, chunker Chunker, embedder Embedder, user *User) ([]Chunk, error) {
+	chunks := chunker.Chunk(doc)
+	if err := embedChunks([][]Chunk{chunks}, embedder, user); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// embedChunks embeds the chunks of several documents together, so that
+// chunks from small documents share requests, and sets their Embedding.
+func embedChunks(documentChunks [][]Chunk, embedder Embedder, user *User) error {
+	chunkContents := []string{}
+	for _, chunks := range documentChunks {
+		for _, chunk := range chunks {
+			chunkContents = append(chunkContents, chunk.Content)
 		}
-		
-		chunks = append(chunks, Chunk{
-			DocumentID: doc.ID,
-			Content:    paragraph,
-			Hash:       MakeHash(paragraph),
-		})
-		chunkContents = append(chunkContents, paragraph)
 	}
-	
-	// Add the full document as a chunk
-	chunks = append(chunks, Chunk{
-		DocumentID: doc.ID,
-		Content:    doc.Content,
-		Hash:       MakeHash(doc.Content),
-	})
-	chunkContents = append(chunkContents, doc.Content)
-	
-	// Create embeddings for all chunks
-	embeddingVectors, err := CreateEmbeddings(embeddingClient, chunkContents, user.ID)
+
+	// Create embeddings for all chunks. Documents are embedded by syncs, which
+	// are not tied to a request that could be cancelled.
+	embeddingVectors, err := CreateEmbeddings(context.Background(), embedder, chunkContents, user.ID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	
+	if len(embeddingVectors) != len(chunkContents) {
+		return fmt.Errorf("expected %d embeddings, got %d", len(chunkContents), len(embeddingVectors))
+	}
+
 	// Add embeddings to chunks
-	for i, embeddingVector := range embeddingVectors {
-		chunks[i].Embedding = embeddingVector
+	i := 0
+	for _, chunks := range documentChunks {
+		for j := range chunks {
+			chunks[j].Embedding = embeddingVectors[i]
+			i++
+		}
 	}
-	
-	return chunks, nil
+	return nil
 }
 
+// HugoToDocument reads a Hugo content file, populating the document's fields
+// and Metadata from its YAML, TOML or JSON front matter. If the file belongs to
+// a Hugo site, its URL is the page's public URL.
 func HugoToDocument(filePath string) (Document, error) {
+	site, err := FindSiteConfig(filepath.Dir(filePath))
+	if err != nil {
+		return Document{}, err
+	}
+	return hugoToDocument(filePath, site)
+}
+
+func hugoToDocument(filePath string, site *SiteConfig) (Document, error) {
 	theDocument := Document{FilePath: filePath}
 	content, err := os.ReadFile(filePath)
 	if err != nil {
 		return Document{}, err
 	}
 
-	lines := strings.Split(string(content), "\n")
-
-	metadataStart := -1
-	metadataEnd := -1
-
-	for i, line := range lines {
-		if strings.TrimSpace(line) == "---" {
-			if metadataStart == -1 {
-				metadataStart = i
-			} else {
-				metadataEnd = i
-				break
-			}
-		}
+	metadata, body, err := ParseFrontMatter(string(content))
+	if err != nil {
+		return Document{}, fmt.Errorf("error parsing front matter of %s: %w", filePath, err)
 	}
 
-	if metadataStart != -1 && metadataEnd != -1 {
-		for i := metadataStart + 1; i < metadataEnd; i++ {
-			line := lines[i]
-			if strings.HasPrefix(line, "title: ") {
-				theDocument.Title = strings.TrimPrefix(line, "title: ")
-			} else if strings.HasPrefix(line, "author: ") {
-				theDocument.Author = strings.TrimPrefix(line, "author: ")
-			} else if strings.HasPrefix(line, "date: ") {
-				theDocument.PublicationDate = strings.TrimPrefix(line, "date: ")
-			} else if strings.HasPrefix(line, "url: ") {
-				theDocument.URL = strings.TrimPrefix(line, "url: ")
-			}
+	theDocument.Content = body
+	theDocument.Metadata = metadata
+	theDocument.Title = MetadataString(metadata, "title")
+	theDocument.Author = MetadataString(metadata, "author")
+	if theDocument.Author == "" {
+		theDocument.Author = strings.Join(MetadataStrings(metadata, "authors"), ", ")
+	}
+	theDocument.PublicationDate = MetadataString(metadata, "date")
+	if theDocument.PublicationDate == "" {
+		theDocument.PublicationDate = MetadataString(metadata, "publishdate")
+	}
+	theDocument.URL = MetadataString(metadata, "url")
+	if site != nil {
+		theDocument.URL, err = site.PageURL(filePath, metadata)
+		if err != nil {
+			return Document{}, err
 		}
-
-		contentLines := lines[metadataEnd+1:]
-		theDocument.Content = strings.Join(contentLines, "\n")
-	} else {
-		theDocument.Content = string(content)
+		theDocument.Section = site.Section(filePath)
 	}
 
 	return theDocument, nil
 }
 
+// HugoDirectoryToDocuments reads the Markdown files in directory, skipping
+// empty files and pages that Hugo would not publish. The site configuration is
+// looked up once, from directory and its parents.
 func HugoDirectoryToDocuments(directory string, recursive bool) ([]Document, error) {
+	site, err := FindSiteConfig(directory)
+	if err != nil {
+		return nil, err
+	}
+	return hugoDirectoryToDocuments(directory, recursive, site)
+}
+
+func hugoDirectoryToDocuments(directory string, recursive bool, site *SiteConfig) ([]Document, error) {
 	documents := []Document{}
 	files, err := os.ReadDir(directory)
 	if err != nil {
@@ -161,7 +185,7 @@ func HugoDirectoryToDocuments(directory string, recursive bool) ([]Document, err
 	for _, file := range files {
 		if file.IsDir() {
 			if recursive {
-				subDirDocuments, err := HugoDirectoryToDocuments(filepath.Join(directory, file.Name()), recursive)
+				subDirDocuments, err := hugoDirectoryToDocuments(filepath.Join(directory, file.Name()), recursive, site)
 				if err != nil {
 					return nil, err
 				}
@@ -172,13 +196,13 @@ func HugoDirectoryToDocuments(directory string, recursive bool) ([]Document, err
 		if !strings.HasSuffix(file.Name(), ".md") {
 			continue
 		}
-		document, err := HugoToDocument(filepath.Join(directory, file.Name()))
-		if len(document.Content) == 0 {
-			continue
-		}
+		document, err := hugoToDocument(filepath.Join(directory, file.Name()), site)
 		if err != nil {
 			return nil, err
 		}
+		if len(document.Content) == 0 || !IsPublished(document.Metadata) {
+			continue
+		}
 		documents = append(documents, document)
 	}
 
@@ -191,14 +215,14 @@ func MakeHash(content string) []byte {
 	return hash.Sum(nil)
 }
 
-func DocumentsFromChunks(chunks []Chunk, database *DB) ([]Document, error) {
+func DocumentsFromChunks(ctx context.Context, chunks []Chunk, database *DB) ([]Document, error) {
 	documents := []Document{}
 	seenDocIDs := make(map[int]bool)
 	for _, chunk := range chunks {
 		if seenDocIDs[chunk.DocumentID] {
 			continue
 		}
-		newDoc, err := GetDocumentByID(database, chunk.DocumentID)
+		newDoc, err := getDocumentByID(ctx, database, chunk.DocumentID)
 		if err != nil {
 			return nil, fmt.Errorf("error getting document by ID: %w", err)
 		}
@@ -242,15 +266,53 @@ func PrepareDocumentForProcessing(doc *Document, db *DB) (bool, error) {
 }
 
 // ProcessDocumentBatch processes a batch of documents, efficiently skipping duplicates
-func ProcessDocumentBatch(db *DB, docs []Document, embeddingClient *EmbeddingClient, user *User) (int, int, error) {
+func ProcessDocumentBatch(db *DB, docs []Document, chunker Chunker, embedder Embedder, user *User) (int, int, error) {
 	totalDocuments := 0
 	skippedDocuments := 0
+	if err := UseEmbedder(db, embedder); err != nil {
+		return totalDocuments, skippedDocuments, err
+	}
+
+	// New documents are queued so the chunks of several documents share
+	// embedding requests
+	pending := []int{}
+	pendingChunks := [][]Chunk{}
+	pendingCount := 0
+	pendingHashes := map[string]bool{}
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		// Embed the chunks first, then insert each document and its chunks
+		// together so a failure part way through leaves nothing behind
+		if err := embedChunks(pendingChunks, embedder, user); err != nil {
+			return fmt.Errorf("error embedding chunks: %w", err)
+		}
+		for j, i := range pending {
+			if err := InsertDocumentWithChunks(db, &docs[i], pendingChunks[j]); err != nil {
+				return fmt.Errorf("error inserting document: %w", err)
+			}
+			totalDocuments++
+		}
+		pending = pending[:0]
+		pendingChunks = pendingChunks[:0]
+		pendingCount = 0
+		clear(pendingHashes)
+		return nil
+	}
 	
 	for i := range docs {
 		// Calculate hash if not already set
 		if docs[i].Hash == nil {
 			docs[i].Hash = MakeHash(docs[i].Content)
 		}
+
+		// A copy of a queued document is a duplicate once that is stored
+		if pendingHashes[string(docs[i].Hash)] {
+			if err := flush(); err != nil {
+				return totalDocuments, skippedDocuments, err
+			}
+		}
 		
 		// Check if document has already been processed
 		processed, err := DocumentHasBeenProcessed(db, docs[i].Hash)
@@ -268,30 +330,29 @@ func ProcessDocumentBatch(db *DB, docs []Document, embeddingClient *EmbeddingCli
 				return totalDocuments, skippedDocuments, fmt.Errorf("error retrieving existing document: %w", err)
 			}
 			docs[i].ID = existingDoc.ID
+
+			// Keep the stored URL current if the site's permalinks changed
+			if docs[i].URL != "" && docs[i].URL != existingDoc.URL {
+				if err := UpdateDocumentURL(db, existingDoc.ID, docs[i].URL); err != nil {
+					return totalDocuments, skippedDocuments, err
+				}
+			}
 			continue
 		}
-		
-		// Insert the document
-		err = InsertDocument(db, &docs[i])
-		if err != nil {
-			return totalDocuments, skippedDocuments, fmt.Errorf("error inserting document: %w", err)
-		}
-		
-		// Process and insert chunks
-		chunks, err := ChunkDocument(&docs[i], embeddingClient, user, db)
-		if err != nil {
-			return totalDocuments, skippedDocuments, fmt.Errorf("error chunking document: %w", err)
-		}
-		
-		// Insert chunks
-		for j := range chunks {
-			err = InsertChunk(db, &chunks[j])
-			if err != nil {
-				return totalDocuments, skippedDocuments, fmt.Errorf("error inserting chunk: %w", err)
+
+		chunks := chunker.Chunk(&docs[i])
+		pending = append(pending, i)
+		pendingChunks = append(pendingChunks, chunks)
+		pendingCount += len(chunks)
+		pendingHashes[string(docs[i].Hash)] = true
+		if pendingCount >= embedGroupChunks {
+			if err := flush(); err != nil {
+				return totalDocuments, skippedDocuments, err
 			}
 		}
-		
-		totalDocuments++
+	}
+	if err := flush(); err != nil {
+		return totalDocuments, skippedDocuments, err
 	}
 	
 	return totalDocuments, skippedDocuments, nil
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
@@ -52,7 +53,7 @@ func TestChunkWithEmbeddings(t *testing.T) {
 
 	user := &User{ID: 123}
 
-	chunks, err := ChunkDocument(doc, embeddingClient, user, db)
+	chunks, err := ChunkDocument(doc, &ParagraphChunker{}, embeddingClient, user, db)
 	if err != nil {
 		t.Fatalf("Failed to chunk document: %v", err)
 	}
@@ -91,6 +92,53 @@ func TestChunkWithEmbeddings(t *testing.T) {
 	}
 }
 
+func TestChunkDocumentWithLocalEmbedder(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	doc := &Document{
+		Title:    "Test Document",
+		Content:  "This is a test chunk for embedding generation.\n\nThis is another test chunk with different content.",
+		FilePath: "/path/to/test/document.md",
+	}
+	if err := InsertDocument(db, doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	embedder := NewLocalEmbedder(0)
+	chunks, err := ChunkDocument(doc, &ParagraphChunker{}, embedder, &User{ID: 1}, db)
+	if err != nil {
+		t.Fatalf("Failed to chunk document: %v", err)
+	}
+
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 2 paragraph chunks and 1 document chunk, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if len(chunk.Embedding) != embedder.Dimensions() {
+			t.Errorf("Chunk %d has %d dimensions, expected %d", i, len(chunk.Embedding), embedder.Dimensions())
+		}
+		if err := InsertChunk(db, &chunks[i]); err != nil {
+			t.Fatalf("Failed to insert chunk %d: %v", i, err)
+		}
+	}
+
+	query, err := CreateEmbedding(context.Background(), embedder, "another chunk with different content", 1)
+	if err != nil {
+		t.Fatalf("Failed to embed query: %v", err)
+	}
+	results, err := SimilaritySearch(context.Background(), db, query, 1)
+	if err != nil {
+		t.Fatalf("Failed to perform similarity search: %v", err)
+	}
+	if len(results) != 1 || results[0].Content != "This is another test chunk with different content." {
+		t.Errorf("Expected the matching paragraph to be the closest chunk, got %+v", results)
+	}
+}
+
 func TestHugoDirectoryToDocuments(t *testing.T) {
 	// Test with the existing test-docs directory
 	docs, err := HugoDirectoryToDocuments("test-docs", false)
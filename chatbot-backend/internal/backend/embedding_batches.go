@@ -0,0 +1,250 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// EmbeddingBatchLimits bounds the requests CreateEmbeddings makes to an
+// embedding API. Zero fields take their default values.
+type EmbeddingBatchLimits struct {
+	// MaxItems is the most texts sent in one request.
+	MaxItems int
+	// MaxTokens is the most estimated tokens sent in one request.
+	MaxTokens int
+	// MaxInputTokens is the most estimated tokens in one text. Longer texts
+	// are split, and the embeddings of the pieces averaged.
+	MaxInputTokens int
+	// Concurrency is the most requests in flight at once.
+	Concurrency int
+}
+
+// DefaultEmbeddingBatchLimits keeps well inside OpenAI's limits of 2048
+// inputs and 300,000 tokens per request and 8191 tokens per input, since
+// EstimateTokens is only approximate. Text such as code, URLs or non-English
+// prose can take twice as many tokens as EstimateTokens gives, so texts are
+// kept to 4000 estimated tokens.
+func DefaultEmbeddingBatchLimits() EmbeddingBatchLimits {
+	return EmbeddingBatchLimits{
+		MaxItems:       512,
+		MaxTokens:      100000,
+		MaxInputTokens: 4000,
+		Concurrency:    4,
+	}
+}
+
+// EmbeddingBatchLimitsFromEnv reads the batch limits from
+// EMBEDDING_BATCH_SIZE, EMBEDDING_BATCH_TOKENS, EMBEDDING_MAX_INPUT_TOKENS and
+// EMBEDDING_CONCURRENCY.
+func EmbeddingBatchLimitsFromEnv() EmbeddingBatchLimits {
+	maxItems, _ := strconv.Atoi(os.Getenv("EMBEDDING_BATCH_SIZE"))
+	maxTokens, _ := strconv.Atoi(os.Getenv("EMBEDDING_BATCH_TOKENS"))
+	maxInputTokens, _ := strconv.Atoi(os.Getenv("EMBEDDING_MAX_INPUT_TOKENS"))
+	concurrency, _ := strconv.Atoi(os.Getenv("EMBEDDING_CONCURRENCY"))
+	return EmbeddingBatchLimits{
+		MaxItems:       maxItems,
+		MaxTokens:      maxTokens,
+		MaxInputTokens: maxInputTokens,
+		Concurrency:    concurrency,
+	}
+}
+
+func (l EmbeddingBatchLimits) withDefaults() EmbeddingBatchLimits {
+	defaults := DefaultEmbeddingBatchLimits()
+	if l.MaxItems <= 0 {
+		l.MaxItems = defaults.MaxItems
+	}
+	if l.MaxTokens <= 0 {
+		l.MaxTokens = defaults.MaxTokens
+	}
+	if l.MaxInputTokens <= 0 {
+		l.MaxInputTokens = defaults.MaxInputTokens
+	}
+	if l.Concurrency <= 0 {
+		l.Concurrency = defaults.Concurrency
+	}
+	return l
+}
+
+// BatchingEmbedder is an Embedder whose API limits the size of requests.
+// CreateEmbeddings splits the texts given to it into requests within
+// BatchLimits.
+type BatchingEmbedder interface {
+	Embedder
+	BatchLimits() EmbeddingBatchLimits
+}
+
+// embeddingBatch is the range of pieces sent in one request.
+type embeddingBatch struct {
+	from int
+	to   int
+}
+
+// embedInBatches embeds texts with as many requests as limits require,
+// running up to limits.Concurrency of them at once. Texts longer than
+// limits.MaxInputTokens are split and given the average embedding of their
+// pieces, weighted by length.
+func embedInBatches(ctx context.Context, e Embedder, limits EmbeddingBatchLimits, texts []string, userID int) ([]Embedding, error) {
+	limits = limits.withDefaults()
+
+	// Split long texts, remembering which pieces belong to each text
+	pieces := []string{}
+	owners := make([][2]int, len(texts))
+	for i, text := range texts {
+		start := len(pieces)
+		pieces = append(pieces, splitByTokens(text, limits.MaxInputTokens)...)
+		owners[i] = [2]int{start, len(pieces)}
+	}
+
+	batches := []embeddingBatch{}
+	batch := embeddingBatch{}
+	tokens := 0
+	for i, piece := range pieces {
+		pieceTokens := EstimateTokens(piece)
+		if batch.to > batch.from && (batch.to-batch.from >= limits.MaxItems || tokens+pieceTokens > limits.MaxTokens) {
+			batches = append(batches, batch)
+			batch = embeddingBatch{from: i, to: i}
+			tokens = 0
+		}
+		batch.to = i + 1
+		tokens += pieceTokens
+	}
+	batches = append(batches, batch)
+
+	embeddings, err := embedBatches(ctx, e, limits.Concurrency, pieces, batches, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Embedding, len(texts))
+	for i, owner := range owners {
+		if owner[1]-owner[0] == 1 {
+			result[i] = embeddings[owner[0]]
+			continue
+		}
+		result[i] = averageEmbeddings(pieces[owner[0]:owner[1]], embeddings[owner[0]:owner[1]])
+	}
+	return result, nil
+}
+
+// embedBatches sends each batch of pieces to e, up to concurrency at a time,
+// and returns the embeddings in the order of pieces. The first error cancels
+// the requests still running.
+func embedBatches(ctx context.Context, e Embedder, concurrency int, pieces []string, batches []embeddingBatch, userID int) ([]Embedding, error) {
+	if len(batches) == 1 {
+		return embedBatch(ctx, e, pieces, batches[0], userID)
+	}
+
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	embeddings := make([]Embedding, len(pieces))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, batch := range batches {
+		select {
+		case sem <- struct{}{}:
+		case <-batchCtx.Done():
+		}
+		if batchCtx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			batchEmbeddings, err := embedBatch(batchCtx, e, pieces, batch, userID)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			copy(embeddings[batch.from:batch.to], batchEmbeddings)
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return embeddings, nil
+}
+
+func embedBatch(ctx context.Context, e Embedder, pieces []string, batch embeddingBatch, userID int) ([]Embedding, error) {
+	embeddings, err := e.Embed(ctx, pieces[batch.from:batch.to], userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != batch.to-batch.from {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", batch.to-batch.from, len(embeddings))
+	}
+	return embeddings, nil
+}
+
+// splitByTokens splits text into pieces of at most maxTokens estimated
+// tokens, breaking at whitespace where there is some in the second half of a
+// piece.
+func splitByTokens(text string, maxTokens int) []string {
+	if EstimateTokens(text) <= maxTokens {
+		return []string{text}
+	}
+
+	maxRunes := maxTokens * 4
+	runes := []rune(text)
+	pieces := []string{}
+	for len(runes) > maxRunes {
+		cut := maxRunes
+		for i := maxRunes; i > maxRunes/2; i-- {
+			if unicode.IsSpace(runes[i]) {
+				cut = i
+				break
+			}
+		}
+		if piece := strings.TrimSpace(string(runes[:cut])); piece != "" {
+			pieces = append(pieces, piece)
+		}
+		runes = runes[cut:]
+	}
+	if piece := strings.TrimSpace(string(runes)); piece != "" || len(pieces) == 0 {
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
+
+// averageEmbeddings returns the average of the embeddings of pieces, weighted
+// by the length of each piece and normalised to unit length.
+func averageEmbeddings(pieces []string, embeddings []Embedding) Embedding {
+	average := make(Embedding, len(embeddings[0]))
+	for i, embedding := range embeddings {
+		weight := float64(EstimateTokens(pieces[i]))
+		for j, v := range embedding {
+			average[j] += weight * v
+		}
+	}
+
+	var norm float64
+	for _, v := range average {
+		norm += v * v
+	}
+	if norm == 0 {
+		return average
+	}
+	norm = math.Sqrt(norm)
+	for j := range average {
+		average[j] /= norm
+	}
+	return average
+}
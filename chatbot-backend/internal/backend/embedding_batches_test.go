@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchRecordingEmbedder is a BatchingEmbedder that records the requests made
+// to it and the most that were in flight at once.
+type batchRecordingEmbedder struct {
+	*LocalEmbedder
+	limits EmbeddingBatchLimits
+	delay  time.Duration
+	failOn string
+
+	mu       sync.Mutex
+	batches  [][]string
+	inFlight int
+	peak     int
+}
+
+func (e *batchRecordingEmbedder) BatchLimits() EmbeddingBatchLimits {
+	return e.limits
+}
+
+func (e *batchRecordingEmbedder) Embed(ctx context.Context, texts []string, userID int) ([]Embedding, error) {
+	e.mu.Lock()
+	e.batches = append(e.batches, texts)
+	e.inFlight++
+	e.peak = max(e.peak, e.inFlight)
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.inFlight--
+		e.mu.Unlock()
+	}()
+
+	for _, text := range texts {
+		if e.failOn != "" && text == e.failOn {
+			return nil, errors.New("injected failure")
+		}
+	}
+	select {
+	case <-time.After(e.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return e.LocalEmbedder.Embed(ctx, texts, userID)
+}
+
+func TestCreateEmbeddingsBatches(t *testing.T) {
+	embedder := &batchRecordingEmbedder{
+		LocalEmbedder: NewLocalEmbedder(8),
+		limits:        EmbeddingBatchLimits{MaxItems: 3, MaxTokens: 6, MaxInputTokens: 10, Concurrency: 2},
+		delay:         10 * time.Millisecond,
+	}
+	texts := []string{}
+	for i := range 10 {
+		texts = append(texts, fmt.Sprintf("text %d", i))
+	}
+	texts = append(texts, strings.Repeat("long ", 4), "last")
+
+	embeddings, err := CreateEmbeddings(context.Background(), embedder, texts, 1)
+	if err != nil {
+		t.Fatalf("CreateEmbeddings failed: %v", err)
+	}
+	expected, err := embedder.LocalEmbedder.Embed(context.Background(), texts, 1)
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	for i := range texts {
+		if !equalEmbeddings(embeddings[i], expected[i]) {
+			t.Errorf("Expected the embedding of %q to be returned in order", texts[i])
+		}
+	}
+
+	// Three requests of three texts, then the tenth text alone, as the long
+	// text would take it over the token limit, and the long text with the last
+	if len(embedder.batches) != 5 {
+		t.Errorf("Expected 5 requests, got %d", len(embedder.batches))
+	}
+	for _, batch := range embedder.batches {
+		tokens := 0
+		for _, text := range batch {
+			tokens += EstimateTokens(text)
+		}
+		if len(batch) > 3 || tokens > 6 {
+			t.Errorf("Expected requests of at most 3 texts and 6 tokens, got %d texts and %d tokens", len(batch), tokens)
+		}
+	}
+	if embedder.peak > 2 {
+		t.Errorf("Expected at most 2 requests at once, got %d", embedder.peak)
+	}
+}
+
+func TestCreateEmbeddingsSplitsLongTexts(t *testing.T) {
+	embedder := &batchRecordingEmbedder{
+		LocalEmbedder: NewLocalEmbedder(8),
+		limits:        EmbeddingBatchLimits{MaxInputTokens: 5},
+	}
+	long := strings.Repeat("apple ", 10)
+
+	embeddings, err := CreateEmbeddings(context.Background(), embedder, []string{"short", long}, 1)
+	if err != nil {
+		t.Fatalf("CreateEmbeddings failed: %v", err)
+	}
+	if len(embeddings) != 2 {
+		t.Fatalf("Expected 2 embeddings, got %d", len(embeddings))
+	}
+	if len(embedder.batches) != 1 || len(embedder.batches[0]) <= 2 {
+		t.Fatalf("Expected the long text to be sent in pieces, got %q", embedder.batches)
+	}
+	for _, piece := range embedder.batches[0] {
+		if EstimateTokens(piece) > 5 {
+			t.Errorf("Expected pieces of at most 5 tokens, got %q", piece)
+		}
+	}
+
+	var norm float64
+	for _, v := range embeddings[1] {
+		norm += v * v
+	}
+	if math.Abs(norm-1) > 1e-9 {
+		t.Errorf("Expected the combined embedding to have unit length, got %v", math.Sqrt(norm))
+	}
+}
+
+func TestCreateEmbeddingsStopsOnError(t *testing.T) {
+	embedder := &batchRecordingEmbedder{
+		LocalEmbedder: NewLocalEmbedder(8),
+		limits:        EmbeddingBatchLimits{MaxItems: 1, Concurrency: 2},
+		delay:         time.Minute,
+		failOn:        "bad",
+	}
+	texts := []string{"bad"}
+	for i := range 20 {
+		texts = append(texts, fmt.Sprintf("text %d", i))
+	}
+
+	start := time.Now()
+	if _, err := CreateEmbeddings(context.Background(), embedder, texts, 1); err == nil {
+		t.Fatal("Expected CreateEmbeddings to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the running requests to be cancelled, took %v", elapsed)
+	}
+	if len(embedder.batches) >= len(texts) {
+		t.Errorf("Expected no more requests after the failure, got %d", len(embedder.batches))
+	}
+}
+
+func TestSplitByTokens(t *testing.T) {
+	tests := []struct {
+		text      string
+		maxTokens int
+		expected  []string
+	}{
+		{"short", 5, []string{"short"}},
+		{"", 5, []string{""}},
+		{"aaaa bbbb cccc", 3, []string{"aaaa bbbb", "cccc"}},
+		{"abcdefghij", 1, []string{"abcd", "efgh", "ij"}},
+	}
+	for _, test := range tests {
+		pieces := splitByTokens(test.text, test.maxTokens)
+		if strings.Join(pieces, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("splitByTokens(%q, %d): expected %q, got %q", test.text, test.maxTokens, test.expected, pieces)
+		}
+	}
+}
+
+func TestSyncDocumentsSharesEmbeddingRequests(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	embedder := &batchRecordingEmbedder{
+		LocalEmbedder: NewLocalEmbedder(8),
+		limits:        EmbeddingBatchLimits{MaxItems: 4},
+	}
+	docs := []Document{}
+	for i := range 5 {
+		docs = append(docs, Document{
+			Title:    fmt.Sprintf("Doc %d", i),
+			Content:  fmt.Sprintf("First paragraph of %d.\n\nSecond paragraph of %d.", i, i),
+			FilePath: fmt.Sprintf("/content/%d.md", i),
+		})
+	}
+	inScope := func(string) bool { return true }
+	result, err := SyncDocuments(db, docs, inScope, &ParagraphChunker{}, embedder, &User{ID: 1})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if result.Added != 5 {
+		t.Errorf("Expected 5 documents to be added, got %+v", result)
+	}
+
+	chunks := countRows(t, db, "chunks")
+	if expected := (chunks + 3) / 4; len(embedder.batches) != expected {
+		t.Errorf("Expected %d chunks to be embedded in %d requests, got %d", chunks, expected, len(embedder.batches))
+	}
+}
+
+func equalEmbeddings(a Embedding, b Embedding) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
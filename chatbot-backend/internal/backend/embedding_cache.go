@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// embeddingCacheBatch is the number of hashes looked up in the embedding
+// cache at a time, well under SQLite's limit on query parameters.
+const embeddingCacheBatch = 500
+
+// EmbeddingCacheStats counts the texts whose embeddings were found in the
+// cache and those that had to be embedded.
+type EmbeddingCacheStats struct {
+	Hits   int
+	Misses int
+}
+
+func (s EmbeddingCacheStats) String() string {
+	return fmt.Sprintf("%d embeddings reused from the cache, %d created", s.Hits, s.Misses)
+}
+
+// CachingEmbedder is an Embedder that stores the embeddings made by another
+// Embedder in the database and reuses them for text it has embedded before.
+// Embeddings are keyed by the SHA-256 hash of the text, as in Chunk.Hash, and
+// the model and dimensions of the embedder, so an edit to a document only
+// embeds the chunks that changed. The cache is kept when documents are
+// deleted, so re-adding a document does not embed it again.
+type CachingEmbedder struct {
+	db       *DB
+	embedder Embedder
+
+	mu    sync.Mutex
+	stats EmbeddingCacheStats
+}
+
+func NewCachingEmbedder(db *DB, embedder Embedder) *CachingEmbedder {
+	return &CachingEmbedder{db: db, embedder: embedder}
+}
+
+func (c *CachingEmbedder) Model() string {
+	return c.embedder.Model()
+}
+
+func (c *CachingEmbedder) Dimensions() int {
+	return c.embedder.Dimensions()
+}
+
+// Stats returns the cache hits and misses since the embedder was created.
+func (c *CachingEmbedder) Stats() EmbeddingCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *CachingEmbedder) Embed(ctx context.Context, texts []string, userID int) ([]Embedding, error) {
+	hashes := make([]string, len(texts))
+	for i, text := range texts {
+		hashes[i] = string(MakeHash(text))
+	}
+	cached, err := c.lookup(ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Embed each uncached text once, however often it appears
+	missing := []string{}
+	missingHashes := []string{}
+	for i, hash := range hashes {
+		if _, ok := cached[hash]; ok {
+			continue
+		}
+		cached[hash] = nil
+		missing = append(missing, texts[i])
+		missingHashes = append(missingHashes, hash)
+	}
+	if len(missing) > 0 {
+		embeddings, err := CreateEmbeddings(ctx, c.embedder, missing, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(embeddings) != len(missing) {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", len(missing), len(embeddings))
+		}
+		if err := c.store(missingHashes, embeddings); err != nil {
+			return nil, err
+		}
+		for i, hash := range missingHashes {
+			cached[hash] = embeddings[i]
+		}
+	}
+
+	result := make([]Embedding, len(texts))
+	for i, hash := range hashes {
+		result[i] = cached[hash]
+	}
+
+	c.mu.Lock()
+	c.stats.Hits += len(texts) - len(missing)
+	c.stats.Misses += len(missing)
+	c.mu.Unlock()
+	return result, nil
+}
+
+// lookup returns the cached embeddings for hashes, keyed by hash.
+func (c *CachingEmbedder) lookup(ctx context.Context, hashes []string) (map[string]Embedding, error) {
+	cached := map[string]Embedding{}
+	for start := 0; start < len(hashes); start += embeddingCacheBatch {
+		batch := hashes[start:min(start+embeddingCacheBatch, len(hashes))]
+		args := []any{c.Model(), c.Dimensions()}
+		for _, hash := range batch {
+			args = append(args, []byte(hash))
+		}
+		rows, err := c.db.conn.QueryContext(ctx, `
+			SELECT hash, embedding FROM embedding_cache
+			WHERE model = ? AND dimensions = ? AND hash IN (`+placeholders(len(batch))+`)
+		`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read embedding cache: %w", err)
+		}
+		for rows.Next() {
+			var hash, blob []byte
+			if err := rows.Scan(&hash, &blob); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan cached embedding: %w", err)
+			}
+			cached[string(hash)] = deserializeEmbedding(blob)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read embedding cache: %w", err)
+		}
+	}
+	return cached, nil
+}
+
+func (c *CachingEmbedder) store(hashes []string, embeddings []Embedding) error {
+	createdAt := formatTimestamp(time.Now())
+	return WithTx(c.db, func(tx *DB) error {
+		for i, hash := range hashes {
+			serialized, err := serializeEmbedding(embeddings[i])
+			if err != nil {
+				return err
+			}
+			_, err = tx.conn.Exec(`
+				INSERT OR REPLACE INTO embedding_cache (hash, model, dimensions, embedding, created_at)
+				VALUES (?, ?, ?, ?, ?)
+			`, []byte(hash), c.Model(), c.Dimensions(), serialized, createdAt)
+			if err != nil {
+				return fmt.Errorf("failed to cache embedding: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// recordingEmbedder is a local embedder that records the texts it embeds.
+type recordingEmbedder struct {
+	*LocalEmbedder
+	embedded []string
+}
+
+func (e *recordingEmbedder) Embed(ctx context.Context, texts []string, userID int) ([]Embedding, error) {
+	e.embedded = append(e.embedded, texts...)
+	return e.LocalEmbedder.Embed(ctx, texts, userID)
+}
+
+func TestCachingEmbedder(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	inner := &recordingEmbedder{LocalEmbedder: NewLocalEmbedder(0)}
+	cache := NewCachingEmbedder(db, inner)
+
+	first, err := cache.Embed(context.Background(), []string{"alpha", "beta", "alpha"}, 1)
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if !slices.Equal(inner.embedded, []string{"alpha", "beta"}) {
+		t.Errorf("Expected each text to be embedded once, got %q", inner.embedded)
+	}
+	if !slices.Equal(first[0], first[2]) || len(first[1]) != inner.Dimensions() {
+		t.Errorf("Unexpected embeddings: %v", first)
+	}
+
+	// A new embedder over the same database reuses the stored embeddings
+	inner.embedded = nil
+	cache = NewCachingEmbedder(db, inner)
+	second, err := cache.Embed(context.Background(), []string{"beta", "gamma"}, 1)
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if !slices.Equal(inner.embedded, []string{"gamma"}) {
+		t.Errorf("Expected only the new text to be embedded, got %q", inner.embedded)
+	}
+	expected, _ := inner.LocalEmbedder.Embed(context.Background(), []string{"beta"}, 1)
+	for i := range expected[0] {
+		// Cached embeddings are stored as float32
+		if float32(second[0][i]) != float32(expected[0][i]) {
+			t.Fatalf("Expected the cached embedding to match, got %v", second[0])
+		}
+	}
+	if stats := cache.Stats(); stats != (EmbeddingCacheStats{Hits: 1, Misses: 1}) {
+		t.Errorf("Expected 1 hit and 1 miss, got %+v", stats)
+	}
+
+	// Embeddings of another size are cached separately
+	inner.embedded = nil
+	other := NewCachingEmbedder(db, &recordingEmbedder{LocalEmbedder: NewLocalEmbedder(8)})
+	embeddings, err := other.Embed(context.Background(), []string{"beta"}, 1)
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if len(embeddings[0]) != 8 || other.Stats().Misses != 1 {
+		t.Errorf("Expected an 8-dimensional embedding to be created, got %d dimensions and %+v", len(embeddings[0]), other.Stats())
+	}
+}
+
+func TestSyncReusesCachedEmbeddings(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.md")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write a.md: %v", err)
+		}
+	}
+	write("---\ntitle: A\n---\nFirst paragraph.\n\nSecond paragraph.")
+
+	inner := &recordingEmbedder{LocalEmbedder: NewLocalEmbedder(0)}
+	embedder := NewCachingEmbedder(db, inner)
+	chunker := &ParagraphChunker{}
+	user := &User{ID: 1}
+	if _, err := SyncHugoDirectory(db, dir, false, chunker, embedder, user); err != nil {
+		t.Fatalf("Initial sync failed: %v", err)
+	}
+
+	// Editing one paragraph only embeds that paragraph and the whole document
+	inner.embedded = nil
+	write("---\ntitle: A\n---\nFirst paragraph.\n\nSecond paragraph, edited.")
+	if _, err := SyncHugoDirectory(db, dir, false, chunker, embedder, user); err != nil {
+		t.Fatalf("Second sync failed: %v", err)
+	}
+	if len(inner.embedded) != 2 || slices.Contains(inner.embedded, "First paragraph.") {
+		t.Errorf("Expected only the changed chunks to be embedded, got %q", inner.embedded)
+	}
+
+	// Removing and re-adding the document embeds nothing
+	inner.embedded = nil
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Failed to remove a.md: %v", err)
+	}
+	if _, err := SyncHugoDirectory(db, dir, false, chunker, embedder, user); err != nil {
+		t.Fatalf("Third sync failed: %v", err)
+	}
+	write("---\ntitle: A\n---\nFirst paragraph.\n\nSecond paragraph, edited.")
+	if _, err := SyncHugoDirectory(db, dir, false, chunker, embedder, user); err != nil {
+		t.Fatalf("Fourth sync failed: %v", err)
+	}
+	if len(inner.embedded) != 0 {
+		t.Errorf("Expected the re-added document to use cached embeddings, got %q", inner.embedded)
+	}
+}
@@ -12,55 +12,132 @@ import (
 
 type Embedding []float64
 
+const (
+	EmbeddingProviderOpenAI = "openai"
+	EmbeddingProviderLocal  = "local"
+)
+
+// Embedder turns text into embedding vectors. Model and Dimensions describe
+// the vectors it produces so that incompatible embeddings are not mixed.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string, userID int) ([]Embedding, error)
+	Model() string
+	Dimensions() int
+}
+
+// EmbeddingConfig selects and configures an Embedder. Model, Retry and Batch
+// only apply to OpenAI, and Model defaults to text-embedding-3-small.
+// Dimensions defaults to the model's full size.
+type EmbeddingConfig struct {
+	Provider   string
+	Model      string
+	Dimensions int
+	Retry      RetryPolicy
+	Batch      EmbeddingBatchLimits
+}
+
+// EmbeddingConfigFromEnv reads the embedding configuration from
+// EMBEDDING_PROVIDER, EMBEDDING_MODEL and EMBEDDING_DIMENSIONS, the retry
+// policy for OpenAI requests with RetryPolicyFromEnv and their batch limits
+// with EmbeddingBatchLimitsFromEnv.
+func EmbeddingConfigFromEnv() EmbeddingConfig {
+	dimensions, _ := strconv.Atoi(os.Getenv("EMBEDDING_DIMENSIONS"))
+	return EmbeddingConfig{
+		Provider:   os.Getenv("EMBEDDING_PROVIDER"),
+		Model:      os.Getenv("EMBEDDING_MODEL"),
+		Dimensions: dimensions,
+		Retry:      RetryPolicyFromEnv(),
+		Batch:      EmbeddingBatchLimitsFromEnv(),
+	}
+}
+
+// NewEmbedder creates the Embedder described by config. An empty provider
+// defaults to OpenAI.
+func NewEmbedder(config EmbeddingConfig) (Embedder, error) {
+	switch config.Provider {
+	case "", EmbeddingProviderOpenAI:
+		return newEmbeddingClient(config)
+	case EmbeddingProviderLocal:
+		return NewLocalEmbedder(config.Dimensions), nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider: %s", config.Provider)
+	}
+}
+
 // Client wraps the OpenAI client for embedding operations
 type EmbeddingClient struct {
-	client *openai.Client
+	client     *openai.Client
+	model      string
+	dimensions int
+	// shorten requests dimensions from the API, for embeddings shorter than
+	// the model's full size.
+	shorten bool
+	limits  EmbeddingBatchLimits
 }
 
 // NewEmbeddingClient creates a new embedding client using the OpenAI API key from environment
 func NewEmbeddingClient() (*EmbeddingClient, error) {
+	return newEmbeddingClient(EmbeddingConfig{Retry: RetryPolicyFromEnv(), Batch: EmbeddingBatchLimitsFromEnv()})
+}
+
+func newEmbeddingClient(config EmbeddingConfig, opts ...option.RequestOption) (*EmbeddingClient, error) {
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
 		return nil, fmt.Errorf("OPENAI_API_KEY environment variable not set")
 	}
 
-	client := openai.NewClient(option.WithAPIKey(apiKey))
-	return &EmbeddingClient{client: client}, nil
+	model := config.Model
+	if model == "" {
+		model = openai.EmbeddingModelTextEmbedding3Small
+	}
+	dimensions := openAIEmbeddingDimensions(model)
+	shorten := config.Dimensions > 0 && config.Dimensions != dimensions
+	if shorten {
+		dimensions = config.Dimensions
+	}
+
+	client := newOpenAIClient(config.Retry, append([]option.RequestOption{option.WithAPIKey(apiKey)}, opts...)...)
+	return &EmbeddingClient{client: client, model: model, dimensions: dimensions, shorten: shorten, limits: config.Batch.withDefaults()}, nil
 }
 
-// CreateEmbedding generates an embedding vector for a single string
-func CreateEmbedding(c *EmbeddingClient, text string, userID int) (Embedding, error) {
-	embeddings, err := CreateEmbeddings(c, []string{text}, userID)
-	if err != nil {
-		return nil, err
+// openAIEmbeddingDimensions returns the full size of the embeddings produced
+// by an OpenAI model.
+func openAIEmbeddingDimensions(model string) int {
+	if model == openai.EmbeddingModelTextEmbedding3Large {
+		return 3072
 	}
+	return 1536
+}
 
-	if len(embeddings) == 0 {
-		return nil, fmt.Errorf("no embeddings returned")
-	}
+func (c *EmbeddingClient) Model() string {
+	return c.model
+}
 
-	return embeddings[0], nil
+func (c *EmbeddingClient) Dimensions() int {
+	return c.dimensions
 }
 
-// CreateEmbeddings generates embedding vectors for multiple strings
-func CreateEmbeddings(c *EmbeddingClient, texts []string, userID int) ([]Embedding, error) {
-	if len(texts) == 0 {
-		return []Embedding{}, nil
-	}
+func (c *EmbeddingClient) BatchLimits() EmbeddingBatchLimits {
+	return c.limits
+}
 
-	ctx := context.Background()
+func (c *EmbeddingClient) Embed(ctx context.Context, texts []string, userID int) ([]Embedding, error) {
 	userIDStr := strconv.Itoa(userID)
 
-	embedding, err := c.client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+	params := openai.EmbeddingNewParams{
 		Input: openai.F(
 			openai.EmbeddingNewParamsInputUnion(
 				openai.EmbeddingNewParamsInputArrayOfStrings(texts),
 			),
 		),
-		Model:          openai.F(openai.EmbeddingModelTextEmbedding3Small),
+		Model:          openai.F(c.model),
 		EncodingFormat: openai.F(openai.EmbeddingNewParamsEncodingFormatFloat),
 		User:           openai.F(userIDStr),
-	})
+	}
+	if c.shorten {
+		params.Dimensions = openai.F(int64(c.dimensions))
+	}
+	embedding, err := c.client.Embeddings.New(ctx, params, idempotent())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create embeddings: %w", err)
 	}
@@ -72,3 +149,31 @@ func CreateEmbeddings(c *EmbeddingClient, texts []string, userID int) ([]Embeddi
 
 	return result, nil
 }
+
+// CreateEmbedding generates an embedding vector for a single string
+func CreateEmbedding(ctx context.Context, e Embedder, text string, userID int) (Embedding, error) {
+	embeddings, err := CreateEmbeddings(ctx, e, []string{text}, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(embeddings) == 0 {
+		return nil, fmt.Errorf("no embeddings returned")
+	}
+
+	return embeddings[0], nil
+}
+
+// CreateEmbeddings generates embedding vectors for multiple strings. For a
+// BatchingEmbedder, the strings are packed into as few requests as its limits
+// allow, which run concurrently.
+func CreateEmbeddings(ctx context.Context, e Embedder, texts []string, userID int) ([]Embedding, error) {
+	if len(texts) == 0 {
+		return []Embedding{}, nil
+	}
+
+	if batching, ok := e.(BatchingEmbedder); ok {
+		return embedInBatches(ctx, e, batching.BatchLimits(), texts, userID)
+	}
+	return e.Embed(ctx, texts, userID)
+}
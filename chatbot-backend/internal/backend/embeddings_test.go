@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -28,7 +29,7 @@ func TestCreateEmbedding(t *testing.T) {
 	text := "This is a test sentence for embedding generation."
 	userID := 123
 
-	embedding, err := CreateEmbedding(client, text, userID)
+	embedding, err := CreateEmbedding(context.Background(), client, text, userID)
 	if err != nil {
 		t.Fatalf("Failed to create embedding: %v", err)
 	}
@@ -70,7 +71,7 @@ func TestCreateEmbeddings(t *testing.T) {
 	}
 	userID := 123
 
-	embeddings, err := CreateEmbeddings(client, texts, userID)
+	embeddings, err := CreateEmbeddings(context.Background(), client, texts, userID)
 	if err != nil {
 		t.Fatalf("Failed to create embeddings: %v", err)
 	}
@@ -89,7 +90,7 @@ func TestCreateEmbeddings(t *testing.T) {
 	}
 
 	// Test empty input
-	emptyEmbeddings, err := CreateEmbeddings(client, []string{}, userID)
+	emptyEmbeddings, err := CreateEmbeddings(context.Background(), client, []string{}, userID)
 	if err != nil {
 		t.Fatalf("Failed on empty input: %v", err)
 	}
@@ -97,3 +98,48 @@ func TestCreateEmbeddings(t *testing.T) {
 		t.Errorf("Expected empty result for empty input, got %d embeddings", len(emptyEmbeddings))
 	}
 }
+
+func TestLocalEmbedder(t *testing.T) {
+	embedder := NewLocalEmbedder(0)
+	if embedder.Dimensions() != DefaultLocalEmbeddingDimensions {
+		t.Errorf("Expected %d dimensions, got %d", DefaultLocalEmbeddingDimensions, embedder.Dimensions())
+	}
+
+	texts := []string{
+		"Epistemic Technology is an AI consultancy based in Kingston, New York.",
+		"Epistemic Technology is an AI consultancy based in Kingston, New York.",
+		"Where is the AI consultancy based? Kingston, New York.",
+		"Reinforcement learning lets robots learn by trial and error.",
+	}
+	embeddings, err := CreateEmbeddings(context.Background(), embedder, texts, 1)
+	if err != nil {
+		t.Fatalf("Failed to create embeddings: %v", err)
+	}
+	if len(embeddings) != len(texts) {
+		t.Fatalf("Expected %d embeddings, got %d", len(texts), len(embeddings))
+	}
+
+	dot := func(a, b Embedding) float64 {
+		var sum float64
+		for i := range a {
+			sum += a[i] * b[i]
+		}
+		return sum
+	}
+
+	for i, embedding := range embeddings {
+		if len(embedding) != embedder.Dimensions() {
+			t.Errorf("Embedding %d has %d dimensions, expected %d", i, len(embedding), embedder.Dimensions())
+		}
+		if norm := dot(embedding, embedding); norm < 0.999 || norm > 1.001 {
+			t.Errorf("Embedding %d is not normalized: squared norm %f", i, norm)
+		}
+	}
+
+	if dot(embeddings[0], embeddings[1]) < 0.999 {
+		t.Error("Expected identical texts to have identical embeddings")
+	}
+	if dot(embeddings[0], embeddings[2]) <= dot(embeddings[0], embeddings[3]) {
+		t.Error("Expected texts sharing vocabulary to be more similar than unrelated texts")
+	}
+}
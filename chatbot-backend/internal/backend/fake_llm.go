@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// FakeLLMClient is a deterministic LLMProvider for tests and offline
+// development. It replies with Response if set, and otherwise echoes the last
+// user message. A structured request is answered with Response if it is
+// JSON, and otherwise with that reply as an Answer that cites nothing. Every
+// request is recorded in Requests. Like a real client, it fails once its
+// context is done.
+type FakeLLMClient struct {
+	Response string
+
+	mu       sync.Mutex
+	Requests [][]Message
+}
+
+func NewFakeLLMClient() *FakeLLMClient {
+	return &FakeLLMClient{}
+}
+
+func (c *FakeLLMClient) Complete(ctx context.Context, messages []Message) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Requests = append(c.Requests, messages)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return c.reply(messages), nil
+}
+
+// CompleteStream emits the reply one word at a time.
+func (c *FakeLLMClient) CompleteStream(ctx context.Context, messages []Message, onDelta func(delta string) error) (string, error) {
+	response, err := c.Complete(ctx, messages)
+	if err != nil {
+		return "", err
+	}
+	return response, c.stream(ctx, response, onDelta)
+}
+
+func (c *FakeLLMClient) CompleteJSON(ctx context.Context, messages []Message, schema ResponseSchema) (string, error) {
+	response, err := c.Complete(ctx, messages)
+	if err != nil {
+		return "", err
+	}
+	if json.Valid([]byte(response)) {
+		return response, nil
+	}
+	structured, err := json.Marshal(TextAnswer(response))
+	return string(structured), err
+}
+
+// CompleteJSONStream emits the JSON reply one word at a time.
+func (c *FakeLLMClient) CompleteJSONStream(ctx context.Context, messages []Message, schema ResponseSchema, onDelta func(delta string) error) (string, error) {
+	response, err := c.CompleteJSON(ctx, messages, schema)
+	if err != nil {
+		return "", err
+	}
+	return response, c.stream(ctx, response, onDelta)
+}
+
+func (c *FakeLLMClient) stream(ctx context.Context, response string, onDelta func(delta string) error) error {
+	words := strings.SplitAfter(response, " ")
+	for _, word := range words {
+		if word == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := onDelta(word); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FakeLLMClient) reply(messages []Message) string {
+	if c.Response != "" {
+		return c.Response
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == RoleUser {
+			return "Fake response to: " + messages[i].Content
+		}
+	}
+	return "Fake response"
+}
@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ParseFrontMatter splits Hugo content into its front matter and body. YAML
+// front matter is delimited by "---", TOML by "+++", and JSON is an object at
+// the start of the file. Keys are lowercased, as Hugo treats them case
+// insensitively, and dates are converted to strings. YAML that fails to parse
+// falls back to reading simple "key: value" lines. Content without front
+// matter is returned unchanged with a nil map.
+func ParseFrontMatter(content string) (map[string]any, string, error) {
+	var metadata map[string]any
+	trimmed := strings.TrimLeft(content, "\ufeff \t\r\n")
+
+	if strings.HasPrefix(trimmed, "{") {
+		decoder := json.NewDecoder(strings.NewReader(trimmed))
+		if err := decoder.Decode(&metadata); err != nil {
+			return nil, content, fmt.Errorf("failed to parse JSON front matter: %w", err)
+		}
+		body := strings.TrimPrefix(trimmed[decoder.InputOffset():], "\n")
+		return normalizeFrontMatter(metadata), body, nil
+	}
+
+	lines := strings.Split(trimmed, "\n")
+	delimiter := strings.TrimSpace(lines[0])
+	if delimiter != "---" && delimiter != "+++" {
+		return nil, content, nil
+	}
+
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == delimiter {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return nil, content, nil
+	}
+
+	raw := strings.Join(lines[1:end], "\n")
+	body := strings.Join(lines[end+1:], "\n")
+
+	if delimiter == "+++" {
+		if _, err := toml.Decode(raw, &metadata); err != nil {
+			return nil, content, fmt.Errorf("failed to parse TOML front matter: %w", err)
+		}
+		return normalizeFrontMatter(metadata), body, nil
+	}
+
+	if err := yaml.Unmarshal([]byte(raw), &metadata); err != nil {
+		return parseLenientYAML(raw), body, nil
+	}
+	return normalizeFrontMatter(metadata), body, nil
+}
+
+// parseLenientYAML reads top-level "key: value" lines from front matter that
+// is not valid YAML, such as titles containing an unquoted ": ".
+func parseLenientYAML(raw string) map[string]any {
+	metadata := map[string]any{}
+	for _, line := range strings.Split(raw, "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		switch value {
+		case "true":
+			metadata[key] = true
+		case "false":
+			metadata[key] = false
+		default:
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+func normalizeFrontMatter(metadata map[string]any) map[string]any {
+	if metadata == nil {
+		return map[string]any{}
+	}
+	normalized := make(map[string]any, len(metadata))
+	for key, value := range metadata {
+		normalized[strings.ToLower(key)] = normalizeFrontMatterValue(value)
+	}
+	return normalized
+}
+
+func normalizeFrontMatterValue(value any) any {
+	switch v := value.(type) {
+	case time.Time:
+		if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 && v.Nanosecond() == 0 {
+			return v.Format(time.DateOnly)
+		}
+		return v.Format(time.RFC3339)
+	case map[string]any:
+		nested := make(map[string]any, len(v))
+		for key, nestedValue := range v {
+			nested[key] = normalizeFrontMatterValue(nestedValue)
+		}
+		return nested
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = normalizeFrontMatterValue(item)
+		}
+		return items
+	case []map[string]any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = normalizeFrontMatterValue(item)
+		}
+		return items
+	default:
+		return v
+	}
+}
+
+// MetadataString returns the metadata value for key as a string, or "" if it
+// is missing or not a scalar.
+func MetadataString(metadata map[string]any, key string) string {
+	switch v := metadata[key].(type) {
+	case string:
+		return v
+	case int, int64, float64, bool:
+		return fmt.Sprint(v)
+	default:
+		return ""
+	}
+}
+
+// MetadataStrings returns the metadata value for key as a list of strings,
+// accepting either a list or a single string.
+func MetadataStrings(metadata map[string]any, key string) []string {
+	switch v := metadata[key].(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []any:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	case []string:
+		return v
+	default:
+		return nil
+	}
+}
+
+func metadataBool(metadata map[string]any, key string) bool {
+	switch v := metadata[key].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	default:
+		return false
+	}
+}
+
+// IsPublished reports whether Hugo would publish the page described by
+// metadata. Drafts, headless bundles and pages whose build options set render
+// to "never" are not published.
+func IsPublished(metadata map[string]any) bool {
+	if metadataBool(metadata, "draft") || metadataBool(metadata, "headless") {
+		return false
+	}
+	for _, key := range []string{"build", "_build"} {
+		options, ok := metadata[key].(map[string]any)
+		if !ok {
+			continue
+		}
+		switch render := options["render"].(type) {
+		case string:
+			if strings.EqualFold(render, "never") || strings.EqualFold(render, "false") {
+				return false
+			}
+		case bool:
+			if !render {
+				return false
+			}
+		}
+	}
+	return true
+}
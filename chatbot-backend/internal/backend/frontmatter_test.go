@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseFrontMatterFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "yaml",
+			content: `---
+title: "Building a Chatbot"
+Date: 2025-03-31
+tags: [rag, go]
+draft: false
+---
+Body text.`,
+		},
+		{
+			name: "toml",
+			content: `+++
+title = "Building a Chatbot"
+date = 2025-03-31
+tags = ["rag", "go"]
+draft = false
++++
+Body text.`,
+		},
+		{
+			name: "json",
+			content: `{
+  "title": "Building a Chatbot",
+  "date": "2025-03-31",
+  "tags": ["rag", "go"],
+  "draft": false
+}
+Body text.`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata, body, err := ParseFrontMatter(test.content)
+			if err != nil {
+				t.Fatalf("Failed to parse front matter: %v", err)
+			}
+			if body != "Body text." {
+				t.Errorf("Expected body %q, got %q", "Body text.", body)
+			}
+			if MetadataString(metadata, "title") != "Building a Chatbot" {
+				t.Errorf("Expected unquoted title, got %q", MetadataString(metadata, "title"))
+			}
+			if MetadataString(metadata, "date") != "2025-03-31" {
+				t.Errorf("Expected date 2025-03-31, got %q", MetadataString(metadata, "date"))
+			}
+			if tags := MetadataStrings(metadata, "tags"); !reflect.DeepEqual(tags, []string{"rag", "go"}) {
+				t.Errorf("Expected tags [rag go], got %v", tags)
+			}
+			if !IsPublished(metadata) {
+				t.Error("Expected the page to be published")
+			}
+		})
+	}
+}
+
+func TestParseFrontMatterWithoutFrontMatter(t *testing.T) {
+	content := "# Heading\n\n---\n\nText after a thematic break."
+	metadata, body, err := ParseFrontMatter(content)
+	if err != nil {
+		t.Fatalf("Failed to parse content: %v", err)
+	}
+	if metadata != nil {
+		t.Errorf("Expected no metadata, got %v", metadata)
+	}
+	if body != content {
+		t.Errorf("Expected the content to be unchanged, got %q", body)
+	}
+}
+
+func TestParseFrontMatterInvalid(t *testing.T) {
+	if _, _, err := ParseFrontMatter("+++\ntitle = \n+++\nBody"); err == nil {
+		t.Error("Expected an error for invalid TOML front matter")
+	}
+
+	metadata, body, err := ParseFrontMatter("---\ntitle: Transformers: The Building Blocks\ndraft: true\n---\nBody")
+	if err != nil {
+		t.Fatalf("Expected invalid YAML to fall back to key: value parsing, got %v", err)
+	}
+	if MetadataString(metadata, "title") != "Transformers: The Building Blocks" {
+		t.Errorf("Unexpected title %q", MetadataString(metadata, "title"))
+	}
+	if IsPublished(metadata) {
+		t.Error("Expected the draft to be unpublished")
+	}
+	if body != "Body" {
+		t.Errorf("Expected body %q, got %q", "Body", body)
+	}
+}
+
+func TestIsPublished(t *testing.T) {
+	tests := []struct {
+		name      string
+		metadata  map[string]any
+		published bool
+	}{
+		{"no metadata", nil, true},
+		{"draft", map[string]any{"draft": true}, false},
+		{"not draft", map[string]any{"draft": false}, true},
+		{"headless", map[string]any{"headless": true}, false},
+		{"render never", map[string]any{"build": map[string]any{"render": "never"}}, false},
+		{"legacy render false", map[string]any{"_build": map[string]any{"render": false}}, false},
+		{"list never", map[string]any{"build": map[string]any{"list": "never"}}, true},
+	}
+
+	for _, test := range tests {
+		if got := IsPublished(test.metadata); got != test.published {
+			t.Errorf("%s: expected published %v, got %v", test.name, test.published, got)
+		}
+	}
+}
+
+func TestHugoDirectoryToDocumentsSkipsUnpublished(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"published.md": "---\ntitle: Published\nauthors: [Ada, Grace]\n---\nPublished content.",
+		"draft.md":     "---\ntitle: Draft\ndraft: true\n---\nDraft content.",
+		"hidden.md":    "+++\ntitle = \"Hidden\"\n[_build]\nrender = \"never\"\n+++\nHidden content.",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	docs, err := HugoDirectoryToDocuments(dir, false)
+	if err != nil {
+		t.Fatalf("Failed to load documents: %v", err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("Expected only the published document, got %d documents", len(docs))
+	}
+	if docs[0].Title != "Published" || docs[0].Author != "Ada, Grace" {
+		t.Errorf("Unexpected document: %q by %q", docs[0].Title, docs[0].Author)
+	}
+}
+
+func TestDocumentMetadataIsPersisted(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	doc := &Document{
+		Title:    "Tagged",
+		Content:  "Tagged content.",
+		Metadata: map[string]any{"tags": []any{"rag"}, "description": "A tagged page"},
+	}
+	if err := InsertDocument(db, doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	stored, err := GetDocumentByID(db, doc.ID)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if !reflect.DeepEqual(stored.Metadata, doc.Metadata) {
+		t.Errorf("Expected metadata %v, got %v", doc.Metadata, stored.Metadata)
+	}
+}
@@ -3,15 +3,124 @@ package backend
 import (
 	"context"
 	_ "embed"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
 )
 
+const (
+	LLMProviderOpenAI           = "openai"
+	LLMProviderOpenAICompatible = "openai-compatible"
+	LLMProviderFake             = "fake"
+)
+
+// Response formats an LLMProvider can use for structured responses.
+// ResponseFormatJSONSchema sends the schema as a strict json_schema response
+// format. ResponseFormatJSONObject only asks for a JSON object, and
+// ResponseFormatNone sends no response format, for servers that reject the
+// field; both give the schema in an instruction instead.
+const (
+	ResponseFormatJSONSchema = "json_schema"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatNone       = "none"
+)
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Message is a single role-tagged message sent to an LLM.
+type Message struct {
+	Role    string
+	Content string
+}
+
+// LLMProvider generates chat completions from a list of messages.
+// CompleteJSON and CompleteJSONStream work like Complete and CompleteStream
+// but constrain the response to JSON matching schema.
+type LLMProvider interface {
+	Complete(ctx context.Context, messages []Message) (string, error)
+	CompleteStream(ctx context.Context, messages []Message, onDelta func(delta string) error) (string, error)
+	CompleteJSON(ctx context.Context, messages []Message, schema ResponseSchema) (string, error)
+	CompleteJSONStream(ctx context.Context, messages []Message, schema ResponseSchema, onDelta func(delta string) error) (string, error)
+}
+
+// ResponseSchema is a JSON schema that a structured response must match.
+// Schemas are strict: every property is required and no others are allowed.
+type ResponseSchema struct {
+	Name   string
+	Schema map[string]any
+}
+
+// LLMConfig selects and configures an LLMProvider. ResponseFormat is one of
+// the ResponseFormat constants, and defaults to ResponseFormatJSONSchema for
+// OpenAI and ResponseFormatNone for an OpenAI-compatible server, since many
+// of them do not support JSON schemas.
+type LLMConfig struct {
+	Provider       string
+	BaseURL        string
+	APIKey         string
+	Model          string
+	ResponseFormat string
+	Retry          RetryPolicy
+}
+
+// LLMConfigFromEnv reads the LLM configuration from LLM_PROVIDER, LLM_BASE_URL,
+// LLM_API_KEY, LLM_MODEL and LLM_RESPONSE_FORMAT, and the retry policy with
+// RetryPolicyFromEnv. LLM_API_KEY falls back to OPENAI_API_KEY.
+func LLMConfigFromEnv() LLMConfig {
+	apiKey := os.Getenv("LLM_API_KEY")
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+	return LLMConfig{
+		Provider:       os.Getenv("LLM_PROVIDER"),
+		BaseURL:        os.Getenv("LLM_BASE_URL"),
+		APIKey:         apiKey,
+		Model:          os.Getenv("LLM_MODEL"),
+		ResponseFormat: os.Getenv("LLM_RESPONSE_FORMAT"),
+		Retry:          RetryPolicyFromEnv(),
+	}
+}
+
+// NewLLMProvider creates the LLMProvider described by config. An empty
+// provider defaults to OpenAI.
+func NewLLMProvider(config LLMConfig) (LLMProvider, error) {
+	switch config.Provider {
+	case "", LLMProviderOpenAI:
+		if config.APIKey == "" {
+			return nil, fmt.Errorf("OPENAI_API_KEY environment variable not set")
+		}
+		responseFormat, err := checkResponseFormat(config.ResponseFormat, ResponseFormatJSONSchema)
+		if err != nil {
+			return nil, err
+		}
+		client := newOpenAIClient(config.Retry, option.WithAPIKey(config.APIKey))
+		return &LLMClient{client: client, model: modelOrDefault(config.Model), responseFormat: responseFormat, retryCompletions: config.Retry.RetryCompletions}, nil
+	case LLMProviderOpenAICompatible:
+		return NewOpenAICompatibleLLMClient(config.BaseURL, config.APIKey, config.Model, config.ResponseFormat, config.Retry)
+	case LLMProviderFake:
+		return NewFakeLLMClient(), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider: %s", config.Provider)
+	}
+}
+
+// LLMClient is an LLMProvider backed by the OpenAI chat completions API or a
+// server that implements it. Structured responses are requested with
+// responseFormat, and failed requests are retried only if retryCompletions is
+// set.
 type LLMClient struct {
-	client *openai.Client
+	client           *openai.Client
+	model            string
+	responseFormat   string
+	retryCompletions bool
 }
 
 func NewLLMClient() (*LLMClient, error) {
@@ -20,28 +129,258 @@ func NewLLMClient() (*LLMClient, error) {
 		return nil, fmt.Errorf("OPENAI_API_KEY environment variable not set")
 	}
 
-	client := openai.NewClient(option.WithAPIKey(apiKey))
-	return &LLMClient{client: client}, nil
+	retry := RetryPolicyFromEnv()
+	client := newOpenAIClient(retry, option.WithAPIKey(apiKey))
+	return &LLMClient{client: client, model: openai.ChatModelGPT4oMini, responseFormat: ResponseFormatJSONSchema, retryCompletions: retry.RetryCompletions}, nil
+}
+
+// NewOpenAICompatibleLLMClient creates a client for a server that implements
+// the OpenAI chat completions API at baseURL, such as Ollama, llama.cpp or
+// vLLM. The API key is optional since local servers usually ignore it.
+// Structured responses are requested with responseFormat, which defaults to
+// ResponseFormatNone. Failed requests are retried according to retry, if it
+// allows completions to be retried.
+func NewOpenAICompatibleLLMClient(baseURL string, apiKey string, model string, responseFormat string, retry RetryPolicy) (*LLMClient, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("a base URL is required for an OpenAI-compatible LLM provider")
+	}
+	if model == "" {
+		return nil, fmt.Errorf("a model is required for an OpenAI-compatible LLM provider")
+	}
+	responseFormat, err := checkResponseFormat(responseFormat, ResponseFormatNone)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == "" {
+		apiKey = "none"
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	client := newOpenAIClient(retry, option.WithBaseURL(baseURL), option.WithAPIKey(apiKey))
+	return &LLMClient{client: client, model: model, responseFormat: responseFormat, retryCompletions: retry.RetryCompletions}, nil
+}
+
+// checkResponseFormat returns responseFormat, or fallback if it is empty, and
+// an error if it is not one of the ResponseFormat constants.
+func checkResponseFormat(responseFormat string, fallback string) (string, error) {
+	switch responseFormat {
+	case "":
+		return fallback, nil
+	case ResponseFormatJSONSchema, ResponseFormatJSONObject, ResponseFormatNone:
+		return responseFormat, nil
+	default:
+		return "", fmt.Errorf("unknown LLM response format: %s", responseFormat)
+	}
+}
+
+func modelOrDefault(model string) string {
+	if model == "" {
+		return openai.ChatModelGPT4oMini
+	}
+	return model
+}
+
+func (c *LLMClient) Complete(ctx context.Context, messages []Message) (string, error) {
+	return c.complete(ctx, c.params(messages, nil))
+}
+
+func (c *LLMClient) CompleteStream(ctx context.Context, messages []Message, onDelta func(delta string) error) (string, error) {
+	return c.completeStream(ctx, c.params(messages, nil), onDelta)
+}
+
+func (c *LLMClient) CompleteJSON(ctx context.Context, messages []Message, schema ResponseSchema) (string, error) {
+	return c.complete(ctx, c.params(messages, &schema))
+}
+
+func (c *LLMClient) CompleteJSONStream(ctx context.Context, messages []Message, schema ResponseSchema, onDelta func(delta string) error) (string, error) {
+	return c.completeStream(ctx, c.params(messages, &schema), onDelta)
+}
+
+// params builds a chat completion request for messages. If schema is not nil,
+// the response is constrained to it according to the client's response
+// format: with the schema as the response format, or with an instruction
+// giving the schema and, for ResponseFormatJSONObject, a JSON object response
+// format.
+func (c *LLMClient) params(messages []Message, schema *ResponseSchema) openai.ChatCompletionNewParams {
+	if schema != nil && c.responseFormat != ResponseFormatJSONSchema {
+		messages = append(messages[:len(messages):len(messages)], Message{Role: RoleSystem, Content: schemaInstruction(*schema)})
+	}
+	params := openai.ChatCompletionNewParams{
+		Messages: openai.F(toOpenAIMessages(messages)),
+		Model:    openai.F(c.model),
+	}
+	if schema == nil {
+		return params
+	}
+	switch c.responseFormat {
+	case ResponseFormatJSONSchema:
+		params.ResponseFormat = openai.F[openai.ChatCompletionNewParamsResponseFormatUnion](openai.ResponseFormatJSONSchemaParam{
+			Type: openai.F(openai.ResponseFormatJSONSchemaTypeJSONSchema),
+			JSONSchema: openai.F(openai.ResponseFormatJSONSchemaJSONSchemaParam{
+				Name:   openai.F(schema.Name),
+				Schema: openai.F[any](schema.Schema),
+				Strict: openai.F(true),
+			}),
+		})
+	case ResponseFormatJSONObject:
+		params.ResponseFormat = openai.F[openai.ChatCompletionNewParamsResponseFormatUnion](openai.ResponseFormatJSONObjectParam{
+			Type: openai.F(openai.ResponseFormatJSONObjectTypeJSONObject),
+		})
+	}
+	return params
+}
+
+// schemaInstruction asks for a response matching schema, for servers that
+// are not given the schema as the response format.
+func schemaInstruction(schema ResponseSchema) string {
+	// The schemas hold only maps, slices and strings, so cannot fail to encode
+	encoded, _ := json.Marshal(schema.Schema)
+	return "Respond with only a JSON object, without markdown formatting, that matches this JSON schema:\n" + string(encoded)
+}
+
+// requestOptions marks completion requests as safe to retry if the client
+// allows it.
+func (c *LLMClient) requestOptions() []option.RequestOption {
+	if !c.retryCompletions {
+		return nil
+	}
+	return []option.RequestOption{idempotent()}
+}
+
+func (c *LLMClient) complete(ctx context.Context, params openai.ChatCompletionNewParams) (string, error) {
+	response, err := c.client.Chat.Completions.New(ctx, params, c.requestOptions()...)
+	if err != nil {
+		return "", fmt.Errorf("failed to create chat completion: %w", err)
+	}
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("chat completion returned no choices")
+	}
+
+	return response.Choices[0].Message.Content, nil
+}
+
+func (c *LLMClient) completeStream(ctx context.Context, params openai.ChatCompletionNewParams, onDelta func(delta string) error) (string, error) {
+	stream := c.client.Chat.Completions.NewStreaming(ctx, params, c.requestOptions()...)
+	defer stream.Close()
+
+	var response strings.Builder
+	for stream.Next() {
+		chunk := stream.Current()
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		if delta == "" {
+			continue
+		}
+		response.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return response.String(), err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return response.String(), fmt.Errorf("failed to stream chat completion: %w", err)
+	}
+
+	return response.String(), nil
+}
+
+func toOpenAIMessages(messages []Message) []openai.ChatCompletionMessageParamUnion {
+	params := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	for _, message := range messages {
+		switch message.Role {
+		case RoleSystem:
+			params = append(params, openai.SystemMessage(message.Content))
+		case RoleAssistant:
+			params = append(params, openai.AssistantMessage(message.Content))
+		default:
+			params = append(params, openai.UserMessage(message.Content))
+		}
+	}
+	return params
 }
 
 //go:embed system_prompt.md
 var systemPrompt string
 
-func Chat(c *LLMClient, query string) (string, error) {
-	ctx := context.Background()
-
-	response, err := c.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Messages: openai.F(
-			[]openai.ChatCompletionMessageParamUnion{
-				openai.UserMessage(query),
-				openai.SystemMessage(systemPrompt),
-			},
-		),
-		Model: openai.F(openai.ChatModelGPT4oMini),
+// Chat sends messages, as built by ChatMessages, to the LLM and returns its
+// response.
+func Chat(ctx context.Context, p LLMProvider, messages []Message) (string, error) {
+	return p.Complete(ctx, messages)
+}
+
+// ChatStream sends messages to the LLM and calls onDelta with each piece of
+// content as it arrives. It returns the full response once the stream ends.
+func ChatStream(ctx context.Context, p LLMProvider, messages []Message, onDelta func(delta string) error) (string, error) {
+	return p.CompleteStream(ctx, messages, onDelta)
+}
+
+// ChatMessages builds the messages for one turn of a conversation: the system
+// prompt, the earlier turns in history, and query as the final user message.
+func ChatMessages(history []Message, query string) []Message {
+	messages := make([]Message, 0, len(history)+2)
+	messages = append(messages, Message{Role: RoleSystem, Content: systemPrompt})
+	messages = append(messages, history...)
+	messages = append(messages, Message{Role: RoleUser, Content: query})
+	return messages
+}
+
+//go:embed rewrite_prompt.md
+var rewritePrompt string
+
+// RewriteQuery asks the LLM to rewrite query, a follow-up to the conversation
+// in history, as a standalone search query. The query is returned unchanged
+// if there is no history or the LLM gives an empty answer.
+func RewriteQuery(ctx context.Context, p LLMProvider, history []Message, query string) (string, error) {
+	if len(history) == 0 {
+		return query, nil
+	}
+
+	conversation := ""
+	for _, message := range history {
+		speaker := "User"
+		if message.Role == RoleAssistant {
+			speaker = "Assistant"
+		}
+		conversation += speaker + ": " + message.Content + "\n"
+	}
+	response, err := p.Complete(ctx, []Message{
+		{Role: RoleSystem, Content: rewritePrompt},
+		{Role: RoleUser, Content: "Conversation:\n" + conversation + "\nLatest question: " + query},
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create chat completion: %w", err)
+		return "", fmt.Errorf("failed to rewrite query: %w", err)
 	}
 
-	return response.Choices[0].Message.Content, nil
+	rewritten := strings.Trim(strings.TrimSpace(response), `"`)
+	if rewritten == "" {
+		return query, nil
+	}
+	return rewritten, nil
+}
+
+// TrimHistory drops the oldest messages from history until the estimated
+// tokens in the rest fit within maxTokens. Whole turns are dropped, so the
+// trimmed history never starts with an assistant message. A maxTokens of zero
+// or less leaves history untrimmed.
+func TrimHistory(history []Message, maxTokens int) []Message {
+	if maxTokens <= 0 {
+		return history
+	}
+
+	start := len(history)
+	tokens := 0
+	for i := len(history) - 1; i >= 0; i-- {
+		tokens += EstimateTokens(history[i].Content)
+		if tokens > maxTokens {
+			break
+		}
+		start = i
+	}
+	for start < len(history) && history[start].Role != RoleUser {
+		start++
+	}
+	return history[start:]
 }
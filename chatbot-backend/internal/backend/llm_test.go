@@ -0,0 +1,362 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFakeLLMClient(t *testing.T) {
+	llm := NewFakeLLMClient()
+
+	response, err := Chat(context.Background(), llm, ChatMessages(nil, "What is Epistemic Technology?"))
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if response != "Fake response to: What is Epistemic Technology?" {
+		t.Errorf("Unexpected response: %q", response)
+	}
+
+	if len(llm.Requests) != 1 {
+		t.Fatalf("Expected 1 recorded request, got %d", len(llm.Requests))
+	}
+	foundSystem := false
+	for _, message := range llm.Requests[0] {
+		if message.Role == RoleSystem && message.Content == systemPrompt {
+			foundSystem = true
+		}
+	}
+	if !foundSystem {
+		t.Error("Expected the system prompt to be sent")
+	}
+}
+
+func TestFakeLLMClientStream(t *testing.T) {
+	llm := NewFakeLLMClient()
+	llm.Response = "A fixed streamed response"
+
+	var deltas []string
+	response, err := ChatStream(context.Background(), llm, ChatMessages(nil, "Anything"), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatStream failed: %v", err)
+	}
+	if response != llm.Response {
+		t.Errorf("Expected %q, got %q", llm.Response, response)
+	}
+	if len(deltas) != 4 {
+		t.Errorf("Expected 4 deltas, got %d", len(deltas))
+	}
+	if strings.Join(deltas, "") != response {
+		t.Errorf("Expected deltas to add up to %q, got %q", response, strings.Join(deltas, ""))
+	}
+}
+
+func TestNewLLMProvider(t *testing.T) {
+	if _, err := NewLLMProvider(LLMConfig{Provider: LLMProviderFake}); err != nil {
+		t.Errorf("Failed to create fake provider: %v", err)
+	}
+	if _, err := NewLLMProvider(LLMConfig{Provider: LLMProviderOpenAI}); err == nil {
+		t.Error("Expected an error creating an OpenAI provider without an API key")
+	}
+	if _, err := NewLLMProvider(LLMConfig{Provider: LLMProviderOpenAICompatible, Model: "llama3"}); err == nil {
+		t.Error("Expected an error creating an OpenAI-compatible provider without a base URL")
+	}
+	if _, err := NewLLMProvider(LLMConfig{Provider: LLMProviderOpenAICompatible, BaseURL: "http://localhost:11434/v1", Model: "llama3", ResponseFormat: "xml"}); err == nil {
+		t.Error("Expected an error for an unknown response format")
+	}
+	if _, err := NewLLMProvider(LLMConfig{Provider: "unknown"}); err == nil {
+		t.Error("Expected an error for an unknown provider")
+	}
+}
+
+func TestOpenAICompatibleLLMClient(t *testing.T) {
+	var requestedModel string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestedModel = body.Model
+
+		if body.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, delta := range []string{"Hello", " from", " local"} {
+				fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":0,\"model\":%q,\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", body.Model, delta)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"1","object":"chat.completion","created":0,"model":%q,"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Hello from local"}}]}`, body.Model)
+	}))
+	defer server.Close()
+
+	llm, err := NewOpenAICompatibleLLMClient(server.URL+"/v1", "", "llama3", "", RetryPolicy{})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	response, err := Chat(context.Background(), llm, ChatMessages(nil, "Hi"))
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if response != "Hello from local" {
+		t.Errorf("Unexpected response: %q", response)
+	}
+	if requestedModel != "llama3" {
+		t.Errorf("Expected model llama3, got %q", requestedModel)
+	}
+
+	var deltas []string
+	response, err = ChatStream(context.Background(), llm, ChatMessages(nil, "Hi"), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatStream failed: %v", err)
+	}
+	if response != "Hello from local" {
+		t.Errorf("Unexpected streamed response: %q", response)
+	}
+	if len(deltas) != 3 {
+		t.Errorf("Expected 3 deltas, got %d", len(deltas))
+	}
+}
+
+func TestOpenAICompatibleLLMClientStructuredAnswer(t *testing.T) {
+	var formats []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Stream         bool `json:"stream"`
+			ResponseFormat struct {
+				Type       string `json:"type"`
+				JSONSchema struct {
+					Name   string `json:"name"`
+					Strict bool   `json:"strict"`
+				} `json:"json_schema"`
+			} `json:"response_format"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := body.ResponseFormat
+		formats = append(formats, fmt.Sprintf("%s %s %v", format.Type, format.JSONSchema.Name, format.JSONSchema.Strict))
+
+		answer := `{"segments":[{"text":"We are in Kingston.","passages":[1]},{"text":"We build software.","passages":[]}]}`
+		if body.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for start := 0; start < len(answer); start += 7 {
+				delta := answer[start:min(start+7, len(answer))]
+				fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":0,\"model\":\"llama3\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", delta)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"1","object":"chat.completion","created":0,"model":"llama3","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%q}}]}`, answer)
+	}))
+	defer server.Close()
+
+	llm, err := NewOpenAICompatibleLLMClient(server.URL+"/v1", "", "llama3", ResponseFormatJSONSchema, RetryPolicy{})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	answer, err := ChatAnswer(context.Background(), llm, ChatMessages(nil, "Hi"))
+	if err != nil {
+		t.Fatalf("ChatAnswer failed: %v", err)
+	}
+	if answer.Text() != "We are in Kingston. We build software." || len(answer.Citations([]Chunk{{ID: 5}})) != 1 {
+		t.Errorf("Unexpected answer: %+v", answer)
+	}
+
+	var deltas []string
+	_, err = ChatAnswerStream(context.Background(), llm, ChatMessages(nil, "Hi"), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatAnswerStream failed: %v", err)
+	}
+	if len(deltas) != 2 || deltas[0] != "We are in Kingston." || deltas[1] != " We build software." {
+		t.Errorf("Expected the text of each segment to be streamed, got %q", deltas)
+	}
+
+	for _, format := range formats {
+		if format != "json_schema answer true" {
+			t.Errorf("Expected the answer schema to be required, got %q", format)
+		}
+	}
+}
+
+func TestOpenAICompatibleLLMClientPlainTextAnswer(t *testing.T) {
+	var requests []map[string]json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, body)
+
+		answer := "We are based in Kingston [1]."
+		if string(body["stream"]) == "true" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, delta := range []string{"We are", " based in", " Kingston [1]."} {
+				fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":0,\"model\":\"llama3\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", delta)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"1","object":"chat.completion","created":0,"model":"llama3","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%q}}]}`, answer)
+	}))
+	defer server.Close()
+
+	llm, err := NewOpenAICompatibleLLMClient(server.URL+"/v1", "", "llama3", "", RetryPolicy{})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	answer, err := ChatAnswer(context.Background(), llm, ChatMessages(nil, "Where are you?"))
+	if err != nil {
+		t.Fatalf("ChatAnswer failed: %v", err)
+	}
+	if answer.Text() != "We are based in Kingston [1]." || len(answer.Citations([]Chunk{{ID: 5}})) != 0 {
+		t.Errorf("Expected the plain text as an uncited answer, got %+v", answer)
+	}
+
+	var deltas []string
+	answer, err = ChatAnswerStream(context.Background(), llm, ChatMessages(nil, "Where are you?"), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatAnswerStream failed: %v", err)
+	}
+	if len(deltas) != 1 || deltas[0] != answer.Text() || len(answer.Citations([]Chunk{{ID: 5}})) != 0 {
+		t.Errorf("Expected the plain text answer to be sent in one piece, got %q", deltas)
+	}
+
+	// The server is not sent a response format, but is asked for the schema
+	for _, request := range requests {
+		if _, ok := request["response_format"]; ok {
+			t.Errorf("Expected no response format, got %s", request["response_format"])
+		}
+		var messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		}
+		if err := json.Unmarshal(request["messages"], &messages); err != nil {
+			t.Fatalf("Failed to decode messages: %v", err)
+		}
+		last := messages[len(messages)-1]
+		if last.Role != RoleSystem || !strings.Contains(string(last.Content), "segments") {
+			t.Errorf("Expected an instruction giving the answer schema, got %s", last.Content)
+		}
+	}
+}
+
+func TestChatMessages(t *testing.T) {
+	history := []Message{
+		{Role: RoleUser, Content: "What services do you offer?"},
+		{Role: RoleAssistant, Content: "We offer consulting."},
+	}
+	messages := ChatMessages(history, "How much does it cost?")
+
+	expected := []Message{
+		{Role: RoleSystem, Content: systemPrompt},
+		history[0],
+		history[1],
+		{Role: RoleUser, Content: "How much does it cost?"},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d", len(expected), len(messages))
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Errorf("Expected message %d to be %+v, got %+v", i, expected[i], messages[i])
+		}
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	history := []Message{
+		{Role: RoleUser, Content: strings.Repeat("a", 40)},
+		{Role: RoleAssistant, Content: strings.Repeat("b", 40)},
+		{Role: RoleUser, Content: strings.Repeat("c", 40)},
+		{Role: RoleAssistant, Content: strings.Repeat("d", 40)},
+	}
+
+	tests := []struct {
+		maxTokens int
+		expected  int
+	}{
+		{0, 4},
+		{100, 4},
+		{40, 4},
+		{39, 2},
+		{30, 2},
+		{20, 2},
+		{15, 0},
+	}
+	for _, test := range tests {
+		trimmed := TrimHistory(history, test.maxTokens)
+		if len(trimmed) != test.expected {
+			t.Errorf("TrimHistory(%d): expected %d messages, got %d", test.maxTokens, test.expected, len(trimmed))
+			continue
+		}
+		if len(trimmed) > 0 && trimmed[0].Role != RoleUser {
+			t.Errorf("TrimHistory(%d): expected the history to start with a user message", test.maxTokens)
+		}
+	}
+}
+
+func TestRewriteQuery(t *testing.T) {
+	llm := NewFakeLLMClient()
+
+	rewritten, err := RewriteQuery(context.Background(), llm, nil, "What services do you offer?")
+	if err != nil {
+		t.Fatalf("RewriteQuery failed: %v", err)
+	}
+	if rewritten != "What services do you offer?" || len(llm.Requests) != 0 {
+		t.Errorf("Expected a query without history to be used as is, got %q", rewritten)
+	}
+
+	llm.Response = " \"How much does Epistemic Technology's consulting cost?\"\n"
+	history := []Message{
+		{Role: RoleUser, Content: "What services do you offer?"},
+		{Role: RoleAssistant, Content: "We offer consulting."},
+	}
+	rewritten, err = RewriteQuery(context.Background(), llm, history, "How much does that cost?")
+	if err != nil {
+		t.Fatalf("RewriteQuery failed: %v", err)
+	}
+	if rewritten != "How much does Epistemic Technology's consulting cost?" {
+		t.Errorf("Unexpected rewritten query: %q", rewritten)
+	}
+	request := llm.Requests[0]
+	if request[0].Content != rewritePrompt {
+		t.Error("Expected the rewrite prompt to be sent")
+	}
+	if !strings.Contains(request[1].Content, "Assistant: We offer consulting.") || !strings.Contains(request[1].Content, "Latest question: How much does that cost?") {
+		t.Errorf("Expected the conversation and question to be sent, got %q", request[1].Content)
+	}
+}
@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	LocalEmbeddingModel             = "local-hashed-bow-v1"
+	DefaultLocalEmbeddingDimensions = 1536
+)
+
+var localStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true, "has": true,
+	"have": true, "in": true, "is": true, "it": true, "its": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true,
+	"was": true, "were": true, "will": true, "with": true,
+}
+
+// LocalEmbedder is an Embedder that needs no network access. It projects a
+// hashed bag of words and word bigrams into a fixed number of dimensions, so
+// texts that share vocabulary end up close together. It is much weaker than a
+// trained model but is deterministic and suitable for CI and development.
+type LocalEmbedder struct {
+	dimensions int
+}
+
+// NewLocalEmbedder creates a LocalEmbedder. A non-positive dimensions uses
+// DefaultLocalEmbeddingDimensions.
+func NewLocalEmbedder(dimensions int) *LocalEmbedder {
+	if dimensions <= 0 {
+		dimensions = DefaultLocalEmbeddingDimensions
+	}
+	return &LocalEmbedder{dimensions: dimensions}
+}
+
+func (e *LocalEmbedder) Model() string {
+	return LocalEmbeddingModel
+}
+
+func (e *LocalEmbedder) Dimensions() int {
+	return e.dimensions
+}
+
+func (e *LocalEmbedder) Embed(ctx context.Context, texts []string, userID int) ([]Embedding, error) {
+	embeddings := make([]Embedding, len(texts))
+	for i, text := range texts {
+		embeddings[i] = e.embed(text)
+	}
+	return embeddings, nil
+}
+
+func (e *LocalEmbedder) embed(text string) Embedding {
+	termCounts := make(map[string]int)
+	tokens := localTokens(text)
+	for i, token := range tokens {
+		termCounts[token]++
+		if i > 0 {
+			termCounts[tokens[i-1]+" "+token]++
+		}
+	}
+
+	vector := make(Embedding, e.dimensions)
+	for term, count := range termCounts {
+		weight := 1 + math.Log(float64(count))
+		if strings.Contains(term, " ") {
+			weight *= 0.5
+		}
+		h := fnv.New64a()
+		h.Write([]byte(term))
+		sum := h.Sum64()
+		index := int(sum % uint64(e.dimensions))
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vector[index] += weight
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	if norm == 0 {
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
+
+func localTokens(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if len(word) < 2 || localStopWords[word] {
+			continue
+		}
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
@@ -0,0 +1,332 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a versioned change to the database schema. Migrations are
+// applied in order of version, each in its own transaction, and recorded in
+// the schema_migrations table. New migrations are appended to migrations;
+// applied migrations must never be edited.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *DB) error
+}
+
+var migrations = []migration{
+	{1, "baseline schema", migrateBaseline},
+	{2, "add document metadata", func(tx *DB) error {
+		return addColumnIfMissing(tx, "documents", "metadata", "TEXT NOT NULL DEFAULT '{}'")
+	}},
+	{3, "add chunk heading paths and ordinals", func(tx *DB) error {
+		err := addColumnIfMissing(tx, "chunks", "heading_path", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "chunks", "ordinal", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{4, "add conversations", func(tx *DB) error {
+		_, err := tx.conn.Exec(`
+			CREATE TABLE conversations (
+				id TEXT PRIMARY KEY,
+				created_at TEXT NOT NULL,
+				updated_at TEXT NOT NULL
+			);
+			CREATE INDEX conversations_updated_at ON conversations (updated_at);
+			CREATE TABLE conversation_turns (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				conversation_id TEXT NOT NULL,
+				query TEXT NOT NULL,
+				response TEXT NOT NULL,
+				chunk_ids TEXT NOT NULL DEFAULT '[]',
+				created_at TEXT NOT NULL,
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+			);
+			CREATE INDEX conversation_turns_conversation_id ON conversation_turns (conversation_id);
+		`)
+		return err
+	}},
+	{5, "add rewritten queries to conversation turns", func(tx *DB) error {
+		return addColumnIfMissing(tx, "conversation_turns", "rewritten_query", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{6, "add document sections", func(tx *DB) error {
+		err := addColumnIfMissing(tx, "documents", "section", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		_, err = tx.conn.Exec(`CREATE INDEX IF NOT EXISTS documents_section ON documents (section)`)
+		return err
+	}},
+	{7, "backfill chunk ordinals", migrateChunkOrdinals},
+	{8, "add embedding cache", func(tx *DB) error {
+		_, err := tx.conn.Exec(`
+			CREATE TABLE embedding_cache (
+				hash BLOB NOT NULL,
+				model TEXT NOT NULL,
+				dimensions INTEGER NOT NULL,
+				embedding BLOB NOT NULL,
+				created_at TEXT NOT NULL,
+				PRIMARY KEY (hash, model, dimensions)
+			);
+		`)
+		return err
+	}},
+	{9, "record embedding models", migrateVectorTables},
+}
+
+// MigrationState describes a migration and whether it has been applied.
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt string
+}
+
+func (s MigrationState) Applied() bool {
+	return s.AppliedAt != ""
+}
+
+// migrateBaseline creates the schema as it was before migrations were
+// introduced. Databases created by that schema are recognised as being at
+// this version.
+func migrateBaseline(tx *DB) error {
+	_, err := tx.conn.Exec(`
+		CREATE TABLE IF NOT EXISTS documents (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT,
+			content TEXT NOT NULL,
+			author TEXT,
+			publication_date TEXT,
+			url TEXT,
+			file_path TEXT,
+			hash BLOB
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create documents table: %w", err)
+	}
+
+	_, err = tx.conn.Exec(`
+		CREATE TABLE IF NOT EXISTS chunks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document_id INTEGER NOT NULL,
+			content TEXT NOT NULL,
+			hash BLOB NOT NULL,
+			FOREIGN KEY (document_id) REFERENCES documents(id)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create chunks table: %w", err)
+	}
+
+	_, err = tx.conn.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS vec_chunks
+		USING vec0(
+			id INTEGER PRIMARY KEY,
+			embedding FLOAT[1536]
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create vec_chunks table: %w", err)
+	}
+
+	return nil
+}
+
+// migrateChunkOrdinals numbers the chunks of documents embedded before chunks
+// stored their ordinals, which were all given ordinal 0. Chunks were inserted
+// in document order, so they are numbered by ID, except for a chunk holding the
+// whole document, which is given DocumentChunkOrdinal.
+func migrateChunkOrdinals(tx *DB) error {
+	_, err := tx.conn.Exec(`
+		CREATE INDEX IF NOT EXISTS chunks_document_ordinal ON chunks (document_id, ordinal);
+		UPDATE chunks SET ordinal = ?
+		WHERE content = (SELECT content FROM documents WHERE documents.id = chunks.document_id)
+		AND document_id IN (
+			SELECT document_id FROM chunks GROUP BY document_id
+			HAVING COUNT(*) > 1 AND MIN(ordinal) = 0 AND MAX(ordinal) = 0
+		);
+	`, DocumentChunkOrdinal)
+	if err != nil {
+		return fmt.Errorf("failed to mark whole-document chunks: %w", err)
+	}
+
+	rows, err := tx.conn.Query(`
+		SELECT id FROM chunks
+		WHERE ordinal = 0
+		AND document_id IN (
+			SELECT document_id FROM chunks WHERE ordinal = 0
+			GROUP BY document_id HAVING COUNT(*) > 1
+		)
+		ORDER BY document_id, id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to find unnumbered chunks: %w", err)
+	}
+	var unnumbered []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		unnumbered = append(unnumbered, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find unnumbered chunks: %w", err)
+	}
+
+	for _, id := range unnumbered {
+		_, err := tx.conn.Exec(`
+			UPDATE chunks SET ordinal = (
+				SELECT COUNT(*) FROM chunks AS earlier
+				WHERE earlier.document_id = chunks.document_id
+				AND earlier.ordinal != ?
+				AND earlier.id < chunks.id
+			)
+			WHERE id = ?
+		`, DocumentChunkOrdinal, id)
+		if err != nil {
+			return fmt.Errorf("failed to number chunk %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Migrate applies any pending migrations. A database that predates the
+// schema_migrations table but already has a documents table is treated as
+// being at the baseline version.
+func Migrate(db *DB) error {
+	if err := initMigrations(db); err != nil {
+		return err
+	}
+
+	states, err := MigrationStatus(db)
+	if err != nil {
+		return err
+	}
+	for i, state := range states {
+		if state.Applied() {
+			continue
+		}
+		m := migrations[i]
+		err := WithTx(db, func(tx *DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return recordMigration(tx, m)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// MigrationStatus lists every known migration and when it was applied.
+func MigrationStatus(db *DB) ([]MigrationState, error) {
+	applied := map[int]string{}
+	exists, err := tableExists(db, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := db.conn.Query(`SELECT version, applied_at FROM schema_migrations`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var appliedAt string
+			if err := rows.Scan(&version, &appliedAt); err != nil {
+				return nil, fmt.Errorf("failed to scan migration: %w", err)
+			}
+			applied[version] = appliedAt
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{Version: m.version, Name: m.name, AppliedAt: applied[m.version]}
+	}
+	return states, nil
+}
+
+func initMigrations(db *DB) error {
+	exists, err := tableExists(db, "schema_migrations")
+	if err != nil || exists {
+		return err
+	}
+
+	return WithTx(db, func(tx *DB) error {
+		_, err := tx.conn.Exec(`
+			CREATE TABLE schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				applied_at TEXT NOT NULL
+			);
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to create schema_migrations table: %w", err)
+		}
+
+		hasDocuments, err := tableExists(tx, "documents")
+		if err != nil || !hasDocuments {
+			return err
+		}
+		log.Println("Recording existing database as the baseline schema")
+		return recordMigration(tx, migrations[0])
+	})
+}
+
+func recordMigration(tx *DB, m migration) error {
+	_, err := tx.conn.Exec(`
+		INSERT INTO schema_migrations (version, name, applied_at)
+		VALUES (?, ?, ?)
+	`, m.version, m.name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+	}
+	return nil
+}
+
+func tableExists(db *DB, table string) (bool, error) {
+	var count int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?
+	`, table).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for %s table: %w", table, err)
+	}
+	return count > 0, nil
+}
+
+// addColumnIfMissing adds a column to a table created before the column
+// existed. Databases created before migrations were introduced may already
+// have the column.
+func addColumnIfMissing(db *DB, table string, column string, definition string) error {
+	var count int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?
+	`, table, column).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add %s column to %s table: %w", column, table, err)
+	}
+	return nil
+}
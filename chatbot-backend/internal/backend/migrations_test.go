@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer Close(db)
+
+	states, err := MigrationStatus(db)
+	if err != nil {
+		t.Fatalf("Failed to get migration status: %v", err)
+	}
+	if len(states) != len(migrations) {
+		t.Fatalf("Expected %d migrations, got %d", len(migrations), len(states))
+	}
+	for _, state := range states {
+		if !state.Applied() {
+			t.Errorf("Expected migration %d to be applied", state.Version)
+		}
+	}
+
+	// Migrating again is a no-op
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Failed to re-run migrations: %v", err)
+	}
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.sqlite")
+
+	// Create a database as Init did before migrations were introduced
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := migrateBaseline(db); err != nil {
+		t.Fatalf("Failed to create baseline schema: %v", err)
+	}
+	_, err = db.conn.Exec(`
+		INSERT INTO documents (title, content, author, publication_date, url, file_path, hash)
+		VALUES ('Old', 'Old content.', '', '', '', '/content/old.md', X'00')
+	`)
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	states, err := MigrationStatus(db)
+	if err != nil {
+		t.Fatalf("Failed to get migration status: %v", err)
+	}
+	for _, state := range states {
+		if state.Applied() {
+			t.Errorf("Expected migration %d to be pending before migrating", state.Version)
+		}
+	}
+	Close(db)
+
+	db, err = GetDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	defer Close(db)
+
+	states, err = MigrationStatus(db)
+	if err != nil {
+		t.Fatalf("Failed to get migration status: %v", err)
+	}
+	for _, state := range states {
+		if !state.Applied() {
+			t.Errorf("Expected migration %d to be applied", state.Version)
+		}
+	}
+
+	docs, err := GetAllDocuments(db)
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	if len(docs) != 1 || docs[0].Title != "Old" || docs[0].Metadata == nil {
+		t.Errorf("Expected the existing document with empty metadata, got %+v", docs)
+	}
+
+	chunk := Chunk{DocumentID: docs[0].ID, Content: "Old content.", Hash: MakeHash("Old content."), HeadingPath: "Old", Ordinal: 2}
+	if err := InsertChunk(db, &chunk); err != nil {
+		t.Fatalf("Failed to insert chunk into migrated table: %v", err)
+	}
+	chunks, err := GetDocumentChunks(db, docs[0].ID)
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].HeadingPath != "Old" || chunks[0].Ordinal != 2 {
+		t.Errorf("Expected the new chunk columns to be stored, got %+v", chunks)
+	}
+}
+
+func TestMigrateChunkOrdinals(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer Close(db)
+
+	// Chunks as stored before ordinals, all at ordinal 0
+	legacy := Document{Content: "First.\n\nSecond.\n\nThird."}
+	current := Document{Content: "Only."}
+	for _, doc := range []*Document{&legacy, &current} {
+		if err := InsertDocument(db, doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+	for _, content := range []string{"First.", "Second.", "Third.", legacy.Content} {
+		chunk := Chunk{DocumentID: legacy.ID, Content: content, Hash: MakeHash(content)}
+		if err := InsertChunk(db, &chunk); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+	}
+	only := Chunk{DocumentID: current.ID, Content: "Only.", Hash: MakeHash("Only.")}
+	if err := InsertChunk(db, &only); err != nil {
+		t.Fatalf("Failed to insert chunk: %v", err)
+	}
+
+	if err := WithTx(db, migrateChunkOrdinals); err != nil {
+		t.Fatalf("Failed to migrate chunk ordinals: %v", err)
+	}
+
+	chunks, err := GetDocumentChunks(db, legacy.ID)
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %v", err)
+	}
+	expected := map[string]int{"First.": 0, "Second.": 1, "Third.": 2, legacy.Content: DocumentChunkOrdinal}
+	for _, chunk := range chunks {
+		if chunk.Ordinal != expected[chunk.Content] {
+			t.Errorf("Expected %q to have ordinal %d, got %d", chunk.Content, expected[chunk.Content], chunk.Ordinal)
+		}
+	}
+
+	chunks, err = GetDocumentChunks(db, current.ID)
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Ordinal != 0 {
+		t.Errorf("Expected a single chunk to keep ordinal 0, got %+v", chunks)
+	}
+}
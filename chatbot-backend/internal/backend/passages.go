@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// passageRange is a run of consecutive chunks of a document, built around the
+// search hits it contains.
+type passageRange struct {
+	documentID int
+	from       int
+	to         int
+	hits       []Chunk
+}
+
+func (r *passageRange) overlaps(other *passageRange) bool {
+	return r.documentID == other.documentID && r.from >= 0 && other.from >= 0 &&
+		other.from <= r.to+1 && other.to >= r.from-1
+}
+
+func (r *passageRange) merge(other *passageRange) {
+	r.from = min(r.from, other.from)
+	r.to = max(r.to, other.to)
+	r.hits = append(r.hits, other.hits...)
+}
+
+// ExpandChunks turns search hits into passages for the LLM. Each hit is
+// widened with up to window chunks either side of it in its document, and
+// hits whose windows overlap or touch are merged into one passage, so the
+// LLM sees the text around a hit rather than an isolated paragraph. A window
+// of zero only merges adjacent hits. Whole-document chunks are never
+// expanded.
+//
+// Passages are returned as chunks in the order of their best hit, taking the
+// ID, Score and Distance of that hit. They are added in that order while
+// their estimated tokens fit in maxTokens; a passage that does not fit is
+// replaced by its hits alone if those fit. The first passage is always
+// returned. A maxTokens of zero or less sets no budget.
+func ExpandChunks(ctx context.Context, db *DB, hits []Chunk, window int, maxTokens int) ([]Chunk, error) {
+	ranges := []*passageRange{}
+	for _, hit := range hits {
+		r := &passageRange{documentID: hit.DocumentID, from: hit.Ordinal, to: hit.Ordinal, hits: []Chunk{hit}}
+		if hit.Ordinal >= 0 && window > 0 {
+			r.from = max(0, hit.Ordinal-window)
+			r.to = hit.Ordinal + window
+		}
+		ranges = mergeRange(ranges, r)
+	}
+
+	passages := []Chunk{}
+	tokens := 0
+	for _, r := range ranges {
+		passage, err := expandRange(ctx, db, r, window)
+		if err != nil {
+			return nil, err
+		}
+		passageTokens := EstimateTokens(passage.Content)
+		if maxTokens > 0 && len(passages) > 0 && tokens+passageTokens > maxTokens {
+			passage = hitsPassage(r)
+			passageTokens = EstimateTokens(passage.Content)
+			if tokens+passageTokens > maxTokens {
+				continue
+			}
+		}
+		passages = append(passages, passage)
+		tokens += passageTokens
+	}
+	return passages, nil
+}
+
+// mergeRange adds r to ranges, merging it with every range it overlaps. The
+// merged range keeps the position of the earliest, and so best ranked, of
+// them.
+func mergeRange(ranges []*passageRange, r *passageRange) []*passageRange {
+	var target *passageRange
+	kept := ranges[:0]
+	for _, existing := range ranges {
+		switch {
+		case target == nil && existing.overlaps(r):
+			existing.merge(r)
+			target = existing
+			kept = append(kept, existing)
+		case target != nil && target.overlaps(existing):
+			target.merge(existing)
+		default:
+			kept = append(kept, existing)
+		}
+	}
+	if target == nil {
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// expandRange reads the chunks in r from the database and joins them into a
+// passage.
+func expandRange(ctx context.Context, db *DB, r *passageRange, window int) (Chunk, error) {
+	if r.from < 0 || (window <= 0 && len(r.hits) == 1) {
+		return hitsPassage(r), nil
+	}
+	chunks, err := GetChunksByOrdinal(ctx, db, r.documentID, r.from, r.to)
+	if err != nil {
+		return Chunk{}, err
+	}
+	if len(chunks) == 0 {
+		return hitsPassage(r), nil
+	}
+	return joinPassage(r.hits, chunks), nil
+}
+
+// hitsPassage joins only the hits in r, in document order.
+func hitsPassage(r *passageRange) Chunk {
+	chunks := append([]Chunk{}, r.hits...)
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Ordinal < chunks[j].Ordinal
+	})
+	return joinPassage(r.hits, chunks)
+}
+
+func joinPassage(hits []Chunk, chunks []Chunk) Chunk {
+	best := hits[0]
+	contents := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		contents[i] = chunk.Content
+	}
+	return Chunk{
+		ID:          best.ID,
+		DocumentID:  best.DocumentID,
+		Content:     strings.Join(contents, "\n\n"),
+		HeadingPath: chunks[0].HeadingPath,
+		Ordinal:     chunks[0].Ordinal,
+		Distance:    best.Distance,
+		Score:       best.Score,
+	}
+}
@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandChunks(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	paragraphs := []string{"Zero.", "One.", "Two.", "Three.", "Four.", "Five.", "Six."}
+	doc := Document{Content: strings.Join(paragraphs, "\n\n")}
+	if err := InsertDocument(db, &doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	byOrdinal := map[int]Chunk{}
+	for _, chunk := range (&ParagraphChunker{}).Chunk(&doc) {
+		if err := InsertChunk(db, &chunk); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+		byOrdinal[chunk.Ordinal] = chunk
+	}
+	hit := func(ordinal int, score float64) Chunk {
+		chunk := byOrdinal[ordinal]
+		chunk.Score = score
+		return chunk
+	}
+	contents := func(passages []Chunk) []string {
+		result := make([]string, len(passages))
+		for i, passage := range passages {
+			result[i] = passage.Content
+		}
+		return result
+	}
+
+	tests := []struct {
+		name      string
+		hits      []Chunk
+		window    int
+		maxTokens int
+		expected  []string
+	}{
+		{"no window", []Chunk{hit(1, 0.9), hit(4, 0.8)}, 0, 0, []string{"One.", "Four."}},
+		{"adjacent hits merge", []Chunk{hit(4, 0.9), hit(3, 0.8)}, 0, 0, []string{"Three.\n\nFour."}},
+		{"window", []Chunk{hit(5, 0.9)}, 1, 0, []string{"Four.\n\nFive.\n\nSix."}},
+		{"window at start", []Chunk{hit(0, 0.9)}, 2, 0, []string{"Zero.\n\nOne.\n\nTwo."}},
+		{"overlapping windows", []Chunk{hit(4, 0.9), hit(1, 0.8)}, 1, 0, []string{"Zero.\n\nOne.\n\nTwo.\n\nThree.\n\nFour.\n\nFive."}},
+		{"separate windows", []Chunk{hit(6, 0.9), hit(1, 0.8)}, 1, 0, []string{"Five.\n\nSix.", "Zero.\n\nOne.\n\nTwo."}},
+		{"bridged windows", []Chunk{hit(0, 0.9), hit(6, 0.8), hit(3, 0.7)}, 1, 0, []string{strings.Join(paragraphs, "\n\n")}},
+		{"whole document", []Chunk{hit(DocumentChunkOrdinal, 0.9), hit(2, 0.8)}, 1, 0, []string{doc.Content, "One.\n\nTwo.\n\nThree."}},
+		{"budget falls back to hits", []Chunk{hit(1, 0.9), hit(5, 0.8)}, 1, 7, []string{"Zero.\n\nOne.\n\nTwo.", "Five."}},
+		{"first passage always kept", []Chunk{hit(1, 0.9), hit(5, 0.8)}, 1, 1, []string{"Zero.\n\nOne.\n\nTwo."}},
+	}
+	for _, test := range tests {
+		passages, err := ExpandChunks(context.Background(), db, test.hits, test.window, test.maxTokens)
+		if err != nil {
+			t.Errorf("%s: ExpandChunks failed: %v", test.name, err)
+			continue
+		}
+		got := contents(passages)
+		if strings.Join(got, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+			continue
+		}
+		if passages[0].ID != test.hits[0].ID || passages[0].Score != test.hits[0].Score {
+			t.Errorf("%s: expected the first passage to take the best hit's ID and score, got %+v", test.name, passages[0])
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ExpandChunks(ctx, db, []Chunk{hit(1, 0.9)}, 1, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled context to stop expansion, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// reembedSwapAttempts is the number of times Reembed tries to swap in the new
+// vector table before giving up on chunks being added faster than they are
+// embedded.
+const reembedSwapAttempts = 5
+
+// Reembed embeds every chunk with embedder into a new vector table and then
+// makes it the active table, dropping the old one. The new table is filled
+// in batches of batchSize chunks, each in its own transaction, so a server
+// using the database keeps searching the old table until the swap, which is a
+// single transaction. Chunks added or removed while the table is built are
+// caught up before the swap. An interrupted Reembed with the same model and
+// dimensions resumes where it stopped; tables left by one with another model
+// are dropped. progress, if not nil, is called after each batch.
+func Reembed(ctx context.Context, db *DB, embedder Embedder, user *User, batchSize int, progress func(done int, total int)) (VectorTable, error) {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	active, err := ActiveVectorTable(db)
+	if err != nil {
+		return VectorTable{}, err
+	}
+	if matchesEmbedder(active, embedder) {
+		return VectorTable{}, fmt.Errorf("the database already holds embeddings from %s", active)
+	}
+
+	table, err := prepareVectorTable(db, embedder)
+	if err != nil {
+		return VectorTable{}, err
+	}
+	for range reembedSwapAttempts {
+		if err := fillVectorTable(ctx, db, table, embedder, user, batchSize, progress); err != nil {
+			return VectorTable{}, err
+		}
+		swapped, err := swapVectorTable(db, table)
+		if err != nil {
+			return VectorTable{}, err
+		}
+		if swapped {
+			table.Active = true
+			return table, nil
+		}
+	}
+	return VectorTable{}, fmt.Errorf("chunks kept changing while %s was built; run reembed again to resume", table.Name)
+}
+
+// prepareVectorTable returns an inactive vector table for embedder, reusing
+// one left by an interrupted Reembed or creating a new one.
+func prepareVectorTable(db *DB, embedder Embedder) (VectorTable, error) {
+	tables, err := GetVectorTables(db)
+	if err != nil {
+		return VectorTable{}, err
+	}
+	var resumed *VectorTable
+	for _, table := range tables {
+		if table.Active {
+			continue
+		}
+		if resumed == nil && matchesEmbedder(table, embedder) {
+			log.Printf("Resuming %s", table.Name)
+			resumed = &table
+			continue
+		}
+		err := WithTx(db, func(tx *DB) error {
+			return dropVectorTable(tx, table.Name)
+		})
+		if err != nil {
+			return VectorTable{}, err
+		}
+	}
+	if resumed != nil {
+		return *resumed, nil
+	}
+
+	table := VectorTable{
+		Name:       fmt.Sprintf("vec_chunks_%d", time.Now().UnixNano()),
+		Model:      embedder.Model(),
+		Dimensions: embedder.Dimensions(),
+		CreatedAt:  time.Now().UTC(),
+	}
+	err = WithTx(db, func(tx *DB) error {
+		if err := createVectorTable(tx, table.Name, table.Dimensions); err != nil {
+			return err
+		}
+		_, err := tx.conn.Exec(`
+			INSERT INTO vector_tables (name, model, dimensions, active, created_at)
+			VALUES (?, ?, ?, 0, ?)
+		`, table.Name, table.Model, table.Dimensions, formatTimestamp(table.CreatedAt))
+		if err != nil {
+			return fmt.Errorf("failed to record vector table: %w", err)
+		}
+		return nil
+	})
+	return table, err
+}
+
+// fillVectorTable embeds the chunks that have no embedding in table.
+func fillVectorTable(ctx context.Context, db *DB, table VectorTable, embedder Embedder, user *User, batchSize int, progress func(done int, total int)) error {
+	var total int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM chunks WHERE id NOT IN (SELECT id FROM ` + table.Name + `)
+	`).Scan(&total)
+	if err != nil {
+		return fmt.Errorf("failed to count chunks to embed: %w", err)
+	}
+
+	done := 0
+	for {
+		ids, contents, err := unembeddedChunks(ctx, db, table, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		embeddings, err := CreateEmbeddings(ctx, embedder, contents, user.ID)
+		if err != nil {
+			return err
+		}
+		if len(embeddings) != len(ids) {
+			return fmt.Errorf("expected %d embeddings, got %d", len(ids), len(embeddings))
+		}
+		err = WithTx(db, func(tx *DB) error {
+			for i, id := range ids {
+				serialized, err := serializeEmbedding(embeddings[i])
+				if err != nil {
+					return err
+				}
+				_, err = tx.conn.Exec(`INSERT INTO `+table.Name+` (id, embedding) VALUES (?, ?)`, id, serialized)
+				if err != nil {
+					return fmt.Errorf("failed to insert embedding of chunk %d: %w", id, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		done += len(ids)
+		if progress != nil {
+			progress(done, max(total, done))
+		}
+	}
+}
+
+func unembeddedChunks(ctx context.Context, db *DB, table VectorTable, limit int) ([]int, []string, error) {
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT id, content FROM chunks
+		WHERE id NOT IN (SELECT id FROM `+table.Name+`)
+		ORDER BY id
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get chunks to embed: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	var contents []string
+	for rows.Next() {
+		var id int
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		ids = append(ids, id)
+		contents = append(contents, content)
+	}
+	return ids, contents, rows.Err()
+}
+
+// swapVectorTable makes table the active vector table and drops the old one,
+// unless chunks were added since it was filled, in which case it returns
+// false and changes nothing.
+func swapVectorTable(db *DB, table VectorTable) (bool, error) {
+	swapped := false
+	err := WithTx(db, func(tx *DB) error {
+		var missing int
+		err := tx.conn.QueryRow(`
+			SELECT COUNT(*) FROM chunks WHERE id NOT IN (SELECT id FROM ` + table.Name + `)
+		`).Scan(&missing)
+		if err != nil {
+			return fmt.Errorf("failed to count chunks to embed: %w", err)
+		}
+		if missing > 0 {
+			return nil
+		}
+
+		// Chunks deleted while the table was built
+		_, err = tx.conn.Exec(`DELETE FROM ` + table.Name + ` WHERE id NOT IN (SELECT id FROM chunks)`)
+		if err != nil {
+			return fmt.Errorf("failed to delete embeddings of removed chunks: %w", err)
+		}
+
+		old, err := ActiveVectorTable(tx)
+		if err != nil {
+			return err
+		}
+		if err := dropVectorTable(tx, old.Name); err != nil {
+			return err
+		}
+		_, err = tx.conn.Exec(`UPDATE vector_tables SET active = 1 WHERE name = ?`, table.Name)
+		if err != nil {
+			return fmt.Errorf("failed to activate %s: %w", table.Name, err)
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+func dropVectorTable(tx *DB, name string) error {
+	if _, err := tx.conn.Exec(`DROP TABLE IF EXISTS ` + name); err != nil {
+		return fmt.Errorf("failed to drop %s: %w", name, err)
+	}
+	if _, err := tx.conn.Exec(`DELETE FROM vector_tables WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("failed to remove %s from vector tables: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	RerankerNone    = "none"
+	RerankerKeyword = "keyword"
+	RerankerLLM     = "llm"
+)
+
+// Reranker reorders search candidates by their relevance to query and returns
+// the best limit of them. Rerankers only reorder chunks; their Distance and
+// Score are left as retrieved.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, candidates []Chunk, limit int) ([]Chunk, error)
+}
+
+// NewReranker creates the Reranker called name. An empty name is the same as
+// RerankerNone. The keyword reranker reads document titles from db and the
+// LLM reranker grades candidates with llm.
+func NewReranker(name string, db *DB, llm LLMProvider) (Reranker, error) {
+	switch name {
+	case "", RerankerNone:
+		return NoopReranker{}, nil
+	case RerankerKeyword:
+		return NewKeywordReranker(db), nil
+	case RerankerLLM:
+		return NewLLMReranker(llm), nil
+	default:
+		return nil, fmt.Errorf("unknown reranker: %s", name)
+	}
+}
+
+// NoopReranker keeps the candidates in the order they were retrieved.
+type NoopReranker struct{}
+
+func (NoopReranker) Rerank(ctx context.Context, query string, candidates []Chunk, limit int) ([]Chunk, error) {
+	return truncateChunks(candidates, limit), nil
+}
+
+// KeywordReranker is a Reranker that needs no network access. It ranks
+// candidates by the fraction of the query's words that appear in them, with a
+// bonus for words that appear in the title of their document. Candidates that
+// score the same keep their retrieved order.
+type KeywordReranker struct {
+	db          *DB
+	titleWeight float64
+}
+
+func NewKeywordReranker(db *DB) *KeywordReranker {
+	return &KeywordReranker{db: db, titleWeight: 0.5}
+}
+
+func (r *KeywordReranker) Rerank(ctx context.Context, query string, candidates []Chunk, limit int) ([]Chunk, error) {
+	queryTerms := termSet(query)
+	if len(queryTerms) == 0 {
+		return truncateChunks(candidates, limit), nil
+	}
+
+	docs, err := DocumentsFromChunks(ctx, candidates, r.db)
+	if err != nil {
+		return nil, err
+	}
+	titles := make(map[int]map[string]bool, len(docs))
+	for _, doc := range docs {
+		titles[doc.ID] = termSet(doc.Title)
+	}
+
+	scores := make([]float64, len(candidates))
+	for i, chunk := range candidates {
+		scores[i] = termOverlap(queryTerms, termSet(chunk.HeadingPath+" "+chunk.Content)) +
+			r.titleWeight*termOverlap(queryTerms, titles[chunk.DocumentID])
+	}
+	return sortByScores(candidates, scores, limit), nil
+}
+
+func termSet(text string) map[string]bool {
+	terms := map[string]bool{}
+	for _, token := range localTokens(text) {
+		terms[token] = true
+	}
+	return terms
+}
+
+// termOverlap returns the fraction of queryTerms found in terms.
+func termOverlap(queryTerms map[string]bool, terms map[string]bool) float64 {
+	found := 0
+	for term := range queryTerms {
+		if terms[term] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(queryTerms))
+}
+
+//go:embed rerank_prompt.md
+var rerankPrompt string
+
+// LLMReranker is a Reranker that asks an LLM to grade every candidate in a
+// single request. Candidates the LLM does not grade are ranked after those it
+// does, in their retrieved order.
+type LLMReranker struct {
+	llm LLMProvider
+}
+
+func NewLLMReranker(llm LLMProvider) *LLMReranker {
+	return &LLMReranker{llm: llm}
+}
+
+// rerankGradePattern matches a line of the LLM's grades, such as "3: 7" or
+// "Passage 3: 7".
+var rerankGradePattern = regexp.MustCompile(`(?i)^\W*(?:passage\s*)?(\d+)\W*?[:=\-]\s*(\d+(?:\.\d+)?)`)
+
+func (r *LLMReranker) Rerank(ctx context.Context, query string, candidates []Chunk, limit int) ([]Chunk, error) {
+	if len(candidates) <= 1 {
+		return truncateChunks(candidates, limit), nil
+	}
+
+	var passages strings.Builder
+	for i, chunk := range candidates {
+		fmt.Fprintf(&passages, "\n\nPassage %d:\n%s", i+1, chunk.Content)
+	}
+	response, err := r.llm.Complete(ctx, []Message{
+		{Role: RoleSystem, Content: rerankPrompt},
+		{Role: RoleUser, Content: "Question: " + query + passages.String()},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to grade candidates: %w", err)
+	}
+
+	scores := make([]float64, len(candidates))
+	for i := range scores {
+		scores[i] = -1
+	}
+	for _, line := range strings.Split(response, "\n") {
+		match := rerankGradePattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		passage, err := strconv.Atoi(match[1])
+		if err != nil || passage < 1 || passage > len(candidates) {
+			continue
+		}
+		grade, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			continue
+		}
+		scores[passage-1] = grade
+	}
+	return sortByScores(candidates, scores, limit), nil
+}
+
+// sortByScores returns the limit chunks with the highest scores, keeping the
+// order of chunks with equal scores.
+func sortByScores(chunks []Chunk, scores []float64, limit int) []Chunk {
+	order := make([]int, len(chunks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+
+	sorted := make([]Chunk, len(chunks))
+	for i, index := range order {
+		sorted[i] = chunks[index]
+	}
+	return truncateChunks(sorted, limit)
+}
+
+// truncateChunks returns at most limit chunks. A limit of zero or less keeps
+// every chunk.
+func truncateChunks(chunks []Chunk, limit int) []Chunk {
+	if limit > 0 && len(chunks) > limit {
+		return chunks[:limit]
+	}
+	return chunks
+}
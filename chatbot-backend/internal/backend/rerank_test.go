@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func chunkIDs(chunks []Chunk) []int {
+	ids := make([]int, len(chunks))
+	for i, chunk := range chunks {
+		ids[i] = chunk.ID
+	}
+	return ids
+}
+
+func TestNoopReranker(t *testing.T) {
+	candidates := []Chunk{{ID: 1}, {ID: 2}, {ID: 3}}
+	reranked, err := NoopReranker{}.Rerank(context.Background(), "query", candidates, 2)
+	if err != nil {
+		t.Fatalf("Rerank failed: %v", err)
+	}
+	if ids := chunkIDs(reranked); !slices.Equal(ids, []int{1, 2}) {
+		t.Errorf("Expected the first two candidates, got %v", ids)
+	}
+}
+
+func TestKeywordReranker(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	about := Document{Title: "About", Content: "About us."}
+	pricing := Document{Title: "Consulting Rates", Content: "Rates."}
+	for _, doc := range []*Document{&about, &pricing} {
+		if err := InsertDocument(db, doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+	candidates := []Chunk{
+		{ID: 1, DocumentID: about.ID, Content: "We are based in Kingston."},
+		{ID: 2, DocumentID: about.ID, Content: "Our consulting work covers retrieval systems."},
+		{ID: 3, DocumentID: pricing.ID, Content: "Our consulting work is billed by the day."},
+	}
+
+	reranked, err := NewKeywordReranker(db).Rerank(context.Background(), "What are your consulting rates?", candidates, 2)
+	if err != nil {
+		t.Fatalf("Rerank failed: %v", err)
+	}
+	// Chunk 3 matches "consulting" in its content and both words in its title
+	if ids := chunkIDs(reranked); !slices.Equal(ids, []int{3, 2}) {
+		t.Errorf("Expected chunks [3 2], got %v", ids)
+	}
+}
+
+func TestLLMReranker(t *testing.T) {
+	llm := NewFakeLLMClient()
+	llm.Response = "1: 2\nPassage 2: 9\n3 - 5\nnot a grade"
+	candidates := []Chunk{
+		{ID: 1, Content: "First."},
+		{ID: 2, Content: "Second."},
+		{ID: 3, Content: "Third."},
+		{ID: 4, Content: "Fourth."},
+	}
+
+	reranked, err := NewLLMReranker(llm).Rerank(context.Background(), "Which one?", candidates, 0)
+	if err != nil {
+		t.Fatalf("Rerank failed: %v", err)
+	}
+	// The ungraded fourth candidate is ranked last
+	if ids := chunkIDs(reranked); !slices.Equal(ids, []int{2, 3, 1, 4}) {
+		t.Errorf("Expected chunks [2 3 1 4], got %v", ids)
+	}
+
+	if len(llm.Requests) != 1 {
+		t.Fatalf("Expected one LLM request, got %d", len(llm.Requests))
+	}
+	prompt := llm.Requests[0][len(llm.Requests[0])-1].Content
+	if !strings.Contains(prompt, "Which one?") || !strings.Contains(prompt, "Passage 4:\nFourth.") {
+		t.Errorf("Expected the query and numbered passages in the prompt, got %q", prompt)
+	}
+}
+
+func TestNewReranker(t *testing.T) {
+	for _, name := range []string{"", RerankerNone, RerankerKeyword, RerankerLLM} {
+		if _, err := NewReranker(name, nil, NewFakeLLMClient()); err != nil {
+			t.Errorf("Expected reranker %q to be created, got %v", name, err)
+		}
+	}
+	if _, err := NewReranker("cross-encoder", nil, nil); err == nil {
+		t.Error("Expected an error for an unknown reranker")
+	}
+}
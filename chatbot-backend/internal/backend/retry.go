@@ -0,0 +1,201 @@
+package backend
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// RetryPolicy decides how requests to the OpenAI API, or a server that
+// implements it, are retried when they fail with a rate limit, a server error
+// or a network error. Zero fields take their default values.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent, including the
+	// first. One disables retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles with each
+	// further retry, up to MaxDelay, and is jittered so that concurrent
+	// requests do not retry in lockstep.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts. A server asking, through
+	// Retry-After, for a longer wait than this is not retried.
+	MaxDelay time.Duration
+	// RetryCompletions allows chat completions to be retried as well as
+	// embeddings. A completion changes nothing on the server, but one that
+	// failed part way may still be billed, and a retry can give a different
+	// answer, so completions are only retried if this is set.
+	RetryCompletions bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+	}
+}
+
+// RetryPolicyFromEnv reads the retry policy from API_RETRY_MAX_ATTEMPTS,
+// API_RETRY_BASE_DELAY, API_RETRY_MAX_DELAY and API_RETRY_COMPLETIONS.
+func RetryPolicyFromEnv() RetryPolicy {
+	maxAttempts, _ := strconv.Atoi(os.Getenv("API_RETRY_MAX_ATTEMPTS"))
+	baseDelay, _ := time.ParseDuration(os.Getenv("API_RETRY_BASE_DELAY"))
+	maxDelay, _ := time.ParseDuration(os.Getenv("API_RETRY_MAX_DELAY"))
+	retryCompletions, _ := strconv.ParseBool(os.Getenv("API_RETRY_COMPLETIONS"))
+	return RetryPolicy{
+		MaxAttempts:      maxAttempts,
+		BaseDelay:        baseDelay,
+		MaxDelay:         maxDelay,
+		RetryCompletions: retryCompletions,
+	}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	defaults := DefaultRetryPolicy()
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaults.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaults.MaxDelay
+	}
+	return p
+}
+
+// Client returns an HTTP client that retries requests according to p.
+func (p RetryPolicy) Client() *http.Client {
+	return &http.Client{Transport: &retryTransport{policy: p.withDefaults(), base: http.DefaultTransport}}
+}
+
+// backoff returns the jittered delay before retry number retry, counting
+// from zero.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.MaxDelay
+	if retry < 30 {
+		delay = min(p.BaseDelay<<retry, p.MaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryTransport is an http.RoundTripper that retries idempotent requests that
+// fail with 408, 409, 429 or a 5xx status, or with a network error. Requests
+// are idempotent if their method is, or if they carry an Idempotency-Key
+// header, following net/http. A response is returned as soon as its status is
+// known, so a stream is never retried once it has started.
+type retryTransport struct {
+	policy RetryPolicy
+	base   http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := isIdempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 1; ; attempt++ {
+		res, err := t.base.RoundTrip(req)
+		if !retryable || attempt >= t.policy.MaxAttempts || req.Context().Err() != nil || !shouldRetry(res, err) {
+			return res, err
+		}
+
+		delay := t.policy.backoff(attempt - 1)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = res.Status
+			if retryAfter, ok := parseRetryAfter(res.Header); ok {
+				if retryAfter > t.policy.MaxDelay {
+					return res, nil
+				}
+				delay = retryAfter
+			}
+			// Drain the body so the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+			res.Body.Close()
+		}
+		log.Printf("Retrying %s %s in %v after attempt %d failed: %s", req.Method, req.URL.Path, delay, attempt, reason)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+func shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return res.StatusCode >= 500
+}
+
+// parseRetryAfter reads the delay a server asked for from the Retry-After-Ms
+// header sent by OpenAI, or the standard Retry-After header, given in seconds
+// or as a date.
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(date)), true
+	}
+	return 0, false
+}
+
+// newOpenAIClient creates an OpenAI client whose requests are retried
+// according to retry, in place of the client's own retries.
+func newOpenAIClient(retry RetryPolicy, opts ...option.RequestOption) *openai.Client {
+	opts = append(opts, option.WithHTTPClient(retry.Client()), option.WithMaxRetries(0))
+	return openai.NewClient(opts...)
+}
+
+// idempotent marks a request as safe to retry, with an Idempotency-Key that
+// each attempt shares. Embeddings change nothing on the server, so sending one
+// twice only costs tokens; chat completions are marked only if the
+// RetryPolicy's RetryCompletions is set.
+func idempotent() option.RequestOption {
+	key := make([]byte, 16)
+	crand.Read(key)
+	return option.WithHeader("Idempotency-Key", hex.EncodeToString(key))
+}
@@ -0,0 +1,246 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/option"
+)
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond, RetryCompletions: true}
+
+// failingServer responds to the first len(failures) requests with the given
+// responses and to later requests with respond.
+type failingServer struct {
+	mu       sync.Mutex
+	failures []func(w http.ResponseWriter)
+	keys     []string
+}
+
+func (s *failingServer) start(t *testing.T, respond func(w http.ResponseWriter)) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		attempt := len(s.keys)
+		s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+		s.mu.Unlock()
+		if attempt < len(s.failures) {
+			s.failures[attempt](w)
+			return
+		}
+		respond(w)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *failingServer) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+func failWith(status int, headers ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Set(headers[i], headers[i+1])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error":{"message":"injected %d","type":"test"}}`, status)
+	}
+}
+
+func respondWithEmbedding(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"object":"list","model":"text-embedding-3-small","data":[{"object":"embedding","index":0,"embedding":[0.5,0.25]}],"usage":{"prompt_tokens":1,"total_tokens":1}}`)
+}
+
+func respondWithCompletion(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"id":"1","object":"chat.completion","created":0,"model":"test","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Recovered"}}]}`)
+}
+
+func TestCreateEmbeddingsRetries(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "test")
+	fake := &failingServer{failures: []func(http.ResponseWriter){
+		failWith(http.StatusTooManyRequests, "Retry-After", "0"),
+		failWith(http.StatusServiceUnavailable),
+	}}
+	server := fake.start(t, respondWithEmbedding)
+
+	client, err := newEmbeddingClient(EmbeddingConfig{Retry: testRetryPolicy}, option.WithBaseURL(server.URL+"/"))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	embeddings, err := CreateEmbeddings(context.Background(), client, []string{"Hello"}, 0)
+	if err != nil {
+		t.Fatalf("CreateEmbeddings failed: %v", err)
+	}
+	if len(embeddings) != 1 || len(embeddings[0]) != 2 {
+		t.Errorf("Unexpected embeddings: %v", embeddings)
+	}
+	if fake.attempts() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", fake.attempts())
+	}
+	for _, key := range fake.keys {
+		if key == "" || key != fake.keys[0] {
+			t.Errorf("Expected every attempt to send the same idempotency key, got %q", fake.keys)
+			break
+		}
+	}
+}
+
+func TestChatRetries(t *testing.T) {
+	fake := &failingServer{failures: []func(http.ResponseWriter){
+		failWith(http.StatusInternalServerError),
+		failWith(http.StatusTooManyRequests, "Retry-After-Ms", "1"),
+	}}
+	server := fake.start(t, respondWithCompletion)
+
+	llm, err := NewOpenAICompatibleLLMClient(server.URL, "", "test", "", testRetryPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	response, err := Chat(context.Background(), llm, ChatMessages(nil, "Hi"))
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if response != "Recovered" {
+		t.Errorf("Unexpected response: %q", response)
+	}
+	if fake.attempts() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", fake.attempts())
+	}
+}
+
+func TestChatNotRetriedByDefault(t *testing.T) {
+	fake := &failingServer{failures: []func(http.ResponseWriter){
+		failWith(http.StatusInternalServerError),
+	}}
+	server := fake.start(t, respondWithCompletion)
+
+	policy := testRetryPolicy
+	policy.RetryCompletions = false
+	llm, err := NewOpenAICompatibleLLMClient(server.URL, "", "test", "", policy)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := Chat(context.Background(), llm, ChatMessages(nil, "Hi")); err == nil {
+		t.Fatal("Expected Chat to fail")
+	}
+	if fake.attempts() != 1 || fake.keys[0] != "" {
+		t.Errorf("Expected 1 attempt without an idempotency key, got %q", fake.keys)
+	}
+}
+
+func TestChatGivesUpAfterMaxAttempts(t *testing.T) {
+	fake := &failingServer{}
+	server := fake.start(t, failWith(http.StatusBadGateway))
+
+	llm, err := NewOpenAICompatibleLLMClient(server.URL, "", "test", "", testRetryPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := Chat(context.Background(), llm, ChatMessages(nil, "Hi")); err == nil {
+		t.Fatal("Expected Chat to fail")
+	}
+	if fake.attempts() != testRetryPolicy.MaxAttempts {
+		t.Errorf("Expected %d attempts, got %d", testRetryPolicy.MaxAttempts, fake.attempts())
+	}
+}
+
+func TestRetryTransportDoesNotRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers []string
+		respond func(w http.ResponseWriter)
+	}{
+		{"client error", http.MethodGet, nil, failWith(http.StatusBadRequest)},
+		{"non-idempotent request", http.MethodPost, nil, failWith(http.StatusServiceUnavailable)},
+		{"long Retry-After", http.MethodGet, nil, failWith(http.StatusTooManyRequests, "Retry-After", "120")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &failingServer{}
+			server := fake.start(t, test.respond)
+
+			req, err := http.NewRequest(test.method, server.URL, strings.NewReader("{}"))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			res, err := testRetryPolicy.Client().Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			res.Body.Close()
+			if fake.attempts() != 1 {
+				t.Errorf("Expected 1 attempt, got %d", fake.attempts())
+			}
+		})
+	}
+}
+
+func TestRetryTransportStopsWhenCancelled(t *testing.T) {
+	fake := &failingServer{}
+	server := fake.start(t, failWith(http.StatusServiceUnavailable))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Minute}
+	start := time.Now()
+	_, err = policy.Client().Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the wait to stop with the context, took %v", elapsed)
+	}
+	if fake.attempts() != 1 {
+		t.Errorf("Expected 1 attempt, got %d", fake.attempts())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header   http.Header
+		expected time.Duration
+		ok       bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Retry-After": {"2"}}, 2 * time.Second, true},
+		{http.Header{"Retry-After": {"0.5"}}, 500 * time.Millisecond, true},
+		{http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"1"}}, 250 * time.Millisecond, true},
+		{http.Header{"Retry-After": {"Wed, 21 Oct 2015 07:28:00 GMT"}}, 0, true},
+		{http.Header{"Retry-After": {"soon"}}, 0, false},
+	}
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.header)
+		if delay != test.expected || ok != test.ok {
+			t.Errorf("parseRetryAfter(%v): expected %v, %v, got %v, %v", test.header, test.expected, test.ok, delay, ok)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for range 20 {
+			delay := policy.backoff(retry)
+			if delay < ceiling/2 || delay > ceiling {
+				t.Fatalf("Expected retry %d to wait between %v and %v, got %v", retry, ceiling/2, ceiling, delay)
+			}
+		}
+	}
+}
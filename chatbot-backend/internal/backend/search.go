@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go"
+)
+
+// SearchFilter restricts a search to the chunks of matching documents. A
+// document matches if it satisfies every field that is set: it is in one of
+// Sections, has one of Tags and one of Categories (compared case-insensitively),
+// was published on or between the days PublishedFrom and PublishedTo, and is
+// one of DocumentIDs. The zero SearchFilter matches every document.
+type SearchFilter struct {
+	Sections      []string
+	Tags          []string
+	Categories    []string
+	PublishedFrom time.Time
+	PublishedTo   time.Time
+	DocumentIDs   []int
+}
+
+func (f SearchFilter) IsEmpty() bool {
+	return len(f.Sections) == 0 && len(f.Tags) == 0 && len(f.Categories) == 0 &&
+		f.PublishedFrom.IsZero() && f.PublishedTo.IsZero() && len(f.DocumentIDs) == 0
+}
+
+// sqlConditions returns the filter as SQL conditions on the documents table,
+// joined with AND, and their arguments.
+func (f SearchFilter) sqlConditions() (string, []any) {
+	conditions := []string{}
+	args := []any{}
+
+	if len(f.Sections) > 0 {
+		conditions = append(conditions, "documents.section IN ("+placeholders(len(f.Sections))+")")
+		for _, section := range f.Sections {
+			args = append(args, section)
+		}
+	}
+	for _, taxonomy := range []struct {
+		key   string
+		terms []string
+	}{{"tags", f.Tags}, {"categories", f.Categories}} {
+		if len(taxonomy.terms) == 0 {
+			continue
+		}
+		// json_each also yields a single term given as a string
+		conditions = append(conditions, `EXISTS (
+			SELECT 1 FROM json_each(documents.metadata, '$.`+taxonomy.key+`')
+			WHERE lower(json_each.value) IN (`+placeholders(len(taxonomy.terms))+`)
+		)`)
+		for _, term := range taxonomy.terms {
+			args = append(args, strings.ToLower(term))
+		}
+	}
+	if !f.PublishedFrom.IsZero() {
+		conditions = append(conditions, "date(documents.publication_date) >= ?")
+		args = append(args, f.PublishedFrom.Format(time.DateOnly))
+	}
+	if !f.PublishedTo.IsZero() {
+		conditions = append(conditions, "date(documents.publication_date) <= ?")
+		args = append(args, f.PublishedTo.Format(time.DateOnly))
+	}
+	if len(f.DocumentIDs) > 0 {
+		conditions = append(conditions, "documents.id IN ("+placeholders(len(f.DocumentIDs))+")")
+		for _, id := range f.DocumentIDs {
+			args = append(args, id)
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "1", args
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// HybridSearchOptions controls how HybridSearch fuses keyword and vector
+// rankings. Candidates further than MaxDistance from the query embedding, or
+// keyword candidates without an embedding, are discarded as irrelevant; a
+// MaxDistance of zero keeps every candidate. Only chunks of documents matching
+// Filter are searched.
+//
+// The final Limit chunks are chosen from the fused candidates with maximal
+// marginal relevance, trading relevance against similarity to chunks already
+// chosen by MMRLambda (1 ranks by relevance alone), and with at most
+// MaxChunksPerDocument chunks from any document (0 sets no cap).
+type HybridSearchOptions struct {
+	Limit                int
+	CandidateLimit       int
+	KeywordWeight        float64
+	VectorWeight         float64
+	RRFConstant          float64
+	MaxDistance          float64
+	Filter               SearchFilter
+	MMRLambda            float64
+	MaxChunksPerDocument int
+}
+
+func DefaultHybridSearchOptions() HybridSearchOptions {
+	return HybridSearchOptions{
+		Limit:                5,
+		CandidateLimit:       20,
+		KeywordWeight:        1,
+		VectorWeight:         1,
+		RRFConstant:          60,
+		MMRLambda:            0.7,
+		MaxChunksPerDocument: 2,
+	}
+}
+
+// defaultMaxDistances are the distance cutoffs for the embedding models this
+// package supports. Relevant chunks of the site are typically within them of
+// a query, and chunks sharing no more than common words with it beyond them.
+// The embeddings are normalised, so these are the L2 distances for cosine
+// similarities of about 0.25 for the text-embedding-3 models and 0.8 for
+// text-embedding-ada-002, which gives every text a high similarity. The
+// LocalEmbedder's cutoff was measured on the test documents.
+var defaultMaxDistances = map[string]float64{
+	openai.EmbeddingModelTextEmbedding3Small: 1.2,
+	openai.EmbeddingModelTextEmbedding3Large: 1.2,
+	openai.EmbeddingModelTextEmbeddingAda002: 0.65,
+	LocalEmbeddingModel:                      1.3,
+}
+
+// DefaultMaxDistance returns the HybridSearchOptions.MaxDistance suited to
+// embeddings from model, or zero, disabling the cutoff, for a model without a
+// known cutoff.
+func DefaultMaxDistance(model string) float64 {
+	return defaultMaxDistances[model]
+}
+
+// HybridSearch retrieves candidates with both KeywordSearch and
+// SimilaritySearch and combines them with weighted reciprocal rank fusion, so
+// a chunk scores weight/(RRFConstant+rank) for each ranking it appears in.
+// Returned chunks carry their fused Score and their Distance from embedding.
+// No chunks are returned if none is within MaxDistance.
+func HybridSearch(ctx context.Context, db *DB, query string, embedding Embedding, options HybridSearchOptions) ([]Chunk, error) {
+	if options.VectorWeight <= 0 && options.KeywordWeight <= 0 {
+		return nil, fmt.Errorf("at least one of the keyword and vector weights must be positive")
+	}
+	if options.CandidateLimit < options.Limit {
+		options.CandidateLimit = options.Limit
+	}
+
+	var vectorChunks, keywordChunks []Chunk
+	var err error
+	if options.VectorWeight > 0 {
+		vectorChunks, err = FilteredSimilaritySearch(ctx, db, embedding, options.CandidateLimit, options.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.KeywordWeight > 0 {
+		keywordChunks, err = FilteredKeywordSearch(ctx, db, query, options.CandidateLimit, options.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(embedding) > 0 {
+		// Keyword matches are only relevant if they are also close to the
+		// query, since any shared word is a match. Those without an
+		// embedding cannot be shown to be close.
+		measured, err := setChunkDistances(ctx, db, embedding, keywordChunks)
+		if err != nil {
+			return nil, err
+		}
+		if options.MaxDistance > 0 {
+			vectorChunks = withinDistance(vectorChunks, options.MaxDistance)
+			keywordChunks = withinDistance(measured, options.MaxDistance)
+		}
+	}
+
+	vectorList := rankedList{vectorChunks, options.VectorWeight}
+	keywordList := rankedList{keywordChunks, options.KeywordWeight}
+	if !options.diversifying() {
+		return fuseRankings(options, vectorList, keywordList), nil
+	}
+
+	// Fuse every candidate and let diversify choose among them
+	fuseOptions := options
+	fuseOptions.Limit = len(vectorChunks) + len(keywordChunks)
+	return diversify(ctx, db, fuseRankings(fuseOptions, vectorList, keywordList), options)
+}
+
+func withinDistance(chunks []Chunk, maxDistance float64) []Chunk {
+	within := []Chunk{}
+	for _, chunk := range chunks {
+		if chunk.Distance <= maxDistance {
+			within = append(within, chunk)
+		}
+	}
+	return within
+}
+
+type rankedList struct {
+	chunks []Chunk
+	weight float64
+}
+
+func fuseRankings(options HybridSearchOptions, lists ...rankedList) []Chunk {
+	scores := make(map[int]float64)
+	chunksByID := make(map[int]Chunk)
+	order := []int{}
+	for _, list := range lists {
+		for rank, chunk := range list.chunks {
+			if _, seen := chunksByID[chunk.ID]; !seen {
+				chunksByID[chunk.ID] = chunk
+				order = append(order, chunk.ID)
+			}
+			scores[chunk.ID] += list.weight / (options.RRFConstant + float64(rank+1))
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	if len(order) > options.Limit {
+		order = order[:options.Limit]
+	}
+
+	fused := make([]Chunk, len(order))
+	for i, id := range order {
+		fused[i] = chunksByID[id]
+		fused[i].Score = scores[id]
+	}
+	return fused
+}
@@ -0,0 +1,282 @@
+package backend
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupSearchTestDB(t *testing.T) (*DB, Embedder) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() { Close(db) })
+
+	embedder := NewLocalEmbedder(0)
+	docs := []Document{
+		{Title: "About", Content: "Epistemic Technology is based in Kingston, New York."},
+		{Title: "Services", Content: "We build retrieval augmented generation systems for research teams."},
+		{Title: "Blog", Content: "Transformers changed natural language processing."},
+	}
+	for i := range docs {
+		if err := InsertDocument(db, &docs[i]); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+		embedding, err := CreateEmbedding(context.Background(), embedder, docs[i].Content, 1)
+		if err != nil {
+			t.Fatalf("Failed to create embedding: %v", err)
+		}
+		chunk := Chunk{
+			DocumentID: docs[i].ID,
+			Content:    docs[i].Content,
+			Hash:       MakeHash(docs[i].Content),
+			Embedding:  embedding,
+		}
+		if err := InsertChunk(db, &chunk); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+	}
+	return db, embedder
+}
+
+func TestFuseRankings(t *testing.T) {
+	vector := []Chunk{{ID: 1}, {ID: 2}, {ID: 3}}
+	keyword := []Chunk{{ID: 3}, {ID: 4}}
+	options := DefaultHybridSearchOptions()
+	options.Limit = 3
+
+	fused := fuseRankings(options, rankedList{vector, 1}, rankedList{keyword, 1})
+	if len(fused) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(fused))
+	}
+	if fused[0].ID != 3 {
+		t.Errorf("Expected chunk 3, found by both rankings, to rank first, got %d", fused[0].ID)
+	}
+
+	fused = fuseRankings(options, rankedList{vector, 1}, rankedList{keyword, 10})
+	if fused[0].ID != 3 || fused[1].ID != 4 {
+		t.Errorf("Expected heavily weighted keyword results first, got %d and %d", fused[0].ID, fused[1].ID)
+	}
+}
+
+func TestKeywordSearch(t *testing.T) {
+	db, _ := setupSearchTestDB(t)
+	if !HasFTS(db) {
+		t.Skip("FTS5 not available; run with -tags sqlite_fts5")
+	}
+
+	chunks, err := KeywordSearch(context.Background(), db, "Where is Kingston?", 5)
+	if err != nil {
+		t.Fatalf("Keyword search failed: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Content != "Epistemic Technology is based in Kingston, New York." {
+		t.Errorf("Expected only the Kingston chunk, got %+v", chunks)
+	}
+
+	chunks, err = KeywordSearch(context.Background(), db, `"unbalanced quote AND (`, 5)
+	if err != nil {
+		t.Fatalf("Expected punctuation in the query to be ignored, got %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("Expected no matches, got %d", len(chunks))
+	}
+}
+
+func TestKeywordSearchWithoutFTS(t *testing.T) {
+	db, _ := setupSearchTestDB(t)
+	db.hasFTS = false
+
+	chunks, err := KeywordSearch(context.Background(), db, "Kingston", 5)
+	if err != nil {
+		t.Fatalf("Keyword search failed: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("Expected no keyword results without FTS, got %d", len(chunks))
+	}
+}
+
+func TestHybridSearch(t *testing.T) {
+	db, embedder := setupSearchTestDB(t)
+
+	query := "Kingston"
+	embedding, err := CreateEmbedding(context.Background(), embedder, query, 1)
+	if err != nil {
+		t.Fatalf("Failed to create embedding: %v", err)
+	}
+
+	options := DefaultHybridSearchOptions()
+	options.Limit = 2
+	chunks, err := HybridSearch(context.Background(), db, query, embedding, options)
+	if err != nil {
+		t.Fatalf("Hybrid search failed: %v", err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(chunks))
+	}
+	if chunks[0].Content != "Epistemic Technology is based in Kingston, New York." {
+		t.Errorf("Expected the Kingston chunk first, got %q", chunks[0].Content)
+	}
+
+	options.KeywordWeight = 0
+	options.VectorWeight = 0
+	if _, err := HybridSearch(context.Background(), db, query, embedding, options); err == nil {
+		t.Error("Expected an error when both weights are zero")
+	}
+}
+
+func TestHybridSearchMaxDistance(t *testing.T) {
+	db, embedder := setupSearchTestDB(t)
+
+	query := "Epistemic Technology is based in Kingston, New York."
+	embedding, err := CreateEmbedding(context.Background(), embedder, query, 1)
+	if err != nil {
+		t.Fatalf("Failed to create embedding: %v", err)
+	}
+
+	options := DefaultHybridSearchOptions()
+	chunks, err := HybridSearch(context.Background(), db, query, embedding, options)
+	if err != nil {
+		t.Fatalf("Hybrid search failed: %v", err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("Expected every chunk without a cutoff, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if chunk.Score <= 0 {
+			t.Errorf("Expected chunk %d to have a score", chunk.ID)
+		}
+		if i > 0 && chunk.Score > chunks[i-1].Score {
+			t.Error("Expected chunks in order of score")
+		}
+	}
+	if chunks[0].Content != query || chunks[0].Distance > 1e-6 || chunks[1].Distance <= 0 {
+		t.Errorf("Expected the identical chunk first with zero distance, got %+v", chunks)
+	}
+
+	options.MaxDistance = 0.01
+	chunks, err = HybridSearch(context.Background(), db, query, embedding, options)
+	if err != nil {
+		t.Fatalf("Hybrid search failed: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Content != query {
+		t.Errorf("Expected only the identical chunk within the cutoff, got %+v", chunks)
+	}
+
+	// Shares words with the documents, but is not close to any of them
+	query = "Is New York based in Kingston?"
+	embedding, err = CreateEmbedding(context.Background(), embedder, query, 1)
+	if err != nil {
+		t.Fatalf("Failed to create embedding: %v", err)
+	}
+	chunks, err = HybridSearch(context.Background(), db, query, embedding, options)
+	if err != nil {
+		t.Fatalf("Hybrid search failed: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("Expected no chunks within the cutoff, got %+v", chunks)
+	}
+
+	// A keyword match without an embedding cannot be shown to be close
+	query = "Epistemic Technology is based in Kingston, New York."
+	embedding, err = CreateEmbedding(context.Background(), embedder, query, 1)
+	if err != nil {
+		t.Fatalf("Failed to create embedding: %v", err)
+	}
+	if _, err := db.db.Exec("DELETE FROM vec_chunks WHERE id IN (SELECT id FROM chunks WHERE content = ?)", query); err != nil {
+		t.Fatalf("Failed to delete embedding: %v", err)
+	}
+	chunks, err = HybridSearch(context.Background(), db, query, embedding, options)
+	if err != nil {
+		t.Fatalf("Hybrid search failed: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("Expected the keyword match without an embedding to be dropped, got %+v", chunks)
+	}
+}
+
+func TestHybridSearchFilter(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	embedder := NewLocalEmbedder(0)
+	docs := []Document{
+		{Title: "Services", Section: "", Content: "We build retrieval systems.", PublicationDate: "2024-06-01"},
+		{Title: "Old post", Section: "blog", Content: "Retrieval systems in 2023.", PublicationDate: "2023-03-15T09:00:00Z",
+			Metadata: map[string]any{"tags": []any{"RAG", "search"}, "categories": "Engineering"}},
+		{Title: "New post", Section: "blog", Content: "Retrieval systems in 2025.", PublicationDate: "2025-01-20T09:00:00-05:00",
+			Metadata: map[string]any{"tags": []any{"agents"}, "categories": []any{"research"}}},
+	}
+	for i := range docs {
+		if err := InsertDocument(db, &docs[i]); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+		chunks, err := ChunkDocument(&docs[i], &ParagraphChunker{}, embedder, &User{ID: 1}, db)
+		if err != nil {
+			t.Fatalf("Failed to chunk document: %v", err)
+		}
+		for j := range chunks {
+			if err := InsertChunk(db, &chunks[j]); err != nil {
+				t.Fatalf("Failed to insert chunk: %v", err)
+			}
+		}
+	}
+
+	query := "Retrieval systems"
+	embedding, err := CreateEmbedding(context.Background(), embedder, query, 1)
+	if err != nil {
+		t.Fatalf("Failed to create embedding: %v", err)
+	}
+
+	day := func(s string) time.Time {
+		d, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", s, err)
+		}
+		return d
+	}
+	tests := []struct {
+		name     string
+		filter   SearchFilter
+		expected []int
+	}{
+		{"no filter", SearchFilter{}, []int{docs[0].ID, docs[1].ID, docs[2].ID}},
+		{"section", SearchFilter{Sections: []string{"blog"}}, []int{docs[1].ID, docs[2].ID}},
+		{"tags", SearchFilter{Tags: []string{"rag", "other"}}, []int{docs[1].ID}},
+		{"single category", SearchFilter{Categories: []string{"engineering"}}, []int{docs[1].ID}},
+		{"published from", SearchFilter{PublishedFrom: day("2024-06-01")}, []int{docs[0].ID, docs[2].ID}},
+		{"published to", SearchFilter{PublishedTo: day("2024-06-01")}, []int{docs[0].ID, docs[1].ID}},
+		{"document IDs", SearchFilter{DocumentIDs: []int{docs[0].ID, docs[2].ID}}, []int{docs[0].ID, docs[2].ID}},
+		{"combined", SearchFilter{Sections: []string{"blog"}, PublishedFrom: day("2024-01-01")}, []int{docs[2].ID}},
+		{"no match", SearchFilter{Sections: []string{"projects"}}, nil},
+	}
+
+	for _, test := range tests {
+		options := DefaultHybridSearchOptions()
+		options.Limit = 10
+		options.Filter = test.filter
+		chunks, err := HybridSearch(context.Background(), db, query, embedding, options)
+		if err != nil {
+			t.Errorf("%s: search failed: %v", test.name, err)
+			continue
+		}
+		found := map[int]bool{}
+		for _, chunk := range chunks {
+			found[chunk.DocumentID] = true
+		}
+		if len(found) != len(test.expected) {
+			t.Errorf("%s: expected documents %v, got %v", test.name, test.expected, found)
+			continue
+		}
+		for _, id := range test.expected {
+			if !found[id] {
+				t.Errorf("%s: expected documents %v, got %v", test.name, test.expected, found)
+				break
+			}
+		}
+	}
+}
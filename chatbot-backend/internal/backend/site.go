@@ -0,0 +1,291 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// siteConfigFiles are the Hugo configuration file names, in the order Hugo
+// looks for them.
+var siteConfigFiles = []string{
+	"hugo.toml", "hugo.yaml", "hugo.yml", "hugo.json",
+	"config.toml", "config.yaml", "config.yml", "config.json",
+}
+
+// SiteConfig holds the parts of a Hugo site configuration needed to work out
+// the public URL of a content file.
+type SiteConfig struct {
+	BaseURL string
+	// ContentDir is the absolute path of the site's content directory.
+	ContentDir string
+	// Permalinks maps a top-level section to a permalink pattern such as
+	// "/:year/:month/:slug/".
+	Permalinks map[string]string
+	UglyURLs   bool
+}
+
+// LoadSiteConfig reads the Hugo configuration file in siteDir.
+func LoadSiteConfig(siteDir string) (*SiteConfig, error) {
+	for _, name := range siteConfigFiles {
+		configPath := filepath.Join(siteDir, name)
+		content, err := os.ReadFile(configPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseSiteConfig(siteDir, configPath, content)
+	}
+	return nil, fmt.Errorf("no Hugo configuration file found in %s", siteDir)
+}
+
+// FindSiteConfig looks for the Hugo site containing directory by searching it
+// and its parents for a configuration file. It returns nil if directory is not
+// inside the content directory of a Hugo site.
+func FindSiteConfig(directory string) (*SiteConfig, error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	for dir := directory; ; dir = filepath.Dir(dir) {
+		for _, name := range siteConfigFiles {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				continue
+			}
+			site, err := LoadSiteConfig(dir)
+			if err != nil {
+				return nil, err
+			}
+			if !isWithin(site.ContentDir, directory) {
+				return nil, nil
+			}
+			return site, nil
+		}
+		if filepath.Dir(dir) == dir {
+			return nil, nil
+		}
+	}
+}
+
+func parseSiteConfig(siteDir string, configPath string, content []byte) (*SiteConfig, error) {
+	var raw map[string]any
+	var err error
+	switch filepath.Ext(configPath) {
+	case ".toml":
+		_, err = toml.Decode(string(content), &raw)
+	case ".json":
+		err = json.Unmarshal(content, &raw)
+	default:
+		err = yaml.Unmarshal(content, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", configPath, err)
+	}
+	raw = normalizeFrontMatter(raw)
+
+	contentDir := MetadataString(raw, "contentdir")
+	if contentDir == "" {
+		contentDir = "content"
+	}
+	if !filepath.IsAbs(contentDir) {
+		contentDir = filepath.Join(siteDir, contentDir)
+	}
+	contentDir, err = filepath.Abs(contentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	site := &SiteConfig{
+		BaseURL:    strings.TrimSuffix(MetadataString(raw, "baseurl"), "/"),
+		ContentDir: contentDir,
+		Permalinks: map[string]string{},
+		UglyURLs:   metadataBool(raw, "uglyurls"),
+	}
+
+	// Permalinks are either a map of section to pattern or, since Hugo
+	// 0.112, split by page kind. Only patterns for regular pages are used.
+	permalinks, _ := raw["permalinks"].(map[string]any)
+	if pages, ok := permalinks["page"].(map[string]any); ok {
+		permalinks = pages
+	}
+	for section, pattern := range permalinks {
+		if pattern, ok := pattern.(string); ok {
+			site.Permalinks[section] = pattern
+		}
+	}
+
+	return site, nil
+}
+
+// PageURL returns the public URL of the content file at filePath, following
+// Hugo's rules: a url in the front matter is used as is, section pages
+// (_index.md) are served at their directory, page bundles (index.md) take the
+// name of their directory, slug replaces the file name, and pages in a
+// section with a permalink pattern use that pattern.
+func (s *SiteConfig) PageURL(filePath string, metadata map[string]any) (string, error) {
+	if pageURL := MetadataString(metadata, "url"); pageURL != "" {
+		return s.absoluteURL(pageURL), nil
+	}
+
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(s.ContentDir, absPath) {
+		return "", fmt.Errorf("%s is not in the content directory %s", filePath, s.ContentDir)
+	}
+	relPath, err := filepath.Rel(s.ContentDir, absPath)
+	if err != nil {
+		return "", err
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	dir, file := path.Split(relPath)
+	dir = strings.Trim(dir, "/")
+	name := strings.TrimSuffix(file, path.Ext(file))
+
+	if name == "_index" {
+		if dir == "" {
+			return s.absoluteURL("/"), nil
+		}
+		return s.absoluteURL("/" + urlizePath(dir) + "/"), nil
+	}
+
+	if name == "index" && dir != "" {
+		dir, name = path.Split(dir)
+		dir = strings.Trim(dir, "/")
+	}
+
+	section, _, _ := strings.Cut(dir, "/")
+	slug := MetadataString(metadata, "slug")
+	if pattern, ok := s.Permalinks[section]; ok && section != "" {
+		return s.absoluteURL(expandPermalink(pattern, dir, name, slug, metadata)), nil
+	}
+
+	if slug != "" {
+		name = slug
+	}
+	pagePath := urlizePath(path.Join(dir, name))
+	if s.UglyURLs {
+		return s.absoluteURL("/" + pagePath + ".html"), nil
+	}
+	return s.absoluteURL("/" + pagePath + "/"), nil
+}
+
+func (s *SiteConfig) absoluteURL(pagePath string) string {
+	if parsed, err := url.Parse(pagePath); err == nil && parsed.IsAbs() {
+		return pagePath
+	}
+	if !strings.HasPrefix(pagePath, "/") {
+		pagePath = "/" + pagePath
+	}
+	return s.BaseURL + pagePath
+}
+
+// Section returns the top-level section of the content file at filePath, or
+// an empty string for pages, including page bundles, at the root of the
+// content directory.
+func (s *SiteConfig) Section(filePath string) string {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil || !isWithin(s.ContentDir, absPath) {
+		return ""
+	}
+	relPath, err := filepath.Rel(s.ContentDir, absPath)
+	if err != nil {
+		return ""
+	}
+
+	dir, file := path.Split(filepath.ToSlash(relPath))
+	dir = strings.Trim(dir, "/")
+	if strings.TrimSuffix(file, path.Ext(file)) == "index" {
+		dir, _ = path.Split(dir)
+		dir = strings.Trim(dir, "/")
+	}
+	section, _, _ := strings.Cut(dir, "/")
+	return section
+}
+
+// expandPermalink substitutes the tokens Hugo supports in permalink patterns.
+// dir is the page's directory relative to the content directory and name its
+// file name, or directory name for a page bundle.
+func expandPermalink(pattern string, dir string, name string, slug string, metadata map[string]any) string {
+	date, _ := parseMetadataDate(MetadataString(metadata, "date"))
+	title := MetadataString(metadata, "title")
+	section, _, _ := strings.Cut(dir, "/")
+
+	slugOrTitle := slug
+	if slugOrTitle == "" {
+		slugOrTitle = title
+	}
+	slugOrFilename := slug
+	if slugOrFilename == "" {
+		slugOrFilename = name
+	}
+
+	replacer := strings.NewReplacer(
+		":year", date.Format("2006"),
+		":monthname", strings.ToLower(date.Format("January")),
+		":month", date.Format("01"),
+		":day", date.Format("02"),
+		":weekdayname", strings.ToLower(date.Format("Monday")),
+		":sections", urlizePath(dir),
+		":section", urlizePath(section),
+		":slugorfilename", urlize(slugOrFilename),
+		":slugorcontentbasename", urlize(slugOrFilename),
+		":contentbasename", urlize(name),
+		":filename", urlize(name),
+		":slug", urlize(slugOrTitle),
+		":title", urlize(title),
+	)
+	expanded := replacer.Replace(pattern)
+	for strings.Contains(expanded, "//") {
+		expanded = strings.ReplaceAll(expanded, "//", "/")
+	}
+	return expanded
+}
+
+func parseMetadataDate(value string) (time.Time, error) {
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// urlize converts text to a URL path segment the way Hugo does: lowercased,
+// with spaces replaced by hyphens and other punctuation removed.
+func urlize(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(text)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.':
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+func urlizePath(pagePath string) string {
+	segments := strings.Split(pagePath, "/")
+	for i, segment := range segments {
+		segments[i] = urlize(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func isWithin(dir string, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
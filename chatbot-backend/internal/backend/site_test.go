@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestSite(t *testing.T, config string, files map[string]string) string {
+	siteDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(siteDir, "hugo.toml"), []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	for name, content := range files {
+		filePath := filepath.Join(siteDir, "content", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatalf("Failed to create directory for %s: %v", name, err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return siteDir
+}
+
+func TestSiteConfigPageURL(t *testing.T) {
+	siteDir := writeTestSite(t, `
+baseURL = 'https://example.com/'
+[permalinks]
+  posts = "/:year/:month/:slug/"
+`, nil)
+	site, err := LoadSiteConfig(siteDir)
+	if err != nil {
+		t.Fatalf("Failed to load site config: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		metadata map[string]any
+		expected string
+	}{
+		{"home page", "_index.md", nil, "https://example.com/"},
+		{"section page", "blog/_index.md", nil, "https://example.com/blog/"},
+		{"regular page", "about.md", nil, "https://example.com/about/"},
+		{"section page file", "blog/2025-03-31-Building a Chatbot.md", nil, "https://example.com/blog/2025-03-31-building-a-chatbot/"},
+		{"page bundle", "blog/my-post/index.md", nil, "https://example.com/blog/my-post/"},
+		{"slug override", "blog/post.md", map[string]any{"slug": "better-name"}, "https://example.com/blog/better-name/"},
+		{"url override", "blog/post.md", map[string]any{"url": "/custom/path/"}, "https://example.com/custom/path/"},
+		{"absolute url override", "blog/post.md", map[string]any{"url": "https://other.example/x/"}, "https://other.example/x/"},
+		{"permalink with title", "posts/first.md", map[string]any{"title": "Hello, World!", "date": "2025-03-31"}, "https://example.com/2025/03/hello-world/"},
+		{"permalink with slug", "posts/second/index.md", map[string]any{"title": "Ignored", "slug": "second-post", "date": "2024-11-02T10:00:00Z"}, "https://example.com/2024/11/second-post/"},
+	}
+
+	for _, test := range tests {
+		filePath := filepath.Join(site.ContentDir, filepath.FromSlash(test.path))
+		got, err := site.PageURL(filePath, test.metadata)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+
+	if _, err := site.PageURL(filepath.Join(siteDir, "outside.md"), nil); err == nil {
+		t.Error("Expected an error for a file outside the content directory")
+	}
+}
+
+func TestSiteConfigSection(t *testing.T) {
+	siteDir := writeTestSite(t, "baseURL = 'https://example.com/'\n", nil)
+	site, err := LoadSiteConfig(siteDir)
+	if err != nil {
+		t.Fatalf("Failed to load site config: %v", err)
+	}
+
+	tests := map[string]string{
+		"_index.md":                 "",
+		"about.md":                  "",
+		"about/index.md":            "",
+		"blog/_index.md":            "blog",
+		"blog/post.md":              "blog",
+		"blog/my-post/index.md":     "blog",
+		"blog/2025/nested/index.md": "blog",
+	}
+	for name, expected := range tests {
+		if got := site.Section(filepath.Join(site.ContentDir, filepath.FromSlash(name))); got != expected {
+			t.Errorf("%s: expected section %q, got %q", name, expected, got)
+		}
+	}
+	if got := site.Section(filepath.Join(siteDir, "outside.md")); got != "" {
+		t.Errorf("Expected no section for a file outside the content directory, got %q", got)
+	}
+}
+
+func TestSiteConfigPermalinksByKindAndUglyURLs(t *testing.T) {
+	siteDir := writeTestSite(t, `
+baseURL = 'https://example.com'
+uglyURLs = true
+[permalinks.page]
+  posts = "/articles/:filename/"
+[permalinks.section]
+  posts = "/articles/"
+`, nil)
+	site, err := LoadSiteConfig(siteDir)
+	if err != nil {
+		t.Fatalf("Failed to load site config: %v", err)
+	}
+
+	got, err := site.PageURL(filepath.Join(site.ContentDir, "posts", "first.md"), nil)
+	if err != nil || got != "https://example.com/articles/first/" {
+		t.Errorf("Expected the page permalink, got %q (%v)", got, err)
+	}
+	got, err = site.PageURL(filepath.Join(site.ContentDir, "about.md"), nil)
+	if err != nil || got != "https://example.com/about.html" {
+		t.Errorf("Expected an ugly URL, got %q (%v)", got, err)
+	}
+}
+
+func TestHugoDirectoryToDocumentsSetsURLs(t *testing.T) {
+	siteDir := writeTestSite(t, "baseURL = 'https://example.com/'\n", map[string]string{
+		"about.md":             "---\ntitle: About\n---\nAbout us.",
+		"blog/_index.md":       "---\ntitle: Blog\n---\nAll posts.",
+		"blog/first/index.md":  "---\ntitle: First\n---\nFirst post.",
+		"blog/second.md":       "---\ntitle: Second\nslug: number-two\n---\nSecond post.",
+		"blog/first/notes.txt": "Not content.",
+	})
+
+	docs, err := HugoDirectoryToDocuments(filepath.Join(siteDir, "content"), true)
+	if err != nil {
+		t.Fatalf("Failed to load documents: %v", err)
+	}
+	expected := map[string]string{
+		"About":  "https://example.com/about/",
+		"Blog":   "https://example.com/blog/",
+		"First":  "https://example.com/blog/first/",
+		"Second": "https://example.com/blog/number-two/",
+	}
+	if len(docs) != len(expected) {
+		t.Fatalf("Expected %d documents, got %d", len(expected), len(docs))
+	}
+	for _, doc := range docs {
+		if doc.URL != expected[doc.Title] {
+			t.Errorf("Expected %s to have URL %q, got %q", doc.Title, expected[doc.Title], doc.URL)
+		}
+	}
+
+	doc, err := HugoToDocument(filepath.Join(siteDir, "content", "blog", "second.md"))
+	if err != nil {
+		t.Fatalf("Failed to load document: %v", err)
+	}
+	if doc.URL != "https://example.com/blog/number-two/" {
+		t.Errorf("Expected a single file to get its site URL, got %q", doc.URL)
+	}
+}
+
+func TestFindSiteConfigOutsideSite(t *testing.T) {
+	site, err := FindSiteConfig("test-docs")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if site != nil {
+		t.Errorf("Expected no site for test-docs, got %+v", site)
+	}
+}
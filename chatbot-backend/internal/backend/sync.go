@@ -0,0 +1,248 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// SyncResult counts the documents changed by a sync.
+type SyncResult struct {
+	Added     int
+	Updated   int
+	Removed   int
+	Unchanged int
+}
+
+func (r SyncResult) String() string {
+	return fmt.Sprintf("%d added, %d updated, %d removed, %d unchanged", r.Added, r.Updated, r.Removed, r.Unchanged)
+}
+
+// SyncHugoDirectory brings the stored documents for the Markdown files in
+// directory up to date. Documents are keyed by file path: new files are
+// added, files whose content changed are re-chunked and re-embedded, and
+// documents whose files were deleted or are no longer published are removed
+// along with their chunks. Documents from outside directory, or from its
+// subdirectories when recursive is false, are left alone.
+func SyncHugoDirectory(db *DB, directory string, recursive bool, chunker Chunker, embedder Embedder, user *User) (SyncResult, error) {
+	docs, err := HugoDirectoryToDocuments(directory, recursive)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	inScope := func(filePath string) bool {
+		if recursive {
+			return isWithin(filepath.Clean(directory), filepath.Clean(filePath))
+		}
+		return filepath.Dir(filepath.Clean(filePath)) == filepath.Clean(directory)
+	}
+	return SyncDocuments(db, docs, inScope, chunker, embedder, user)
+}
+
+// embedGroupChunks is the number of chunks a sync embeds together. New and
+// changed documents are queued until their chunks reach this number, so the
+// chunks of many small documents share requests, while a sync that fails
+// part way through a large site keeps the documents stored before it.
+const embedGroupChunks = 1000
+
+// pendingDocument is a new or changed document waiting to be embedded.
+type pendingDocument struct {
+	doc     *Document
+	chunks  []Chunk
+	replace bool
+}
+
+// SyncDocuments stores docs, keyed by their FilePath, and removes stored
+// documents for which inScope returns true but that are not in docs. It
+// refuses to add embeddings from an embedder whose model is not the one
+// recorded for the database.
+func SyncDocuments(db *DB, docs []Document, inScope func(filePath string) bool, chunker Chunker, embedder Embedder, user *User) (SyncResult, error) {
+	result := SyncResult{}
+	if err := UseEmbedder(db, embedder); err != nil {
+		return result, err
+	}
+
+	pending := []pendingDocument{}
+	pendingChunks := 0
+	queue := func(doc *Document, replace bool) error {
+		chunks := chunker.Chunk(doc)
+		pending = append(pending, pendingDocument{doc: doc, chunks: chunks, replace: replace})
+		pendingChunks += len(chunks)
+		if pendingChunks < embedGroupChunks {
+			return nil
+		}
+		err := storePendingDocuments(db, pending, embedder, user, &result)
+		pending = pending[:0]
+		pendingChunks = 0
+		return err
+	}
+
+	stored, err := GetAllDocuments(db)
+	if err != nil {
+		return result, err
+	}
+	storedByPath := map[string][]Document{}
+	for _, doc := range stored {
+		if doc.FilePath == "" || !inScope(doc.FilePath) {
+			continue
+		}
+		path := filepath.Clean(doc.FilePath)
+		storedByPath[path] = append(storedByPath[path], doc)
+	}
+
+	for i := range docs {
+		doc := &docs[i]
+		doc.Hash = MakeHash(doc.Content)
+		path := filepath.Clean(doc.FilePath)
+		existing := storedByPath[path]
+		delete(storedByPath, path)
+
+		// Earlier versions keyed documents by content, so a file may have
+		// several stored documents. Keep the one matching the current
+		// content, or failing that the first, and remove the others.
+		keep := -1
+		for j, old := range existing {
+			if bytes.Equal(old.Hash, doc.Hash) {
+				keep = j
+				break
+			}
+		}
+		if keep == -1 && len(existing) > 0 {
+			keep = 0
+		}
+		for j, old := range existing {
+			if j == keep {
+				continue
+			}
+			if err := DeleteDocument(db, old.ID); err != nil {
+				return result, err
+			}
+		}
+
+		if keep == -1 {
+			if err := queue(doc, false); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		// A document is stored in the same transaction as its chunks, so one
+		// with the same content needs no re-embedding, even if it has no
+		// chunks.
+		old := existing[keep]
+		doc.ID = old.ID
+		if bytes.Equal(old.Hash, doc.Hash) {
+			if sameDocumentFields(old, *doc) {
+				result.Unchanged++
+				continue
+			}
+			if err := UpdateDocument(db, doc); err != nil {
+				return result, err
+			}
+			log.Printf("Updated metadata of %s", doc.FilePath)
+			result.Updated++
+			continue
+		}
+
+		if err := queue(doc, true); err != nil {
+			return result, err
+		}
+	}
+	if err := storePendingDocuments(db, pending, embedder, user, &result); err != nil {
+		return result, err
+	}
+
+	for path, removed := range storedByPath {
+		for _, doc := range removed {
+			if err := DeleteDocument(db, doc.ID); err != nil {
+				return result, err
+			}
+		}
+		log.Printf("Removed %s", path)
+		result.Removed++
+	}
+
+	return result, nil
+}
+
+// storePendingDocuments embeds the chunks of the pending documents together
+// and then stores each document with its chunks, replacing the stored chunks
+// of changed documents. Embeddings are created before any transaction starts
+// so the database is not locked while waiting on the embedder, so the model is
+// checked again in each transaction in case the database was re-embedded.
+func storePendingDocuments(db *DB, pending []pendingDocument, embedder Embedder, user *User, result *SyncResult) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	chunks := make([][]Chunk, len(pending))
+	for i, p := range pending {
+		chunks[i] = p.chunks
+	}
+	if err := embedChunks(chunks, embedder, user); err != nil {
+		return fmt.Errorf("error embedding chunks of %d documents: %w", len(pending), err)
+	}
+
+	for _, p := range pending {
+		err := WithTx(db, func(tx *DB) error {
+			if err := CheckEmbedder(tx, embedder); err != nil {
+				return err
+			}
+			if !p.replace {
+				if err := insertDocumentRow(tx, p.doc); err != nil {
+					return err
+				}
+				return insertDocumentChunks(tx, p.doc, p.chunks)
+			}
+			if err := UpdateDocument(tx, p.doc); err != nil {
+				return err
+			}
+			if err := DeleteDocumentChunks(tx, p.doc.ID); err != nil {
+				return err
+			}
+			return insertDocumentChunks(tx, p.doc, p.chunks)
+		})
+		if err != nil {
+			return err
+		}
+		if p.replace {
+			log.Printf("Updated %s", p.doc.FilePath)
+			result.Updated++
+		} else {
+			log.Printf("Added %s", p.doc.FilePath)
+			result.Added++
+		}
+	}
+	return nil
+}
+
+func insertDocumentChunks(db *DB, doc *Document, chunks []Chunk) error {
+	for i := range chunks {
+		chunks[i].DocumentID = doc.ID
+		if err := insertChunk(db, &chunks[i]); err != nil {
+			return fmt.Errorf("error inserting chunk %d of %s: %w", i, doc.FilePath, err)
+		}
+	}
+	return nil
+}
+
+// sameDocumentFields reports whether two versions of a document agree on every
+// field other than the content, so a front matter edit that leaves the body
+// unchanged can be stored without re-embedding.
+func sameDocumentFields(a Document, b Document) bool {
+	if a.Title != b.Title || a.Author != b.Author || a.PublicationDate != b.PublicationDate ||
+		a.URL != b.URL || a.FilePath != b.FilePath || a.Section != b.Section {
+		return false
+	}
+	// Compare the metadata as it is stored, since numbers come back from the
+	// database as float64.
+	aMetadata, err := marshalMetadata(a.Metadata)
+	if err != nil {
+		return false
+	}
+	bMetadata, err := marshalMetadata(b.Metadata)
+	if err != nil {
+		return false
+	}
+	return aMetadata == bMetadata
+}
@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func countRows(t *testing.T, db *DB, table string) int {
+	var count int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatalf("Failed to count %s: %v", table, err)
+	}
+	return count
+}
+
+func TestSyncHugoDirectory(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	write("a.md", "---\ntitle: A\n---\nFirst document.")
+	write("b.md", "---\ntitle: B\n---\nSecond document.")
+	write("c.md", "---\ntitle: C\n---\nThird document.")
+
+	chunker := &ParagraphChunker{}
+	embedder := NewLocalEmbedder(0)
+	user := &User{ID: 1}
+
+	result, err := SyncHugoDirectory(db, dir, false, chunker, embedder, user)
+	if err != nil {
+		t.Fatalf("Initial sync failed: %v", err)
+	}
+	if result != (SyncResult{Added: 3}) {
+		t.Errorf("Expected 3 added documents, got %s", result)
+	}
+	chunksBefore := countRows(t, db, "chunks")
+
+	result, err = SyncHugoDirectory(db, dir, false, chunker, embedder, user)
+	if err != nil {
+		t.Fatalf("Second sync failed: %v", err)
+	}
+	if result != (SyncResult{Unchanged: 3}) {
+		t.Errorf("Expected 3 unchanged documents, got %s", result)
+	}
+
+	write("a.md", "---\ntitle: A\n---\nFirst document, edited.\n\nWith a second paragraph.")
+	write("b.md", "---\ntitle: B renamed\n---\nSecond document.")
+	if err := os.Remove(filepath.Join(dir, "c.md")); err != nil {
+		t.Fatalf("Failed to remove c.md: %v", err)
+	}
+	write("d.md", "---\ntitle: D\n---\nFourth document.")
+
+	result, err = SyncHugoDirectory(db, dir, false, chunker, embedder, user)
+	if err != nil {
+		t.Fatalf("Third sync failed: %v", err)
+	}
+	if result != (SyncResult{Added: 1, Updated: 2, Removed: 1}) {
+		t.Errorf("Expected 1 added, 2 updated and 1 removed, got %s", result)
+	}
+
+	docs, err := GetAllDocuments(db)
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	titles := map[string]string{}
+	for _, doc := range docs {
+		titles[filepath.Base(doc.FilePath)] = doc.Title
+	}
+	expected := map[string]string{"a.md": "A", "b.md": "B renamed", "d.md": "D"}
+	if len(titles) != len(expected) || len(docs) != len(expected) {
+		t.Fatalf("Expected documents %v, got %v", expected, titles)
+	}
+	for file, title := range expected {
+		if titles[file] != title {
+			t.Errorf("Expected %s to have title %q, got %q", file, title, titles[file])
+		}
+	}
+
+	// a.md gained a paragraph, c.md lost its two chunks and d.md added two.
+	if chunks := countRows(t, db, "chunks"); chunks != chunksBefore+1 {
+		t.Errorf("Expected %d chunks, got %d", chunksBefore+1, chunks)
+	}
+	if vectors := countRows(t, db, "vec_chunks"); vectors != countRows(t, db, "chunks") {
+		t.Errorf("Expected a vector for every chunk, got %d vectors", vectors)
+	}
+
+	embedding, err := CreateEmbedding(context.Background(), embedder, "Third document.", 1)
+	if err != nil {
+		t.Fatalf("Failed to create embedding: %v", err)
+	}
+	results, err := SimilaritySearch(context.Background(), db, embedding, 10)
+	if err != nil {
+		t.Fatalf("Similarity search failed: %v", err)
+	}
+	for _, chunk := range results {
+		if chunk.Content == "Third document." {
+			t.Error("Expected the deleted document to no longer be searchable")
+		}
+	}
+}
+
+func TestSyncDocumentsReplacesContentKeyedDuplicates(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	// Two versions of the same file stored by an earlier, content-keyed ingest
+	for _, content := range []string{"Old version.", "Older version."} {
+		doc := Document{FilePath: "/site/content/a.md", Content: content}
+		if err := InsertDocument(db, &doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+	// A document from elsewhere, which must be left alone
+	other := Document{FilePath: "/elsewhere/b.md", Content: "Other."}
+	if err := InsertDocument(db, &other); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	inScope := func(filePath string) bool { return isWithin("/site/content", filePath) }
+	docs := []Document{{FilePath: "/site/content/a.md", Content: "New version."}}
+	result, err := SyncDocuments(db, docs, inScope, &ParagraphChunker{}, NewLocalEmbedder(0), &User{ID: 1})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if result != (SyncResult{Updated: 1}) {
+		t.Errorf("Expected 1 updated document, got %s", result)
+	}
+
+	stored, err := GetAllDocuments(db)
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("Expected the duplicate to be removed, got %d documents", len(stored))
+	}
+	for _, doc := range stored {
+		if doc.FilePath == "/site/content/a.md" && doc.Content != "New version." {
+			t.Errorf("Expected the new content, got %q", doc.Content)
+		}
+	}
+}
+
+func TestSyncDocumentsKeepsDocumentsWithoutChunks(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	// The Markdown chunker makes no chunks of a document with no body
+	inScope := func(filePath string) bool { return true }
+	docs := []Document{{FilePath: "/site/content/empty.md", Title: "Empty"}}
+	for i, expected := range []SyncResult{{Added: 1}, {Unchanged: 1}} {
+		result, err := SyncDocuments(db, docs, inScope, NewMarkdownChunker(0, 0), NewLocalEmbedder(0), &User{ID: 1})
+		if err != nil {
+			t.Fatalf("Sync %d failed: %v", i+1, err)
+		}
+		if result != expected {
+			t.Errorf("Sync %d: expected %s, got %s", i+1, expected, result)
+		}
+	}
+	if chunks := countRows(t, db, "chunks"); chunks != 0 {
+		t.Errorf("Expected the document to have no chunks, got %d", chunks)
+	}
+}
@@ -0,0 +1,11 @@
+package backend
+
+import "unicode/utf8"
+
+// EstimateTokens approximates the number of LLM tokens in text using the common
+// rule of thumb of four characters per token. It is used to keep prompts and
+// chunks within budgets without depending on a model-specific tokenizer.
+func EstimateTokens(text string) int {
+	characters := utf8.RuneCountInString(text)
+	return (characters + 3) / 4
+}
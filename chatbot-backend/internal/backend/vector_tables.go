@@ -0,0 +1,213 @@
+package backend
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openai/openai-go"
+)
+
+// ErrEmbeddingModelMismatch is returned when an embedder does not produce
+// embeddings like those stored in the database.
+var ErrEmbeddingModelMismatch = errors.New("embedding model does not match the database")
+
+// VectorTable is a vec0 table holding chunk embeddings, and the embedding
+// model and dimensions of those embeddings. Searches use the active table;
+// an inactive table is one being built by Reembed. A Model of "" means the
+// table is empty and takes on the model of the first embedder used with it.
+type VectorTable struct {
+	Name       string
+	Model      string
+	Dimensions int
+	Active     bool
+	CreatedAt  time.Time
+}
+
+func (t VectorTable) String() string {
+	model := t.Model
+	if model == "" {
+		model = "unknown model"
+	}
+	return fmt.Sprintf("%s (%d dimensions)", model, t.Dimensions)
+}
+
+// migrateVectorTables records vec_chunks, created by the baseline schema, as
+// the active vector table. Before models were recorded, embeddings were only
+// ever made with text-embedding-3-small, so that is recorded for a table
+// holding embeddings. An empty table's model is recorded by UseEmbedder.
+func migrateVectorTables(tx *DB) error {
+	var embedded bool
+	err := tx.conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM vec_chunks)`).Scan(&embedded)
+	if err != nil {
+		return fmt.Errorf("failed to count embeddings: %w", err)
+	}
+	model := ""
+	if embedded {
+		model = openai.EmbeddingModelTextEmbedding3Small
+	}
+
+	_, err = tx.conn.Exec(`
+		CREATE TABLE vector_tables (
+			name TEXT PRIMARY KEY,
+			model TEXT NOT NULL,
+			dimensions INTEGER NOT NULL,
+			active INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL
+		);
+		CREATE UNIQUE INDEX vector_tables_active ON vector_tables (active) WHERE active = 1;
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.conn.Exec(`
+		INSERT INTO vector_tables (name, model, dimensions, active, created_at)
+		VALUES ('vec_chunks', ?, 1536, 1, ?)
+	`, model, formatTimestamp(time.Now()))
+	return err
+}
+
+// GetVectorTables lists the vector tables, the active table first.
+func GetVectorTables(db *DB) ([]VectorTable, error) {
+	rows, err := db.conn.Query(`
+		SELECT name, model, dimensions, active, created_at FROM vector_tables
+		ORDER BY active DESC, created_at
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vector tables: %w", err)
+	}
+	defer rows.Close()
+
+	tables := []VectorTable{}
+	for rows.Next() {
+		var table VectorTable
+		var createdAt string
+		if err := rows.Scan(&table.Name, &table.Model, &table.Dimensions, &table.Active, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan vector table: %w", err)
+		}
+		table.CreatedAt, _ = time.Parse(timestampLayout, createdAt)
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// ActiveVectorTable returns the vector table searches use.
+func ActiveVectorTable(db *DB) (VectorTable, error) {
+	var table VectorTable
+	var createdAt string
+	err := db.conn.QueryRow(`
+		SELECT name, model, dimensions, active, created_at FROM vector_tables WHERE active = 1
+	`).Scan(&table.Name, &table.Model, &table.Dimensions, &table.Active, &createdAt)
+	if err == sql.ErrNoRows {
+		return VectorTable{}, fmt.Errorf("no active vector table")
+	}
+	if err != nil {
+		return VectorTable{}, fmt.Errorf("failed to get active vector table: %w", err)
+	}
+	table.CreatedAt, _ = time.Parse(timestampLayout, createdAt)
+	return table, nil
+}
+
+// vectorTableName returns the name of the active vector table. It is read
+// for each query, rather than once when the database is opened, so that a
+// server picks up a table swapped in by Reembed.
+func vectorTableName(db *DB) (string, error) {
+	var name string
+	err := db.conn.QueryRow(`SELECT name FROM vector_tables WHERE active = 1`).Scan(&name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get active vector table: %w", err)
+	}
+	return name, nil
+}
+
+// CheckEmbedder returns an error wrapping ErrEmbeddingModelMismatch if
+// embedder does not produce embeddings like those in the active vector
+// table, so query embeddings are compared with embeddings from the same
+// model. An empty table whose model is not yet recorded accepts any embedder.
+func CheckEmbedder(db *DB, embedder Embedder) error {
+	table, err := ActiveVectorTable(db)
+	if err != nil {
+		return err
+	}
+	if matchesEmbedder(table, embedder) {
+		return nil
+	}
+	if table.Model == "" {
+		var embedded bool
+		err := db.conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM ` + table.Name + `)`).Scan(&embedded)
+		if err != nil {
+			return fmt.Errorf("failed to count embeddings: %w", err)
+		}
+		if !embedded {
+			return nil
+		}
+	}
+	return mismatchError(table, embedder)
+}
+
+// UseEmbedder records embedder as the source of the embeddings in the active
+// vector table, or returns an error wrapping ErrEmbeddingModelMismatch if the
+// table holds embeddings from another model. An empty table is recreated for
+// embedder, so a new database can use any model. Changing the model of a
+// table with embeddings needs Reembed, even if its model was never recorded,
+// since embeddings of the same size from another model are not comparable.
+func UseEmbedder(db *DB, embedder Embedder) error {
+	return WithTx(db, func(tx *DB) error {
+		table, err := ActiveVectorTable(tx)
+		if err != nil {
+			return err
+		}
+		if matchesEmbedder(table, embedder) {
+			return nil
+		}
+
+		var count int
+		err = tx.conn.QueryRow(`SELECT COUNT(*) FROM ` + table.Name).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to count embeddings: %w", err)
+		}
+		switch {
+		case count == 0 && table.Dimensions != embedder.Dimensions():
+			if _, err := tx.conn.Exec(`DROP TABLE ` + table.Name); err != nil {
+				return fmt.Errorf("failed to drop %s: %w", table.Name, err)
+			}
+			if err := createVectorTable(tx, table.Name, embedder.Dimensions()); err != nil {
+				return err
+			}
+		case count > 0:
+			return mismatchError(table, embedder)
+		}
+
+		_, err = tx.conn.Exec(`
+			UPDATE vector_tables SET model = ?, dimensions = ? WHERE name = ?
+		`, embedder.Model(), embedder.Dimensions(), table.Name)
+		if err != nil {
+			return fmt.Errorf("failed to record embedding model: %w", err)
+		}
+		return nil
+	})
+}
+
+func matchesEmbedder(table VectorTable, embedder Embedder) bool {
+	return table.Model == embedder.Model() && table.Dimensions == embedder.Dimensions()
+}
+
+func mismatchError(table VectorTable, embedder Embedder) error {
+	return fmt.Errorf("%w: the database holds embeddings from %s but the embedder is %s (%d dimensions); configure the recorded model or run the reembed command",
+		ErrEmbeddingModelMismatch, table, embedder.Model(), embedder.Dimensions())
+}
+
+func createVectorTable(tx *DB, name string, dimensions int) error {
+	_, err := tx.conn.Exec(fmt.Sprintf(`
+		CREATE VIRTUAL TABLE %s
+		USING vec0(
+			id INTEGER PRIMARY KEY,
+			embedding FLOAT[%d]
+		);
+	`, name, dimensions))
+	if err != nil {
+		return fmt.Errorf("failed to create %s table: %w", name, err)
+	}
+	return nil
+}
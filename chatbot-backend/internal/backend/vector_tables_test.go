@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUseEmbedder(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	table, err := ActiveVectorTable(db)
+	if err != nil {
+		t.Fatalf("Failed to get active vector table: %v", err)
+	}
+	if table.Name != "vec_chunks" || table.Model != "" || table.Dimensions != 1536 {
+		t.Errorf("Expected a new database to have vec_chunks with an unknown model, got %+v", table)
+	}
+
+	// An empty table is recreated for the embedder
+	small := NewLocalEmbedder(8)
+	if err := UseEmbedder(db, small); err != nil {
+		t.Fatalf("UseEmbedder failed: %v", err)
+	}
+	docs := []Document{{Title: "A", Content: "Apples are red.", FilePath: "/content/a.md"}}
+	inScope := func(string) bool { return true }
+	if _, err := SyncDocuments(db, docs, inScope, &ParagraphChunker{}, small, &User{ID: 1}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	table, err = ActiveVectorTable(db)
+	if err != nil {
+		t.Fatalf("Failed to get active vector table: %v", err)
+	}
+	if table.Model != LocalEmbeddingModel || table.Dimensions != 8 {
+		t.Errorf("Expected the embedder to be recorded, got %+v", table)
+	}
+
+	// Embeddings from another model are refused
+	large := NewLocalEmbedder(0)
+	if err := CheckEmbedder(db, large); !errors.Is(err, ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected CheckEmbedder to refuse another model, got %v", err)
+	}
+	if err := UseEmbedder(db, large); !errors.Is(err, ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected UseEmbedder to refuse another model, got %v", err)
+	}
+	docs[0].Content = "Apples are green."
+	if _, err := SyncDocuments(db, docs, inScope, &ParagraphChunker{}, large, &User{ID: 1}); !errors.Is(err, ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected the sync to be refused, got %v", err)
+	}
+}
+
+func TestMigrateVectorTablesRecordsBaselineModel(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.sqlite")
+
+	// Embeddings stored before models were recorded
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := migrateBaseline(db); err != nil {
+		t.Fatalf("Failed to create baseline schema: %v", err)
+	}
+	serialized, err := serializeEmbedding(make(Embedding, 1536))
+	if err != nil {
+		t.Fatalf("Failed to serialize embedding: %v", err)
+	}
+	if _, err := db.conn.Exec(`INSERT INTO vec_chunks (id, embedding) VALUES (1, ?)`, serialized); err != nil {
+		t.Fatalf("Failed to insert embedding: %v", err)
+	}
+	Close(db)
+
+	db, err = GetDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	defer Close(db)
+
+	table, err := ActiveVectorTable(db)
+	if err != nil {
+		t.Fatalf("Failed to get active vector table: %v", err)
+	}
+	if table.Model != "text-embedding-3-small" || table.Name != "vec_chunks" {
+		t.Errorf("Expected the baseline model to be recorded for vec_chunks, got %+v", table)
+	}
+
+	// An embedder of the same size from another model is refused
+	local := NewLocalEmbedder(1536)
+	if err := CheckEmbedder(db, local); !errors.Is(err, ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected CheckEmbedder to refuse another model, got %v", err)
+	}
+	if err := UseEmbedder(db, local); !errors.Is(err, ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected UseEmbedder to refuse another model, got %v", err)
+	}
+}
+
+func TestUseEmbedderDoesNotAdoptPopulatedTable(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	// Embeddings stored without going through UseEmbedder
+	embedder := NewLocalEmbedder(0)
+	if err := CheckEmbedder(db, embedder); err != nil {
+		t.Errorf("Expected an empty table to accept any embedder, got %v", err)
+	}
+	doc := Document{Content: "Apples are red."}
+	if err := InsertDocument(db, &doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	chunks, err := EmbedDocumentChunks(&doc, &ParagraphChunker{}, embedder, &User{ID: 1})
+	if err != nil {
+		t.Fatalf("Failed to embed document: %v", err)
+	}
+	for i := range chunks {
+		chunks[i].DocumentID = doc.ID
+		if err := InsertChunk(db, &chunks[i]); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+	}
+
+	if err := CheckEmbedder(db, embedder); !errors.Is(err, ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected embeddings from an unrecorded model to be refused, got %v", err)
+	}
+	if err := UseEmbedder(db, embedder); !errors.Is(err, ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected an unrecorded model not to be adopted, got %v", err)
+	}
+}
+
+func TestReembed(t *testing.T) {
+	db, err := GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer Close(db)
+
+	docs := []Document{
+		{Title: "A", Content: "Apples are red.\n\nBananas are yellow.", FilePath: "/content/a.md"},
+		{Title: "B", Content: "Cherries are dark red.", FilePath: "/content/b.md"},
+	}
+	inScope := func(string) bool { return true }
+	if _, err := SyncDocuments(db, docs, inScope, &ParagraphChunker{}, NewLocalEmbedder(0), &User{ID: 1}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	chunkCount := countRows(t, db, "chunks")
+
+	// A table left by an interrupted re-embedding with another model
+	if _, err := prepareVectorTable(db, NewLocalEmbedder(4)); err != nil {
+		t.Fatalf("Failed to prepare vector table: %v", err)
+	}
+
+	embedder := NewLocalEmbedder(16)
+	calls := 0
+	table, err := Reembed(context.Background(), db, embedder, &User{ID: 1}, 2, func(done int, total int) {
+		calls++
+		if total != chunkCount {
+			t.Errorf("Expected %d chunks to embed, got %d", chunkCount, total)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Reembed failed: %v", err)
+	}
+	if calls != (chunkCount+1)/2 {
+		t.Errorf("Expected progress after each of %d batches, got %d", (chunkCount+1)/2, calls)
+	}
+
+	tables, err := GetVectorTables(db)
+	if err != nil {
+		t.Fatalf("Failed to get vector tables: %v", err)
+	}
+	if len(tables) != 1 || tables[0].Name != table.Name || !tables[0].Active || tables[0].Dimensions != 16 {
+		t.Errorf("Expected only the new table to remain, active, got %+v", tables)
+	}
+	if count := countRows(t, db, "sqlite_master WHERE name = 'vec_chunks'"); count != 0 {
+		t.Errorf("Expected the old vector table to be dropped")
+	}
+
+	query, err := CreateEmbedding(context.Background(), embedder, "Cherries", 1)
+	if err != nil {
+		t.Fatalf("Failed to embed query: %v", err)
+	}
+	results, err := SimilaritySearch(context.Background(), db, query, 10)
+	if err != nil {
+		t.Fatalf("SimilaritySearch failed: %v", err)
+	}
+	if len(results) != chunkCount {
+		t.Errorf("Expected every chunk to be searchable, got %d of %d", len(results), chunkCount)
+	}
+
+	// Syncs use the new table
+	docs[1].Content = "Cherries are dark red.\n\nDates are brown."
+	if _, err := SyncDocuments(db, docs, inScope, &ParagraphChunker{}, embedder, &User{ID: 1}); err != nil {
+		t.Fatalf("Sync after reembed failed: %v", err)
+	}
+	if count := countRows(t, db, table.Name); count != countRows(t, db, "chunks") {
+		t.Errorf("Expected an embedding for each chunk, got %d", count)
+	}
+
+	if _, err := Reembed(context.Background(), db, embedder, &User{ID: 1}, 2, nil); err == nil {
+		t.Error("Expected re-embedding with the current model to fail")
+	}
+}
@@ -0,0 +1,152 @@
+package backend
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	VerifierNone    = "none"
+	VerifierLexical = "lexical"
+	VerifierLLM     = "llm"
+)
+
+// Verification is the outcome of checking an answer against the passages it
+// was generated from. The answer is Supported if every one of its Claims is.
+type Verification struct {
+	Verifier  string
+	Supported bool
+	Claims    []ClaimCheck
+}
+
+// ClaimCheck is the outcome of checking one claim of an answer. Support is
+// the lexical verifier's measure of how well a passage covers the claim, from
+// 0 to 1.
+type ClaimCheck struct {
+	Claim     string
+	Supported bool
+	Support   float64
+}
+
+// UnsupportedClaims returns the claims that were not supported.
+func (v Verification) UnsupportedClaims() []string {
+	claims := []string{}
+	for _, check := range v.Claims {
+		if !check.Supported {
+			claims = append(claims, check.Claim)
+		}
+	}
+	return claims
+}
+
+// Verifier checks that an answer is supported by the passages given to the
+// LLM to produce it.
+type Verifier interface {
+	Verify(ctx context.Context, answer string, passages []Chunk) (Verification, error)
+}
+
+// NewVerifier creates the Verifier called name, or returns nil for
+// VerifierNone or an empty name. The LLM verifier checks answers with llm.
+func NewVerifier(name string, llm LLMProvider) (Verifier, error) {
+	switch name {
+	case "", VerifierNone:
+		return nil, nil
+	case VerifierLexical:
+		return NewLexicalVerifier(), nil
+	case VerifierLLM:
+		return NewLLMVerifier(llm), nil
+	default:
+		return nil, fmt.Errorf("unknown verifier: %s", name)
+	}
+}
+
+// LexicalVerifier is a Verifier that needs no network access. It treats each
+// sentence of the answer as a claim, and a claim as supported if at least
+// MinSupport of its words appear in a single passage. Sentences of fewer than
+// MinWords words, such as greetings, are not checked. It catches answers that
+// drift from the passages, not claims that contradict them.
+type LexicalVerifier struct {
+	MinSupport float64
+	MinWords   int
+}
+
+func NewLexicalVerifier() *LexicalVerifier {
+	return &LexicalVerifier{MinSupport: 0.5, MinWords: 3}
+}
+
+// sentencePattern matches a sentence and its closing punctuation.
+var sentencePattern = regexp.MustCompile(`[^.!?\n]+[.!?]*`)
+
+func (v *LexicalVerifier) Verify(ctx context.Context, answer string, passages []Chunk) (Verification, error) {
+	passageTerms := make([]map[string]bool, len(passages))
+	for i, passage := range passages {
+		passageTerms[i] = termSet(passage.Content)
+	}
+
+	verification := Verification{Verifier: VerifierLexical, Supported: true, Claims: []ClaimCheck{}}
+	for _, sentence := range sentencePattern.FindAllString(answer, -1) {
+		claim := strings.TrimSpace(sentence)
+		claimTerms := termSet(claim)
+		if len(claimTerms) < v.MinWords {
+			continue
+		}
+
+		check := ClaimCheck{Claim: claim}
+		for _, terms := range passageTerms {
+			check.Support = max(check.Support, termOverlap(claimTerms, terms))
+		}
+		check.Supported = check.Support >= v.MinSupport
+		verification.Supported = verification.Supported && check.Supported
+		verification.Claims = append(verification.Claims, check)
+	}
+	return verification, nil
+}
+
+//go:embed verify_prompt.md
+var verifyPrompt string
+
+// LLMVerifier is a Verifier that asks an LLM to split the answer into claims
+// and judge each against the passages.
+type LLMVerifier struct {
+	llm LLMProvider
+}
+
+func NewLLMVerifier(llm LLMProvider) *LLMVerifier {
+	return &LLMVerifier{llm: llm}
+}
+
+// verdictPattern matches a line of the LLM's judgements, such as
+// "UNSUPPORTED: We were founded in 1990."
+var verdictPattern = regexp.MustCompile(`(?i)^\W*(unsupported|supported)\W*:\s*(.+)$`)
+
+func (v *LLMVerifier) Verify(ctx context.Context, answer string, passages []Chunk) (Verification, error) {
+	var documents strings.Builder
+	for i, passage := range passages {
+		fmt.Fprintf(&documents, "Document %d:\n%s\n\n", i+1, passage.Content)
+	}
+	response, err := v.llm.Complete(ctx, []Message{
+		{Role: RoleSystem, Content: verifyPrompt},
+		{Role: RoleUser, Content: documents.String() + "Answer:\n" + answer},
+	})
+	if err != nil {
+		return Verification{}, fmt.Errorf("failed to verify answer: %w", err)
+	}
+
+	verification := Verification{Verifier: VerifierLLM, Supported: true, Claims: []ClaimCheck{}}
+	for _, line := range strings.Split(response, "\n") {
+		match := verdictPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		check := ClaimCheck{Claim: strings.TrimSpace(match[2]), Supported: strings.EqualFold(match[1], "supported")}
+		if check.Supported {
+			check.Support = 1
+		}
+		verification.Supported = verification.Supported && check.Supported
+		verification.Claims = append(verification.Claims, check)
+	}
+	return verification, nil
+}
@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLexicalVerifier(t *testing.T) {
+	passages := []Chunk{
+		{Content: "Epistemic Technology is an AI consultancy based in Kingston, New York."},
+		{Content: "We build retrieval augmented generation systems."},
+	}
+
+	verification, err := NewLexicalVerifier().Verify(context.Background(), "Thanks for asking! We are an AI consultancy in Kingston. We build retrieval systems.", passages)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !verification.Supported || len(verification.Claims) != 2 {
+		t.Errorf("Expected two supported claims, got %+v", verification)
+	}
+
+	verification, err = NewLexicalVerifier().Verify(context.Background(), "We are based in Kingston, New York. Our founders sailed around Antarctica twice.", passages)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if verification.Supported {
+		t.Errorf("Expected the answer to be unsupported, got %+v", verification)
+	}
+	unsupported := verification.UnsupportedClaims()
+	if len(unsupported) != 1 || unsupported[0] != "Our founders sailed around Antarctica twice." {
+		t.Errorf("Expected the second sentence to be unsupported, got %v", unsupported)
+	}
+}
+
+func TestLLMVerifier(t *testing.T) {
+	llm := NewFakeLLMClient()
+	llm.Response = "SUPPORTED: We are based in Kingston.\n- UNSUPPORTED: We were founded in 1990.\nSomething else"
+
+	verification, err := NewLLMVerifier(llm).Verify(context.Background(), "We are based in Kingston. We were founded in 1990.", []Chunk{{Content: "Based in Kingston."}})
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if verification.Supported || len(verification.Claims) != 2 {
+		t.Fatalf("Expected one of two claims to be unsupported, got %+v", verification)
+	}
+	if unsupported := verification.UnsupportedClaims(); len(unsupported) != 1 || unsupported[0] != "We were founded in 1990." {
+		t.Errorf("Expected the founding claim to be unsupported, got %v", unsupported)
+	}
+
+	prompt := llm.Requests[0][1].Content
+	if !strings.Contains(prompt, "Document 1:\nBased in Kingston.") || !strings.Contains(prompt, "Answer:\nWe are based in Kingston.") {
+		t.Errorf("Expected the documents and the answer in the prompt, got %q", prompt)
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	for _, name := range []string{"", VerifierNone} {
+		if verifier, err := NewVerifier(name, nil); err != nil || verifier != nil {
+			t.Errorf("Expected no verifier for %q, got %v, %v", name, verifier, err)
+		}
+	}
+	for _, name := range []string{VerifierLexical, VerifierLLM} {
+		if verifier, err := NewVerifier(name, NewFakeLLMClient()); err != nil || verifier == nil {
+			t.Errorf("Expected verifier %q to be created, got %v", name, err)
+		}
+	}
+	if _, err := NewVerifier("oracle", nil); err == nil {
+		t.Error("Expected an error for an unknown verifier")
+	}
+}
@@ -1,99 +1,332 @@
 package chatbot
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/Epistemic-Technology/epistemic.technology/chatbot-backend/internal/backend"
 )
 
+// outsideKnowledgeResponse is the answer given, without asking the LLM, when
+// no documents are relevant to a query.
+const outsideKnowledgeResponse = "I'm sorry, but that is outside my knowledge. I can only answer questions about Epistemic Technology and the topics covered on this website."
+
+// unverifiedResponse replaces an answer that is not supported by the
+// documents it was given.
+const unverifiedResponse = "I'm sorry, but I couldn't find enough information on this website to answer that with confidence."
+
+const (
+	VerifyActionRegenerate = "regenerate"
+	VerifyActionFallback   = "fallback"
+)
+
 type ChatBot struct {
-	db              *backend.DB
-	embeddingClient *backend.EmbeddingClient
-	llmClient       *backend.LLMClient
+	db       *backend.DB
+	embedder backend.Embedder
+	llm      backend.LLMProvider
+	reranker backend.Reranker
+	verifier backend.Verifier
+	options  Options
+}
+
+func NewChatBot(db *backend.DB, embedder backend.Embedder, llm backend.LLMProvider) *ChatBot {
+	return NewChatBotWithOptions(db, embedder, llm, DefaultOptions(embedder))
 }
 
-func NewChatBot(db *backend.DB, embeddingClient *backend.EmbeddingClient, llmClient *backend.LLMClient) *ChatBot {
+func NewChatBotWithOptions(db *backend.DB, embedder backend.Embedder, llm backend.LLMProvider, options Options) *ChatBot {
+	reranker, err := backend.NewReranker(options.Reranker, db, llm)
+	if err != nil {
+		log.Printf("Warning: %v; candidates will not be reranked", err)
+		reranker = backend.NoopReranker{}
+	}
+	verifier, err := backend.NewVerifier(options.Verifier, llm)
+	if err != nil {
+		log.Printf("Warning: %v; responses will not be verified", err)
+	}
 	return &ChatBot{
-		db:              db,
-		embeddingClient: embeddingClient,
-		llmClient:       llmClient,
+		db:       db,
+		embedder: embedder,
+		llm:      llm,
+		reranker: reranker,
+		verifier: verifier,
+		options:  options,
 	}
 }
 
-func Chat(c *ChatBot, userID int, query string, history string) (response string, references []backend.Chunk, sources []backend.Document, err error) {
-	queryEmbedding, err := backend.CreateEmbedding(c.embeddingClient, query, userID)
+// Chat answers query using the chunks retrieved for it. history holds the
+// earlier turns of the conversation as user and assistant messages. sources
+// holds only the documents cited in the response.
+func Chat(ctx context.Context, c *ChatBot, userID int, query string, history []backend.Message) (response string, references []backend.Chunk, sources []backend.Document, err error) {
+	result, err := answer(ctx, c, userID, query, history, backend.SearchFilter{}, nil)
+	return result.Response, result.References, result.Sources, err
+}
+
+// ChatStream works like Chat but passes each piece of the response to onDelta
+// as it is generated. The references and sources are returned once the
+// response is complete.
+func ChatStream(ctx context.Context, c *ChatBot, userID int, query string, history []backend.Message, onDelta func(delta string) error) (response string, references []backend.Chunk, sources []backend.Document, err error) {
+	result, err := answer(ctx, c, userID, query, history, backend.SearchFilter{}, onDelta)
+	return result.Response, result.References, result.Sources, err
+}
+
+// answer retrieves chunks matching filter for query, rewriting it first if
+// enabled, expands them into passages and asks the LLM for a structured
+// answer that cites them. The retrieved chunks, not the passages, are
+// returned as references, and only the documents the answer cites as sources. If no
+// chunks are relevant it gives outsideKnowledgeResponse instead. If a
+// verifier is set, the response is checked against the passages before it
+// is returned. The response is streamed to onDelta if it is not nil; a
+// verified response is sent in one piece.
+//
+// Each stage runs within its own timeout from the options, and the whole
+// answer stops with an error wrapping ctx.Err() once ctx is done.
+func answer(ctx context.Context, c *ChatBot, userID int, query string, history []backend.Message, filter backend.SearchFilter, onDelta func(delta string) error) (ChatResult, error) {
+	history = backend.TrimHistory(history, c.options.HistoryTokens)
+
+	searchQuery := query
+	if c.options.RewriteQueries && len(history) > 0 {
+		rewriteCtx, cancel := withTimeout(ctx, c.options.LLMTimeout)
+		rewritten, err := backend.RewriteQuery(rewriteCtx, c.llm, history, query)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			return ChatResult{}, fmt.Errorf("failed to rewrite query: %w", ctx.Err())
+		} else if err != nil {
+			// Retrieval still works with the original query, if less well
+			log.Println("Error rewriting query: ", err)
+		} else {
+			log.Printf("Rewrote query %q as %q", query, rewritten)
+			searchQuery = rewritten
+		}
+	}
+
+	chunks, err := retrieveChunks(ctx, c, userID, searchQuery, filter)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to create embedding: %w", err)
+		return ChatResult{}, err
 	}
 
-	// Get similar chunks
-	chunks, err := backend.SimilaritySearch(c.db, queryEmbedding, 5)
+	passages, err := backend.ExpandChunks(ctx, c.db, chunks, c.options.NeighbourChunks, c.options.ContextTokens)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to search for similar chunks: %w", err)
+		return ChatResult{}, fmt.Errorf("failed to expand chunks: %w", err)
 	}
 
-	// Get response from LLM
-	finalQuery := buildUserQuery(query, history, chunks)
-	response, err = backend.Chat(c.llmClient, finalQuery)
+	messages := backend.ChatMessages(history, buildUserQuery(query, passages))
+	var reply backend.Answer
+	var verificationAction string
+	var verification *backend.Verification
+	switch {
+	case len(chunks) == 0:
+		log.Println("No relevant chunks found for query: ", searchQuery)
+		reply = backend.TextAnswer(outsideKnowledgeResponse)
+		err = sendWhole(onDelta, outsideKnowledgeResponse)
+	case c.verifier != nil:
+		// The response is only streamed once it has been verified
+		reply, verification, verificationAction, err = verifiedResponse(ctx, c, messages, passages)
+		if err == nil {
+			err = sendWhole(onDelta, reply.Text())
+		}
+	default:
+		reply, err = complete(ctx, c, messages, onDelta)
+	}
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to get chat response: %w", err)
+		return ChatResult{}, err
 	}
 
-	// Get source documents
-	sources, err = backend.DocumentsFromChunks(chunks, c.db)
+	sources, err := backend.DocumentsFromChunks(ctx, chunks, c.db)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to get source documents: %w", err)
+		return ChatResult{}, fmt.Errorf("failed to get source documents: %w", err)
 	}
+	citations := reply.Citations(passages)
+
+	result := ChatResult{
+		Response:   reply.Text(),
+		References: chunks,
+		Sources:    backend.CitedDocuments(citations, sources),
+		Citations:  citations,
+		Uncited:    len(citations) == 0,
 
-	return response, chunks, sources, nil
+		Verification:       verification,
+		VerificationAction: verificationAction,
+	}
+	if searchQuery != query {
+		result.RewrittenQuery = searchQuery
+	}
+	return result, nil
 }
 
-func buildUserQuery(query string, history string, chunks []backend.Chunk) string {
-	finalQuery := "This is our conversation history: " + history
-	finalQuery += "\n\n"
-	finalQuery += "This is a list of documents that are relevant to the conversation: "
-	for _, chunk := range chunks {
-		finalQuery += "Document ID: " + strconv.Itoa(chunk.DocumentID) + "\n"
-		finalQuery += "Document Content: " + chunk.Content + "\n"
+// sendWhole passes response to onDelta as a single piece, if onDelta is set.
+func sendWhole(onDelta func(delta string) error, response string) error {
+	if onDelta == nil {
+		return nil
 	}
-	finalQuery += "This is the user's query: " + query
-	return finalQuery
+	if err := onDelta(response); err != nil {
+		return fmt.Errorf("failed to stream chat response: %w", err)
+	}
+	return nil
 }
 
-func EmbedHugoDirectory(c *ChatBot, directory string) error {
-	log.Println("Embedding Hugo directory: ", directory)
-	docs, err := backend.HugoDirectoryToDocuments(directory, true)
+// complete asks the LLM for an answer to messages within LLMTimeout,
+// streaming its text to onDelta if it is not nil.
+func complete(ctx context.Context, c *ChatBot, messages []backend.Message, onDelta func(delta string) error) (backend.Answer, error) {
+	ctx, cancel := withTimeout(ctx, c.options.LLMTimeout)
+	defer cancel()
+
+	if onDelta != nil {
+		reply, err := backend.ChatAnswerStream(ctx, c.llm, messages, onDelta)
+		if err != nil {
+			return backend.Answer{}, fmt.Errorf("failed to stream chat response: %w", err)
+		}
+		return reply, nil
+	}
+	reply, err := backend.ChatAnswer(ctx, c.llm, messages)
 	if err != nil {
-		return fmt.Errorf("failed to convert directory to documents: %w", err)
+		return backend.Answer{}, fmt.Errorf("failed to get chat response: %w", err)
 	}
-	log.Println("Converted directory to documents: ", len(docs))
-	
-	user := &backend.User{ID: 1}
+	return reply, nil
+}
 
-	for i, doc := range docs {
-		log.Printf("Processing document %d/%d: %s", i+1, len(docs), doc.Title)
+// withTimeout returns a copy of ctx that is cancelled after timeout, or
+// only when ctx is if timeout is zero or less.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
 
-		if err := backend.InsertDocument(c.db, &doc); err != nil {
-			return fmt.Errorf("failed to insert document: %v", err)
-		}
+// verifiedResponse gets an answer to messages from the LLM and checks it
+// against passages with the verifier. An unsupported response is
+// regenerated once if OnVerifyFailure is VerifyActionRegenerate; otherwise,
+// or if the new response is also unsupported, it is replaced with
+// unverifiedResponse. The action taken, if any, is returned with the
+// verification of the final LLM response. If the verifier fails, the
+// response is returned unverified.
+func verifiedResponse(ctx context.Context, c *ChatBot, messages []backend.Message, passages []backend.Chunk) (backend.Answer, *backend.Verification, string, error) {
+	reply, err := complete(ctx, c, messages, nil)
+	if err != nil {
+		return backend.Answer{}, nil, "", err
+	}
+	verification, err := verify(ctx, c, reply.Text(), passages)
+	if err != nil && ctx.Err() != nil {
+		return backend.Answer{}, nil, "", fmt.Errorf("failed to verify chat response: %w", ctx.Err())
+	}
+	if err != nil || verification.Supported {
+		return reply, verification, "", nil
+	}
 
-		chunks, err := backend.ChunkDocument(&doc, c.embeddingClient, user, c.db)
+	if c.options.OnVerifyFailure == VerifyActionRegenerate {
+		messages = append(messages,
+			backend.Message{Role: backend.RoleAssistant, Content: reply.Text()},
+			backend.Message{Role: backend.RoleUser, Content: regenerateRequest(verification.UnsupportedClaims())},
+		)
+		reply, err = complete(ctx, c, messages, nil)
 		if err != nil {
-			return fmt.Errorf("error creating chunks: %v", err)
+			return backend.Answer{}, nil, "", err
+		}
+		verification, err = verify(ctx, c, reply.Text(), passages)
+		if err != nil && ctx.Err() != nil {
+			return backend.Answer{}, nil, "", fmt.Errorf("failed to verify chat response: %w", ctx.Err())
+		}
+		if err != nil || verification.Supported {
+			return reply, verification, VerifyActionRegenerate, nil
 		}
+	}
+	return backend.TextAnswer(unverifiedResponse), verification, VerifyActionFallback, nil
+}
 
-		log.Printf("Created %d chunks", len(chunks))
+func verify(ctx context.Context, c *ChatBot, response string, passages []backend.Chunk) (*backend.Verification, error) {
+	ctx, cancel := withTimeout(ctx, c.options.LLMTimeout)
+	defer cancel()
 
-		for j, chunk := range chunks {
-			chunk.DocumentID = doc.ID
-			if err := backend.InsertChunk(c.db, &chunk); err != nil {
-				return fmt.Errorf("error inserting chunk %d: %v", j, err)
-			}
-		}
+	verification, err := c.verifier.Verify(ctx, response, passages)
+	if err != nil {
+		log.Println("Error verifying response: ", err)
+		return nil, err
+	}
+	unsupported := verification.UnsupportedClaims()
+	log.Printf("Verified response with %s verifier: %d of %d claims unsupported", verification.Verifier, len(unsupported), len(verification.Claims))
+	for _, claim := range unsupported {
+		log.Printf("Unsupported claim: %q", claim)
 	}
+	return &verification, nil
+}
 
-	return nil
+func regenerateRequest(unsupported []string) string {
+	request := "These claims in your answer are not supported by the documents:\n"
+	for _, claim := range unsupported {
+		request += "- " + claim + "\n"
+	}
+	request += "Answer the query again using only information in the documents, citing them as before. If the documents do not answer the query, say so."
+	return request
+}
+
+// retrieveChunks searches for RerankCandidates chunks matching query and
+// filter and keeps the Search.Limit chunks ranked best by the reranker.
+func retrieveChunks(ctx context.Context, c *ChatBot, userID int, query string, filter backend.SearchFilter) ([]backend.Chunk, error) {
+	// The stored embeddings change model if the database is re-embedded while
+	// the server is running
+	if err := backend.CheckEmbedder(c.db, c.embedder); err != nil {
+		return nil, err
+	}
+
+	embeddingCtx, cancel := withTimeout(ctx, c.options.EmbeddingTimeout)
+	queryEmbedding, err := backend.CreateEmbedding(embeddingCtx, c.embedder, query, userID)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedding: %w", err)
+	}
+
+	options := c.options.Search
+	options.Filter = filter
+	options.Limit = max(options.Limit, c.options.RerankCandidates)
+	searchCtx, cancel := withTimeout(ctx, c.options.SearchTimeout)
+	candidates, err := backend.HybridSearch(searchCtx, c.db, query, queryEmbedding, options)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for similar chunks: %w", err)
+	}
+
+	rerankCtx, cancel := withTimeout(ctx, c.options.LLMTimeout)
+	chunks, err := c.reranker.Rerank(rerankCtx, query, candidates, c.options.Search.Limit)
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("failed to rerank chunks: %w", ctx.Err())
+	}
+	if err != nil {
+		// The retrieved order is still a reasonable ranking
+		log.Println("Error reranking chunks: ", err)
+		chunks = candidates[:min(len(candidates), c.options.Search.Limit)]
+	}
+	return chunks, nil
+}
+
+// buildUserQuery numbers the passages so the LLM can cite them by number in
+// its structured answer.
+func buildUserQuery(query string, chunks []backend.Chunk) string {
+	finalQuery := "This is a list of documents that are relevant to the conversation: "
+	for i, chunk := range chunks {
+		finalQuery += "[" + strconv.Itoa(i+1) + "] Document ID: " + strconv.Itoa(chunk.DocumentID) + "\n"
+		finalQuery += "Document Content: " + chunk.Content + "\n"
+	}
+	finalQuery += "This is the user's query: " + query
+	return finalQuery
+}
+
+// SyncHugoDirectory brings the stored documents up to date with the Markdown
+// files under directory, splitting new and changed documents with chunker.
+// Chunks embedded by earlier syncs are taken from the embedding cache.
+func SyncHugoDirectory(c *ChatBot, directory string, chunker backend.Chunker) (backend.SyncResult, error) {
+	log.Println("Syncing Hugo directory: ", directory)
+	user := &backend.User{ID: 1}
+	embedder := backend.NewCachingEmbedder(c.db, c.embedder)
+	result, err := backend.SyncHugoDirectory(c.db, directory, true, chunker, embedder, user)
+	log.Println("Embeddings: ", embedder.Stats())
+	if err != nil {
+		return result, fmt.Errorf("failed to sync directory: %w", err)
+	}
+	log.Println("Synced Hugo directory: ", result)
+	return result, nil
 }
 
@@ -1,9 +1,13 @@
 package chatbot
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Epistemic-Technology/epistemic.technology/chatbot-backend/internal/backend"
 	"github.com/joho/godotenv"
@@ -91,11 +95,11 @@ func TestChat(t *testing.T) {
 
 	// Test with a simple query
 	query := "What is artificial intelligence?"
-	history := ""
+	var history []backend.Message
 	userID := 1
 
 	// Call the Chat function
-	response, references, sources, err := Chat(chatbot, userID, query, history)
+	response, references, sources, err := Chat(context.Background(), chatbot, userID, query, history)
 	if err != nil {
 		t.Fatalf("Chat failed: %v", err)
 	}
@@ -139,11 +143,11 @@ func TestChatWithNoRelevantDocuments(t *testing.T) {
 
 	// Test with a query that should not match any documents
 	query := "What is the meaning of life?"
-	history := ""
+	var history []backend.Message
 	userID := 1
 
 	// Call the Chat function
-	response, references, sources, err := Chat(chatbot, userID, query, history)
+	response, references, sources, err := Chat(context.Background(), chatbot, userID, query, history)
 	if err != nil {
 		t.Fatalf("Chat failed: %v", err)
 	}
@@ -182,13 +186,9 @@ func TestBuildUserQuery(t *testing.T) {
 
 	// Test with empty history
 	query := "What is artificial intelligence?"
-	history := ""
-	result := buildUserQuery(query, history, chunks)
+	result := buildUserQuery(query, chunks)
 
 	// Verify the result contains the expected components
-	if !contains(result, "This is our conversation history: ") {
-		t.Error("Expected result to contain conversation history header")
-	}
 	if !contains(result, "This is a list of documents that are relevant to the conversation: ") {
 		t.Error("Expected result to contain documents header")
 	}
@@ -226,10 +226,13 @@ func TestChatWithHistory(t *testing.T) {
 	// Test with history
 	query := "Tell me more about it"
 	userID := 1
-	history := "User: What is in the test document?\nBot: The test document contains information about testing the chatbot."
+	history := []backend.Message{
+		{Role: backend.RoleUser, Content: "What is in the test document?"},
+		{Role: backend.RoleAssistant, Content: "The test document contains information about testing the chatbot."},
+	}
 
 	// Call the Chat function
-	response, references, sources, err := Chat(chatbot, userID, query, history)
+	response, references, sources, err := Chat(context.Background(), chatbot, userID, query, history)
 	if err != nil {
 		t.Fatalf("Chat failed: %v", err)
 	}
@@ -250,6 +253,565 @@ func TestChatWithHistory(t *testing.T) {
 	}
 }
 
+func TestChatStream(t *testing.T) {
+	if os.Getenv("OPENAI_API_KEY") == "" {
+		t.Skip("OPENAI_API_KEY not set, skipping test")
+	}
+
+	chatbot, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	var deltas []string
+	response, references, sources, err := ChatStream(context.Background(), chatbot, 1, "What is artificial intelligence?", nil, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatStream failed: %v", err)
+	}
+
+	if len(deltas) == 0 {
+		t.Error("Expected at least one delta, got none")
+	}
+	if strings.Join(deltas, "") != response {
+		t.Errorf("Expected deltas to add up to the response %q, got %q", response, strings.Join(deltas, ""))
+	}
+	if len(references) == 0 {
+		t.Error("Expected references, got none")
+	}
+	if len(sources) == 0 {
+		t.Error("Expected sources, got none")
+	}
+}
+
+func setupOfflineTestEnvironment(t *testing.T) (*ChatBot, *backend.FakeLLMClient) {
+	database, err := backend.GetDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() { backend.Close(database) })
+
+	embedder := backend.NewLocalEmbedder(0)
+	llm := backend.NewFakeLLMClient()
+	if err := backend.UseEmbedder(database, embedder); err != nil {
+		t.Fatalf("Failed to record embedder: %v", err)
+	}
+
+	doc := &backend.Document{
+		Title:   "Test Document",
+		Content: "Epistemic Technology is an AI consultancy based in Kingston, New York.\n\nWe build retrieval augmented generation systems.",
+	}
+	if err := backend.InsertDocument(database, doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	chunks, err := backend.ChunkDocument(doc, backend.NewMarkdownChunker(0, 0), embedder, &backend.User{ID: 1}, database)
+	if err != nil {
+		t.Fatalf("Failed to chunk document: %v", err)
+	}
+	for i := range chunks {
+		if err := backend.InsertChunk(database, &chunks[i]); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+	}
+
+	return NewChatBot(database, embedder, llm), llm
+}
+
+func TestChatOffline(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+
+	response, references, sources, err := Chat(context.Background(), chatbot, 1, "Where is Epistemic Technology based?", nil)
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+
+	if !strings.HasPrefix(response, "Fake response to: ") {
+		t.Errorf("Expected the fake LLM response, got %q", response)
+	}
+	if len(references) == 0 {
+		t.Error("Expected references, got none")
+	}
+	// The echoed prompt numbers the passages, but cites none of them
+	if len(sources) != 0 {
+		t.Errorf("Expected no sources for an answer that cites nothing, got %+v", sources)
+	}
+	if len(llm.Requests) != 1 {
+		t.Fatalf("Expected 1 LLM request, got %d", len(llm.Requests))
+	}
+	if !contains(response, "Kingston, New York") {
+		t.Error("Expected the retrieved document to be sent to the LLM")
+	}
+}
+
+func TestChatOutsideKnowledge(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+	chatbot.options.Search.MaxDistance = 0.01
+
+	var deltas []string
+	response, references, sources, err := ChatStream(context.Background(), chatbot, 1, "What is the capital of France?", nil, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatStream failed: %v", err)
+	}
+	if response != outsideKnowledgeResponse || strings.Join(deltas, "") != response {
+		t.Errorf("Expected the outside knowledge response, got %q", response)
+	}
+	if len(references) != 0 || len(sources) != 0 {
+		t.Errorf("Expected no references or sources, got %d and %d", len(references), len(sources))
+	}
+	if len(llm.Requests) != 0 {
+		t.Errorf("Expected the LLM not to be asked, got %d requests", len(llm.Requests))
+	}
+}
+
+func TestChatOutsideKnowledgeWithDefaultOptions(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+	if chatbot.options.Search.MaxDistance != backend.DefaultMaxDistance(backend.LocalEmbeddingModel) || chatbot.options.Search.MaxDistance <= 0 {
+		t.Fatalf("Expected the default cutoff for the local embedder, got %v", chatbot.options.Search.MaxDistance)
+	}
+
+	response, _, _, err := Chat(context.Background(), chatbot, 1, "What is the capital of France?", nil)
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if response != outsideKnowledgeResponse || len(llm.Requests) != 0 {
+		t.Errorf("Expected the outside knowledge response without asking the LLM, got %q", response)
+	}
+}
+
+func TestChatExpandsNeighbours(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+
+	doc := &backend.Document{
+		Title:   "Projects",
+		Content: "Our projects are listed below.\n\nThe first project is a search engine for philosophy papers.\n\nIt was released in 2024.",
+	}
+	if err := backend.InsertDocument(chatbot.db, doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	chunks, err := backend.EmbedDocumentChunks(doc, &backend.ParagraphChunker{}, chatbot.embedder, &backend.User{ID: 1})
+	if err != nil {
+		t.Fatalf("Failed to chunk document: %v", err)
+	}
+	for i := range chunks {
+		if err := backend.InsertChunk(chatbot.db, &chunks[i]); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+	}
+
+	chatbot.options.Search.Limit = 1
+	chatbot.options.NeighbourChunks = 1
+	_, references, _, err := Chat(context.Background(), chatbot, 1, "The first project is a search engine for philosophy papers.", nil)
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if len(references) != 1 || references[0].Content != "The first project is a search engine for philosophy papers." {
+		t.Fatalf("Expected the matching paragraph as the only reference, got %+v", references)
+	}
+	prompt := llm.Requests[0][len(llm.Requests[0])-1].Content
+	if !contains(prompt, "Our projects are listed below.\n\nThe first project is a search engine for philosophy papers.\n\nIt was released in 2024.") {
+		t.Errorf("Expected the neighbouring paragraphs in the prompt, got %q", prompt)
+	}
+}
+
+// reversingReranker records its candidates and returns them in reverse.
+type reversingReranker struct {
+	candidates []backend.Chunk
+}
+
+func (r *reversingReranker) Rerank(ctx context.Context, query string, candidates []backend.Chunk, limit int) ([]backend.Chunk, error) {
+	r.candidates = candidates
+	reversed := make([]backend.Chunk, 0, len(candidates))
+	for i := len(candidates) - 1; i >= 0 && len(reversed) < limit; i-- {
+		reversed = append(reversed, candidates[i])
+	}
+	return reversed, nil
+}
+
+func TestChatReranks(t *testing.T) {
+	chatbot, _ := setupOfflineTestEnvironment(t)
+
+	doc := &backend.Document{
+		Title:   "Services",
+		Content: "We offer consulting.\n\nWe offer training.\n\nWe offer development.",
+	}
+	if err := backend.InsertDocument(chatbot.db, doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	chunks, err := backend.EmbedDocumentChunks(doc, &backend.ParagraphChunker{}, chatbot.embedder, &backend.User{ID: 1})
+	if err != nil {
+		t.Fatalf("Failed to chunk document: %v", err)
+	}
+	for i := range chunks {
+		if err := backend.InsertChunk(chatbot.db, &chunks[i]); err != nil {
+			t.Fatalf("Failed to insert chunk: %v", err)
+		}
+	}
+
+	reranker := &reversingReranker{}
+	chatbot.reranker = reranker
+	chatbot.options.Search.Limit = 1
+	chatbot.options.Search.MaxChunksPerDocument = 0
+	chatbot.options.RerankCandidates = 3
+	_, references, _, err := Chat(context.Background(), chatbot, 1, "What do you offer?", nil)
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if len(reranker.candidates) != 3 {
+		t.Fatalf("Expected 3 candidates to be reranked, got %d", len(reranker.candidates))
+	}
+	if len(references) != 1 || references[0].ID != reranker.candidates[2].ID {
+		t.Errorf("Expected the reranker's choice as the only reference, got %+v", references)
+	}
+}
+
+func TestChatInConversationCitations(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+
+	llm.Response = `{"segments": [{"text": "We are based in Kingston, New York.", "passages": [1]}, {"text": "We also sell boats.", "passages": [9]}]}`
+	result, err := ChatInConversation(context.Background(), chatbot, 1, "", "Where is Epistemic Technology based?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("ChatInConversation failed: %v", err)
+	}
+	if !contains(llm.Requests[0][len(llm.Requests[0])-1].Content, "[1] Document ID: ") {
+		t.Error("Expected the passages to be numbered in the prompt")
+	}
+	if result.Uncited || len(result.Citations) != 1 {
+		t.Fatalf("Expected one citation, got %+v", result.Citations)
+	}
+	citation := result.Citations[0]
+	if citation.ChunkID != result.References[0].ID || result.Response[citation.Start:citation.End] != "We are based in Kingston, New York." {
+		t.Errorf("Expected the first sentence to cite the first reference, got %+v", citation)
+	}
+	if len(result.Sources) != 1 || result.Sources[0].ID != result.References[0].DocumentID {
+		t.Errorf("Expected the cited document as the only source, got %+v", result.Sources)
+	}
+
+	llm.Response = "We are based in Kingston, New York."
+	result, err = ChatInConversation(context.Background(), chatbot, 1, result.ConversationID, "Is Epistemic Technology really based in Kingston?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("ChatInConversation failed: %v", err)
+	}
+	if !result.Uncited || len(result.Sources) != 0 {
+		t.Errorf("Expected an uncited answer without sources, got %+v", result)
+	}
+	history := llm.Requests[1][1:3]
+	if history[1].Content != "We are based in Kingston, New York. We also sell boats." {
+		t.Errorf("Expected the answer text in the history, got %q", history[1].Content)
+	}
+}
+
+func TestChatInConversationVerification(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+	chatbot.verifier = backend.NewLexicalVerifier()
+
+	llm.Response = `{"segments": [{"text": "Epistemic Technology is an AI consultancy based in Kingston, New York.", "passages": [1]}]}`
+	result, err := ChatInConversation(context.Background(), chatbot, 1, "", "Where is Epistemic Technology based?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("ChatInConversation failed: %v", err)
+	}
+	if result.Response != "Epistemic Technology is an AI consultancy based in Kingston, New York." || result.Uncited || result.Verification == nil || !result.Verification.Supported || result.VerificationAction != "" {
+		t.Errorf("Expected the supported response to be kept, got %+v", result)
+	}
+
+	llm.Response = `{"segments": [{"text": "We were founded on the moon by astronauts in 1850.", "passages": [1]}]}`
+	result, err = ChatInConversation(context.Background(), chatbot, 1, "", "When was Epistemic Technology founded?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("ChatInConversation failed: %v", err)
+	}
+	if result.Response != unverifiedResponse || result.VerificationAction != VerifyActionFallback || !result.Uncited {
+		t.Errorf("Expected the fallback response, got %+v", result)
+	}
+
+	chatbot.options.OnVerifyFailure = VerifyActionRegenerate
+	requests := len(llm.Requests)
+	var deltas []string
+	result, err = ChatInConversationStream(context.Background(), chatbot, 1, "", "When was Epistemic Technology founded?", backend.SearchFilter{}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatInConversationStream failed: %v", err)
+	}
+	if len(llm.Requests) != requests+2 {
+		t.Fatalf("Expected the response to be regenerated once, got %d requests", len(llm.Requests)-requests)
+	}
+	regenerate := llm.Requests[len(llm.Requests)-1]
+	if !contains(regenerate[len(regenerate)-1].Content, "- We were founded on the moon by astronauts in 1850.") {
+		t.Errorf("Expected the unsupported claim in the regeneration request, got %q", regenerate[len(regenerate)-1].Content)
+	}
+	if result.Response != unverifiedResponse || result.VerificationAction != VerifyActionFallback {
+		t.Errorf("Expected the fallback after a second unsupported response, got %+v", result)
+	}
+	if len(deltas) != 1 || deltas[0] != unverifiedResponse {
+		t.Errorf("Expected only the verified response to be streamed, got %q", deltas)
+	}
+}
+
+// blockingLLM never responds, returning only once its context is done.
+type blockingLLM struct{}
+
+func (blockingLLM) Complete(ctx context.Context, messages []backend.Message) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (l blockingLLM) CompleteStream(ctx context.Context, messages []backend.Message, onDelta func(delta string) error) (string, error) {
+	return l.Complete(ctx, messages)
+}
+
+func (l blockingLLM) CompleteJSON(ctx context.Context, messages []backend.Message, schema backend.ResponseSchema) (string, error) {
+	return l.Complete(ctx, messages)
+}
+
+func (l blockingLLM) CompleteJSONStream(ctx context.Context, messages []backend.Message, schema backend.ResponseSchema, onDelta func(delta string) error) (string, error) {
+	return l.Complete(ctx, messages)
+}
+
+func TestChatInConversationCancelled(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := ChatInConversation(ctx, chatbot, 1, "", "Where is Epistemic Technology based?", backend.SearchFilter{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancellation error, got %v", err)
+	}
+	if len(llm.Requests) != 0 {
+		t.Errorf("Expected the LLM not to be asked, got %d requests", len(llm.Requests))
+	}
+	if result.ConversationID != "" {
+		t.Errorf("Expected no conversation to be returned, got %q", result.ConversationID)
+	}
+
+	chatbot.llm = blockingLLM{}
+	chatbot.options.LLMTimeout = 10 * time.Millisecond
+	_, err = ChatInConversation(context.Background(), chatbot, 1, "", "Where is Epistemic Technology based?", backend.SearchFilter{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the LLM request to time out, got %v", err)
+	}
+}
+
+// failingLLM fails every request.
+type failingLLM struct{}
+
+func (failingLLM) Complete(ctx context.Context, messages []backend.Message) (string, error) {
+	return "", errors.New("LLM unavailable")
+}
+
+func (l failingLLM) CompleteStream(ctx context.Context, messages []backend.Message, onDelta func(delta string) error) (string, error) {
+	return l.Complete(ctx, messages)
+}
+
+func (l failingLLM) CompleteJSON(ctx context.Context, messages []backend.Message, schema backend.ResponseSchema) (string, error) {
+	return l.Complete(ctx, messages)
+}
+
+func (l failingLLM) CompleteJSONStream(ctx context.Context, messages []backend.Message, schema backend.ResponseSchema, onDelta func(delta string) error) (string, error) {
+	return l.Complete(ctx, messages)
+}
+
+func TestChatInConversationFailureStoresNothing(t *testing.T) {
+	chatbot, _ := setupOfflineTestEnvironment(t)
+	chatbot.llm = failingLLM{}
+
+	if _, err := ChatInConversation(context.Background(), chatbot, 1, "", "Where is Epistemic Technology based?", backend.SearchFilter{}); err == nil {
+		t.Fatal("Expected the failing LLM to fail the query")
+	}
+
+	// Pruning everything updated before now counts every stored conversation
+	stored, err := backend.PruneConversations(context.Background(), chatbot.db, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if stored != 0 {
+		t.Errorf("Expected no conversation to be stored, got %d", stored)
+	}
+}
+
+func TestChatTrimsHistory(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+	chatbot.options.HistoryTokens = 20
+
+	history := []backend.Message{
+		{Role: backend.RoleUser, Content: "What services do you offer? We are looking for help."},
+		{Role: backend.RoleAssistant, Content: "We offer consulting."},
+		{Role: backend.RoleUser, Content: "Do you build software?"},
+		{Role: backend.RoleAssistant, Content: "Yes, we do."},
+	}
+	if _, _, _, err := Chat(context.Background(), chatbot, 1, "How much do your retrieval augmented generation systems cost?", history); err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	messages := llm.Requests[0]
+
+	// The oldest turn does not fit in the budget
+	expected := []string{backend.RoleSystem, backend.RoleUser, backend.RoleAssistant, backend.RoleUser}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got %+v", len(expected), messages)
+	}
+	for i, role := range expected {
+		if messages[i].Role != role {
+			t.Errorf("Expected message %d to have role %s, got %s", i, role, messages[i].Role)
+		}
+	}
+	if messages[1].Content != "Do you build software?" || messages[2].Content != "Yes, we do." {
+		t.Errorf("Expected the most recent turn to be kept, got %+v", messages[1:3])
+	}
+	if !contains(messages[3].Content, "This is the user's query: How much do your retrieval augmented generation systems cost?") {
+		t.Errorf("Expected the query in the last message, got %q", messages[3].Content)
+	}
+}
+
+func TestChatInConversation(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+
+	first, err := ChatInConversation(context.Background(), chatbot, 1, "", "Where is Epistemic Technology based?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if first.ConversationID == "" {
+		t.Fatal("Expected a new conversation ID")
+	}
+
+	second, err := ChatInConversation(context.Background(), chatbot, 1, first.ConversationID, "What retrieval systems do they build?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if second.ConversationID != first.ConversationID {
+		t.Errorf("Expected the conversation to continue, got ID %q", second.ConversationID)
+	}
+	request := llm.Requests[1]
+	if len(request) != 4 || request[1] != (backend.Message{Role: backend.RoleUser, Content: "Where is Epistemic Technology based?"}) ||
+		request[2] != (backend.Message{Role: backend.RoleAssistant, Content: first.Response}) {
+		t.Errorf("Expected the stored turn in the history, got %+v", request)
+	}
+
+	turns, err := backend.GetConversationTurns(context.Background(), chatbot.db, first.ConversationID, 0)
+	if err != nil {
+		t.Fatalf("Failed to get turns: %v", err)
+	}
+	if len(turns) != 2 || turns[1].Query != "What retrieval systems do they build?" || len(turns[0].ChunkIDs) == 0 {
+		t.Errorf("Expected 2 stored turns with chunk IDs, got %+v", turns)
+	}
+
+	unknown, err := ChatInConversation(context.Background(), chatbot, 1, "unknown", "Hello, where is Epistemic Technology based?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if unknown.ConversationID == "unknown" || unknown.ConversationID == first.ConversationID {
+		t.Errorf("Expected an unknown ID to start a new conversation, got %q", unknown.ConversationID)
+	}
+	if len(llm.Requests[2]) != 2 {
+		t.Errorf("Expected a new conversation to have no history, got %+v", llm.Requests[2])
+	}
+}
+
+func TestChatInConversationRewritesQuery(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+	chatbot.options.RewriteQueries = true
+
+	first, err := ChatInConversation(context.Background(), chatbot, 1, "", "What does Epistemic Technology build?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if first.RewrittenQuery != "" || len(llm.Requests) != 1 {
+		t.Errorf("Expected a query without history not to be rewritten, got %q", first.RewrittenQuery)
+	}
+
+	llm.Response = "Where is Epistemic Technology based?"
+	second, err := ChatInConversation(context.Background(), chatbot, 1, first.ConversationID, "Where are they based?", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if len(llm.Requests) != 3 {
+		t.Fatalf("Expected a rewrite request and a chat request after the first turn, got %d requests", len(llm.Requests))
+	}
+	if !contains(llm.Requests[1][1].Content, "Where are they based?") {
+		t.Errorf("Expected the follow-up to be sent for rewriting, got %q", llm.Requests[1][1].Content)
+	}
+	if second.RewrittenQuery != "Where is Epistemic Technology based?" {
+		t.Errorf("Expected the rewritten query in the result, got %q", second.RewrittenQuery)
+	}
+	if !contains(llm.Requests[2][len(llm.Requests[2])-1].Content, "This is the user's query: Where are they based?") {
+		t.Error("Expected the LLM to answer the original query")
+	}
+
+	turns, err := backend.GetConversationTurns(context.Background(), chatbot.db, first.ConversationID, 0)
+	if err != nil {
+		t.Fatalf("Failed to get turns: %v", err)
+	}
+	if len(turns) != 2 || turns[1].RewrittenQuery != second.RewrittenQuery {
+		t.Errorf("Expected the rewritten query to be stored with the turn, got %+v", turns)
+	}
+}
+
+func TestChatInConversationFilter(t *testing.T) {
+	chatbot, llm := setupOfflineTestEnvironment(t)
+
+	result, err := ChatInConversation(context.Background(), chatbot, 1, "", "Where is Epistemic Technology based?", backend.SearchFilter{Sections: []string{"blog"}})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if result.Response != outsideKnowledgeResponse || len(result.References) != 0 {
+		t.Errorf("Expected no documents outside the filter to be used, got %+v", result)
+	}
+	if len(llm.Requests) != 0 {
+		t.Errorf("Expected the LLM not to be asked, got %d requests", len(llm.Requests))
+	}
+}
+
+func TestChatInConversationExpiry(t *testing.T) {
+	chatbot, _ := setupOfflineTestEnvironment(t)
+	chatbot.options.ConversationTTL = time.Hour
+
+	expired, err := backend.CreateConversation(context.Background(), chatbot.db, "expired")
+	if err != nil {
+		t.Fatalf("Failed to create conversation: %v", err)
+	}
+	turn := &backend.ConversationTurn{ConversationID: expired.ID, Query: "Old question", Response: "Old answer"}
+	if err := backend.AddConversationTurn(context.Background(), chatbot.db, turn); err != nil {
+		t.Fatalf("Failed to add turn: %v", err)
+	}
+	if _, err := backend.PruneConversations(context.Background(), chatbot.db, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if _, err := backend.GetConversation(context.Background(), chatbot.db, expired.ID); err != nil {
+		t.Fatalf("Expected a recent conversation to survive pruning: %v", err)
+	}
+
+	// Let the conversation expire
+	chatbot.options.ConversationTTL = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+
+	result, err := ChatInConversation(context.Background(), chatbot, 1, expired.ID, "Hello", backend.SearchFilter{})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if result.ConversationID == expired.ID {
+		t.Error("Expected an expired conversation to be replaced")
+	}
+	if _, err := backend.GetConversation(context.Background(), chatbot.db, expired.ID); !errors.Is(err, backend.ErrConversationNotFound) {
+		t.Errorf("Expected the expired conversation to be pruned, got %v", err)
+	}
+}
+
+func TestChatRefusesReembeddedDatabase(t *testing.T) {
+	chatbot, _ := setupOfflineTestEnvironment(t)
+
+	// The database is re-embedded with another model while the bot runs
+	_, err := backend.Reembed(context.Background(), chatbot.db, backend.NewLocalEmbedder(16), &backend.User{ID: 1}, 0, nil)
+	if err != nil {
+		t.Fatalf("Reembed failed: %v", err)
+	}
+
+	_, _, _, err = Chat(context.Background(), chatbot, 1, "Where is Epistemic Technology based?", nil)
+	if !errors.Is(err, backend.ErrEmbeddingModelMismatch) {
+		t.Errorf("Expected queries with the old model to be refused, got %v", err)
+	}
+}
+
 func TestChatWithEmbeddingError(t *testing.T) {
 	// Save the original environment variable
 	originalAPIKey := os.Getenv("OPENAI_API_KEY")
@@ -0,0 +1,123 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Epistemic-Technology/epistemic.technology/chatbot-backend/internal/backend"
+)
+
+// ChatResult is the answer to a query asked within a conversation.
+// RewrittenQuery is the standalone query used for retrieval if the query was
+// rewritten using the conversation history. Sources holds the documents cited
+// by Citations, and Uncited is set when the response cites nothing.
+// Verification is the check of the response against its passages, if a
+// verifier is set, and VerificationAction is VerifyActionRegenerate or
+// VerifyActionFallback if the response failed it.
+type ChatResult struct {
+	ConversationID string
+	RewrittenQuery string
+	Response       string
+	References     []backend.Chunk
+	Sources        []backend.Document
+	Citations      []backend.Citation
+	Uncited        bool
+
+	Verification       *backend.Verification
+	VerificationAction string
+}
+
+// ChatInConversation answers query as the next turn of the conversation with
+// conversationID, using its stored turns as history, and stores the new turn.
+// An empty, unknown or expired conversationID starts a new conversation,
+// whose ID is returned in the result. Only documents matching filter are used
+// to answer. The turn is not stored if ctx is done before it is answered.
+func ChatInConversation(ctx context.Context, c *ChatBot, userID int, conversationID string, query string, filter backend.SearchFilter) (ChatResult, error) {
+	return chatInConversation(ctx, c, userID, conversationID, query, filter, nil)
+}
+
+// ChatInConversationStream works like ChatInConversation but passes each
+// piece of the response to onDelta as it is generated.
+func ChatInConversationStream(ctx context.Context, c *ChatBot, userID int, conversationID string, query string, filter backend.SearchFilter, onDelta func(delta string) error) (ChatResult, error) {
+	return chatInConversation(ctx, c, userID, conversationID, query, filter, onDelta)
+}
+
+func chatInConversation(ctx context.Context, c *ChatBot, userID int, conversationID string, query string, filter backend.SearchFilter, onDelta func(delta string) error) (ChatResult, error) {
+	conversationID, history, isNew, err := loadConversation(ctx, c, conversationID)
+	if err != nil {
+		return ChatResult{}, err
+	}
+
+	result, err := answer(ctx, c, userID, query, history, filter, onDelta)
+	if err != nil {
+		return ChatResult{}, err
+	}
+	result.ConversationID = conversationID
+
+	turn := &backend.ConversationTurn{
+		ConversationID: conversationID,
+		Query:          query,
+		RewrittenQuery: result.RewrittenQuery,
+		Response:       result.Response,
+	}
+	for _, chunk := range result.References {
+		turn.ChunkIDs = append(turn.ChunkIDs, chunk.ID)
+	}
+	// A new conversation is only stored with its first turn, so a query that
+	// fails leaves nothing behind
+	err = backend.WithTx(c.db, func(tx *backend.DB) error {
+		if isNew {
+			if _, err := backend.CreateConversation(ctx, tx, conversationID); err != nil {
+				return err
+			}
+		}
+		return backend.AddConversationTurn(ctx, tx, turn)
+	})
+	if err != nil {
+		return ChatResult{}, fmt.Errorf("failed to store conversation turn: %w", err)
+	}
+
+	return result, nil
+}
+
+// loadConversation returns the ID and history of the conversation, or a new
+// ID, reported by isNew, if it does not exist or has expired. The new
+// conversation is not stored until its first turn is. Expired conversations
+// are pruned whenever a new one is started.
+func loadConversation(ctx context.Context, c *ChatBot, conversationID string) (id string, history []backend.Message, isNew bool, err error) {
+	if conversationID != "" {
+		conversation, err := backend.GetConversation(ctx, c.db, conversationID)
+		switch {
+		case errors.Is(err, backend.ErrConversationNotFound):
+			log.Println("Unknown conversation, starting a new one: ", conversationID)
+		case err != nil:
+			return "", nil, false, err
+		case c.options.ConversationTTL > 0 && time.Since(conversation.UpdatedAt) > c.options.ConversationTTL:
+			log.Println("Conversation expired, starting a new one: ", conversationID)
+		default:
+			turns, err := backend.GetConversationTurns(ctx, c.db, conversationID, c.options.HistoryTurns)
+			if err != nil {
+				return "", nil, false, err
+			}
+			return conversationID, backend.TurnsToMessages(turns), false, nil
+		}
+	}
+
+	if c.options.ConversationTTL > 0 {
+		pruned, err := backend.PruneConversations(ctx, c.db, time.Now().Add(-c.options.ConversationTTL))
+		if err != nil {
+			log.Println("Error pruning expired conversations: ", err)
+		} else if pruned > 0 {
+			log.Printf("Pruned %d expired conversations", pruned)
+		}
+	}
+
+	id, err = backend.NewConversationID()
+	if err != nil {
+		return "", nil, false, err
+	}
+	return id, nil, true, nil
+}
@@ -0,0 +1,162 @@
+package chatbot
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Epistemic-Technology/epistemic.technology/chatbot-backend/internal/backend"
+)
+
+// Options configures how the ChatBot retrieves context and answers queries.
+type Options struct {
+	Search backend.HybridSearchOptions
+	// Reranker names the backend.Reranker that chooses the final
+	// Search.Limit chunks from RerankCandidates search results: none,
+	// keyword or llm.
+	Reranker         string
+	RerankCandidates int
+	// NeighbourChunks is the number of chunks either side of each retrieved
+	// chunk added to the context given to the LLM.
+	NeighbourChunks int
+	// ContextTokens is the approximate token budget for that context. Zero or
+	// less disables the budget.
+	ContextTokens int
+	// ConversationTTL is how long a conversation is kept after its last turn.
+	ConversationTTL time.Duration
+	// HistoryTurns is the number of previous turns of a conversation given to
+	// the LLM.
+	HistoryTurns int
+	// HistoryTokens is the approximate token budget for those turns. The
+	// oldest turns are dropped until the history fits. Zero or less disables
+	// the budget.
+	HistoryTokens int
+	// Verifier names the backend.Verifier that checks responses against the
+	// passages they were generated from: none, lexical or llm.
+	Verifier string
+	// OnVerifyFailure is the action taken when a response fails
+	// verification: VerifyActionRegenerate or VerifyActionFallback.
+	OnVerifyFailure string
+	// EmbeddingTimeout, SearchTimeout and LLMTimeout bound the time taken to
+	// embed a query, to search for its chunks and by each request to the
+	// LLM. Zero or less sets no deadline.
+	EmbeddingTimeout time.Duration
+	SearchTimeout    time.Duration
+	LLMTimeout       time.Duration
+	// RewriteQueries enables asking the LLM to rewrite follow-up queries as
+	// standalone queries, using the conversation history, before retrieval.
+	RewriteQueries bool
+}
+
+// DefaultOptions returns the default options for a ChatBot using embedder,
+// whose model sets the distance cutoff beyond which chunks are irrelevant.
+func DefaultOptions(embedder backend.Embedder) Options {
+	search := backend.DefaultHybridSearchOptions()
+	search.MaxDistance = backend.DefaultMaxDistance(embedder.Model())
+	return Options{
+		Search:           search,
+		Reranker:         backend.RerankerNone,
+		RerankCandidates: 20,
+		ContextTokens:    3000,
+		ConversationTTL:  24 * time.Hour,
+		HistoryTurns:     10,
+		HistoryTokens:    1500,
+		Verifier:         backend.VerifierNone,
+		OnVerifyFailure:  VerifyActionFallback,
+		EmbeddingTimeout: 10 * time.Second,
+		SearchTimeout:    10 * time.Second,
+		LLMTimeout:       60 * time.Second,
+	}
+}
+
+// OptionsFromEnv returns DefaultOptions overridden by any of the following
+// environment variables that are set: SEARCH_LIMIT, SEARCH_CANDIDATE_LIMIT,
+// SEARCH_KEYWORD_WEIGHT, SEARCH_VECTOR_WEIGHT, SEARCH_MAX_DISTANCE,
+// SEARCH_MMR_LAMBDA, SEARCH_MAX_CHUNKS_PER_DOCUMENT, RERANKER,
+// RERANK_CANDIDATES, CONTEXT_NEIGHBOUR_CHUNKS, CONTEXT_MAX_TOKENS,
+// CONVERSATION_TTL, CONVERSATION_HISTORY_TURNS, CONVERSATION_HISTORY_TOKENS,
+// REWRITE_QUERIES, ANSWER_VERIFIER, ANSWER_VERIFY_FAILURE, EMBEDDING_TIMEOUT,
+// SEARCH_TIMEOUT and LLM_TIMEOUT.
+func OptionsFromEnv(embedder backend.Embedder) Options {
+	options := DefaultOptions(embedder)
+	envInt("SEARCH_LIMIT", &options.Search.Limit)
+	envInt("SEARCH_CANDIDATE_LIMIT", &options.Search.CandidateLimit)
+	envFloat("SEARCH_KEYWORD_WEIGHT", &options.Search.KeywordWeight)
+	envFloat("SEARCH_VECTOR_WEIGHT", &options.Search.VectorWeight)
+	envFloat("SEARCH_MAX_DISTANCE", &options.Search.MaxDistance)
+	envFloat("SEARCH_MMR_LAMBDA", &options.Search.MMRLambda)
+	envInt("SEARCH_MAX_CHUNKS_PER_DOCUMENT", &options.Search.MaxChunksPerDocument)
+	envString("RERANKER", &options.Reranker)
+	envInt("RERANK_CANDIDATES", &options.RerankCandidates)
+	envInt("CONTEXT_NEIGHBOUR_CHUNKS", &options.NeighbourChunks)
+	envInt("CONTEXT_MAX_TOKENS", &options.ContextTokens)
+	envDuration("CONVERSATION_TTL", &options.ConversationTTL)
+	envInt("CONVERSATION_HISTORY_TURNS", &options.HistoryTurns)
+	envInt("CONVERSATION_HISTORY_TOKENS", &options.HistoryTokens)
+	envBool("REWRITE_QUERIES", &options.RewriteQueries)
+	envString("ANSWER_VERIFIER", &options.Verifier)
+	envString("ANSWER_VERIFY_FAILURE", &options.OnVerifyFailure)
+	envDuration("EMBEDDING_TIMEOUT", &options.EmbeddingTimeout)
+	envDuration("SEARCH_TIMEOUT", &options.SearchTimeout)
+	envDuration("LLM_TIMEOUT", &options.LLMTimeout)
+	return options
+}
+
+func envString(name string, target *string) {
+	if value := os.Getenv(name); value != "" {
+		*target = value
+	}
+}
+
+func envInt(name string, target *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: ignoring invalid %s %q: %v", name, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func envFloat(name string, target *float64) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Warning: ignoring invalid %s %q: %v", name, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func envBool(name string, target *bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: ignoring invalid %s %q: %v", name, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func envDuration(name string, target *time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: ignoring invalid %s %q: %v", name, value, err)
+		return
+	}
+	*target = parsed
+}
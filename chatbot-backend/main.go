@@ -18,6 +18,11 @@ import (
 
 	dbPathFlag := flag.String("db", "", "Path to the database file (overrides DATABASE_PATH env var)")
 	apiKeyFlag := flag.String("api-key", "", "OpenAI API key (overrides OPENAI_API_KEY env var)")
+	llmProviderFlag := flag.String("llm-provider", "", "LLM provider: openai, openai-compatible or fake (overrides LLM_PROVIDER env var)")
+	llmBaseURLFlag := flag.String("llm-base-url", "", "Base URL of an OpenAI-compatible LLM server (overrides LLM_BASE_URL env var)")
+	llmModelFlag := flag.String("llm-model", "", "LLM model name (overrides LLM_MODEL env var)")
+	chunkStrategyFlag := flag.String("chunk-strategy", "", "Chunking strategy: markdown or paragraph (overrides CHUNK_STRATEGY env var)")
+	embeddingProviderFlag := flag.String("embedding-provider", "", "Embedding provider: openai or local (overrides EMBEDDING_PROVIDER env var)")
 	portFlag := flag.String("port", "", "Port to run the API on (overrides PORT env var)")
 	hugoContentPathFlag := flag.String("hugo-content-path", "", "Path to the Hugo content directory (overrides HUGO_CONTENT_PATH env var)")
 	flag.Parse()
@@ -33,8 +38,27 @@ import (
 	apiKey := *apiKeyFlag
 	if apiKey != "" {
 		os.Setenv("OPENAI_API_KEY", apiKey)
-	} else if os.Getenv("OPENAI_API_KEY") == "" {
-		log.Fatal("Error: No OpenAI API key provided. Use --api-key flag or set OPENAI_API_KEY environment variable")
+	}
+
+	llmConfig := backend.LLMConfigFromEnv()
+	if *llmProviderFlag != "" {
+		llmConfig.Provider = *llmProviderFlag
+	}
+	if *llmBaseURLFlag != "" {
+		llmConfig.BaseURL = *llmBaseURLFlag
+	}
+	if *llmModelFlag != "" {
+		llmConfig.Model = *llmModelFlag
+	}
+
+	chunkerConfig := backend.ChunkerConfigFromEnv()
+	if *chunkStrategyFlag != "" {
+		chunkerConfig.Strategy = *chunkStrategyFlag
+	}
+
+	embeddingConfig := backend.EmbeddingConfigFromEnv()
+	if *embeddingProviderFlag != "" {
+		embeddingConfig.Provider = *embeddingProviderFlag
 	}
 
 	port := *portFlag
@@ -57,21 +81,31 @@ import (
 	}
 	defer backend.Close(database)
 
-	embeddingClient, err := backend.NewEmbeddingClient()
+	embedder, err := backend.NewEmbedder(embeddingConfig)
 	if err != nil {
-		log.Fatalf("Error creating embeddings client: %v", err)
+		log.Fatalf("Error creating embedder: %v", err)
+	}
+	if err := backend.UseEmbedder(database, embedder); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 
-	llmClient, err := backend.NewLLMClient()
+	llm, err := backend.NewLLMProvider(llmConfig)
 	if err != nil {
-		log.Fatalf("Error creating LLM client: %v", err)
+		log.Fatalf("Error creating LLM provider: %v", err)
 	}
 
-	bot := chatbot.NewChatBot(database, embeddingClient, llmClient)
+	bot := chatbot.NewChatBotWithOptions(database, embedder, llm, chatbot.OptionsFromEnv(embedder))
+
+	chunker, err := backend.NewChunker(chunkerConfig)
+	if err != nil {
+		log.Fatalf("Error creating chunker: %v", err)
+	}
 
-	err = chatbot.EmbedHugoDirectory(bot, os.Getenv("HUGO_CONTENT_PATH"))
+	// A failed sync leaves the documents synced so far in place, so the API
+	// can still answer from them. The next start retries the rest.
+	_, err = chatbot.SyncHugoDirectory(bot, os.Getenv("HUGO_CONTENT_PATH"), chunker)
 	if err != nil {
-		log.Fatalf("Error embedding Hugo directory: %v", err)
+		log.Printf("Warning: error syncing Hugo directory: %v", err)
 	}
 
 	api.StartAPI(bot)
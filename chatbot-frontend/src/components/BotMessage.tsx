@@ -1,7 +1,7 @@
 import { Component, For, JSX } from "solid-js";
 import { BotMessageProps } from "../types";
 import TerminalMessageWrapper from "./TerminalMessageWrapper";
-import { filePathToURL } from "../utils/siteUtils";
+import { sourceURL } from "../utils/siteUtils";
 
 const BotMessage: Component<BotMessageProps> = (props) => {
   return (
@@ -10,6 +10,11 @@ const BotMessage: Component<BotMessageProps> = (props) => {
         {props.content.split("\n").map((paragraph, index) => (
           <p class="mt-2 !p-0">{paragraph || "\u00A0"}</p>
         ))}
+        {props.uncited && (
+          <p class="mt-2 !p-0 italic">
+            This answer does not cite any sources.
+          </p>
+        )}
         {props.sources && (
           <>
             <p>Sources:</p>
@@ -22,7 +27,7 @@ const BotMessage: Component<BotMessageProps> = (props) => {
                     </span>
                     <a
                       class="!text-blue-300"
-                      href={filePathToURL(source.FilePath)}
+                      href={sourceURL(source)}
                     >
                       {source.Title}
                     </a>
@@ -2,6 +2,8 @@ import { Component, For, createSignal, createEffect, JSX } from "solid-js";
 import {
   Buffer,
   ChatBufferProps,
+  ChatFilters,
+  Citation,
   TerminalMessageProps,
   Source,
   ChatRequest,
@@ -10,13 +12,14 @@ import UserMessage from "./UserMessage";
 import BotMessage from "./BotMessage";
 import UserInput from "./UserInput";
 import Navbar from "./Navbar";
-import { filePathToURL } from "../utils/siteUtils";
+import { filePathToURL, sourceURL } from "../utils/siteUtils";
 
 const ChatBuffer: Component<{
   id: string;
   chatHistory?: TerminalMessageProps[];
   isLoading?: boolean;
   apiUrl?: string;
+  filters?: ChatFilters;
   onExit?: () => void;
   setNavbar?: (navbar: JSX.Element) => void;
 }> = (props) => {
@@ -26,6 +29,7 @@ const ChatBuffer: Component<{
   const storageKey = `chat_history_${props.id}`;
   const sourcesStorageKey = `chat_sources_${props.id}`;
   const sourceIndexStorageKey = `chat_source_index_${props.id}`;
+  const conversationIdStorageKey = `chat_conversation_id_${props.id}`;
 
   const loadChatHistory = (): TerminalMessageProps[] => {
     if (typeof window === "undefined") return props.chatHistory || [];
@@ -80,6 +84,12 @@ const ChatBuffer: Component<{
     return 0;
   };
 
+  const loadConversationId = (): string => {
+    if (typeof window === "undefined") return "";
+
+    return localStorage.getItem(conversationIdStorageKey) || "";
+  };
+
   const [chatHistory, setChatHistory] = createSignal<TerminalMessageProps[]>(
     loadChatHistory()
   );
@@ -87,6 +97,9 @@ const ChatBuffer: Component<{
   const [apiUrl] = createSignal(props.apiUrl || defaultApiUrl);
   const [sources, setSources] = createSignal<Source[]>(loadSources());
   const [sourceIndex, setSourceIndex] = createSignal(loadSourceIndex());
+  const [conversationId, setConversationId] = createSignal(
+    loadConversationId()
+  );
 
   const addSource = (source: Source): Source => {
     if (sources().length < 9) {
@@ -119,6 +132,17 @@ const ChatBuffer: Component<{
     }
   });
 
+  createEffect(() => {
+    const currentConversationId = conversationId();
+    if (typeof window !== "undefined") {
+      try {
+        localStorage.setItem(conversationIdStorageKey, currentConversationId);
+      } catch (error) {
+        console.error("Error saving conversation ID to localStorage:", error);
+      }
+    }
+  });
+
   createEffect(() => {
     const currentSources = sources();
     const currentSourceIndex = sourceIndex();
@@ -200,9 +224,7 @@ const ChatBuffer: Component<{
         ...prev,
         {
           type: "bot",
-          content: `${source.index}: ${source.Title} - ${filePathToURL(
-            source.FilePath
-          )}`,
+          content: `${source.index}: ${source.Title} - ${sourceURL(source)}`,
         },
       ]);
     }
@@ -215,7 +237,7 @@ const ChatBuffer: Component<{
       index < sourcesArray.length &&
       sourcesArray[index].FilePath
     ) {
-      window.location.href = filePathToURL(sourcesArray[index].FilePath);
+      window.location.href = sourceURL(sourcesArray[index]);
     } else {
       setChatHistory((prev) => [
         ...prev,
@@ -227,12 +249,40 @@ const ChatBuffer: Component<{
     }
   };
 
+  // Each citation gives the span of the response that cites a passage. Mark
+  // the end of each cited span with the indexes of the cited sources, as used
+  // by the :1-9 commands.
+  const citationsToSourceIndexes = (
+    content: string,
+    citations: Citation[],
+    sources: Source[]
+  ): string => {
+    const indexesByEnd = new Map<number, number[]>();
+    for (const citation of citations) {
+      const source = sources.find((s) => s.ID === citation.document_id);
+      if (!source?.index) {
+        continue;
+      }
+      const indexes = indexesByEnd.get(citation.end) || [];
+      if (!indexes.includes(source.index)) {
+        indexes.push(source.index);
+      }
+      indexesByEnd.set(citation.end, indexes);
+    }
+    let marked = "";
+    let last = 0;
+    for (const end of [...indexesByEnd.keys()].sort((a, b) => a - b)) {
+      marked += `${content.slice(last, end)} [:${indexesByEnd.get(end)!.join(", :")}]`;
+      last = end;
+    }
+    return marked + content.slice(last);
+  };
+
   const handleChatSubmit = async (query: string) => {
     const chatRequest: ChatRequest = {
       query: query,
-      history: chatHistory()
-        .map((message) => message.content)
-        .join("\n"),
+      conversation_id: conversationId(),
+      filters: props.filters,
     };
     setChatHistory((prev) => [
       ...prev,
@@ -269,12 +319,15 @@ const ChatBuffer: Component<{
           return;
         case "clear":
           setChatHistory([]);
+          setConversationId("");
           return;
         case "reset":
           localStorage.removeItem(storageKey);
           localStorage.removeItem(sourcesStorageKey);
           localStorage.removeItem(sourceIndexStorageKey);
+          localStorage.removeItem(conversationIdStorageKey);
           setChatHistory(loadChatHistory());
+          setConversationId("");
           setSources([]);
           setSourceIndex(0);
           return;
@@ -317,6 +370,7 @@ const ChatBuffer: Component<{
       }
 
       const data = await response.json();
+      setConversationId(data.conversation_id);
       const sources = [];
       for (const source of data.sources) {
         sources.push(addSource(source));
@@ -326,8 +380,13 @@ const ChatBuffer: Component<{
         ...prev,
         {
           type: "bot",
-          content: data.response,
+          content: citationsToSourceIndexes(
+            data.response,
+            data.citations || [],
+            sources
+          ),
           sources: sources,
+          uncited: data.uncited,
         },
       ]);
     } catch (error) {
@@ -390,6 +449,7 @@ const ChatBuffer: Component<{
               <BotMessage
                 content={message.content}
                 sources={message.sources}
+                uncited={message.uncited}
                 type="bot"
               />
             )}
@@ -422,6 +482,7 @@ export const createChatBuffer = (
         chatHistory={props.chatHistory}
         isLoading={props.isLoading}
         apiUrl={props.apiUrl}
+        filters={props.filters}
         onExit={props.onExit}
         setNavbar={props.setNavbar}
       />
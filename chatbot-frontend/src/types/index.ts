@@ -9,21 +9,41 @@ export interface TerminalMessageProps {
   type: "user" | "bot";
   content: string;
   sources?: Source[];
+  uncited?: boolean;
 }
 
 export interface Source {
   index?: number;
   Title: string;
   FilePath: string;
+  URL?: string;
   Author: string;
   ID: number;
   Content: string;
   PublicationDate: string;
 }
 
+export interface Citation {
+  marker: number;
+  start: number;
+  end: number;
+  chunk_id: number;
+  document_id: number;
+}
+
+export interface ChatFilters {
+  sections?: string[];
+  tags?: string[];
+  categories?: string[];
+  published_from?: string;
+  published_to?: string;
+  document_ids?: number[];
+}
+
 export interface ChatRequest {
   query: string;
-  history: string;
+  conversation_id: string;
+  filters?: ChatFilters;
 }
 
 export interface BotMessageProps extends TerminalMessageProps {}
@@ -48,5 +68,6 @@ export interface ChatBufferProps {
   chatHistory?: TerminalMessageProps[];
   isLoading?: boolean;
   apiUrl?: string;
+  filters?: ChatFilters;
   onExit?: () => void;
 }
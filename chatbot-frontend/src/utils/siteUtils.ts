@@ -1,3 +1,5 @@
+import { Source } from "../types";
+
 /**
  * Convert a file path to a URL on the Epistemic Technology site
  * @param filePath - The file path to convert
@@ -15,3 +17,16 @@ export const filePathToURL = (filePath: string) => {
   }
   return new URL(urlPath, window.location.origin).toString();
 };
+
+/**
+ * Get the URL of a source, preferring the public URL computed by the backend
+ * and falling back to one derived from the file path
+ * @param source - The source to link to
+ * @returns The URL
+ */
+export const sourceURL = (source: Source) => {
+  if (source.URL) {
+    return source.URL;
+  }
+  return filePathToURL(source.FilePath);
+};